@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditOutput receives the audit log, a JSON object per line for every
+// record the webhook creates or deletes, regardless of the log format and
+// verbosity. It is replaced in tests.
+var (
+	auditOutput io.Writer = os.Stdout
+	auditMu     sync.Mutex
+)
+
+// Operations and outcomes of audit log entries.
+const (
+	auditCreate  = "create"
+	auditDelete  = "delete"
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// auditEntry is a line of the audit log. It never holds the value of a
+// record, which is the key of a challenge, nor the API token. The zone ID
+// and name of a deleted record are empty if the client didn't see it
+// before.
+type auditEntry struct {
+	Log        string `json:"log"`
+	Time       string `json:"time"`
+	Operation  string `json:"operation"`
+	ZoneID     string `json:"zoneId"`
+	RecordName string `json:"recordName"`
+	RecordType string `json:"recordType"`
+	RecordID   string `json:"recordId"`
+	Outcome    string `json:"outcome"`
+	// ErrorClass classifies the error of a failure, see auditErrorClass.
+	ErrorClass string `json:"errorClass,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+}
+
+// audit writes an audit log entry for an operation on record e with the
+// outcome err.
+func (c *HetznerClient) audit(operation string, e Entry, err error) {
+	entry := auditEntry{
+		Log:        "audit",
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Operation:  operation,
+		ZoneID:     e.ZoneID,
+		RecordName: e.Name,
+		RecordType: e.Type,
+		RecordID:   e.ID,
+		Outcome:    auditSuccess,
+		DryRun:     c.dryRun,
+	}
+	if err != nil {
+		entry.Outcome = auditFailure
+		entry.ErrorClass = auditErrorClass(err)
+	}
+	line, _ := json.Marshal(entry)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditOutput.Write(append(line, '\n'))
+}
+
+// auditErrorClass returns a short, stable name for the kind of err, e.g.
+// "unauthorized" or "server_error", without its message, which may quote
+// the request.
+func auditErrorClass(err error) string {
+	var apiErr *apiError
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrInvalidRecord):
+		return "invalid_record"
+	case errors.Is(err, ErrAuthFailed):
+		return "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound:
+			return "not_found"
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return "rate_limited"
+		case apiErr.StatusCode >= 500:
+			return "server_error"
+		default:
+			return "client_error"
+		}
+	default:
+		return "network"
+	}
+}
+
+// seenRecords remembers the records clients listed or created for
+// recordIDTTL, so that the audit log of a deletion names the zone and
+// record, also when CleanUp deletes a record by the ID Present got. Its
+// zero value is empty, a nil one remembers nothing.
+type seenRecords struct {
+	mu      sync.Mutex
+	entries map[string]seenRecord
+}
+
+type seenRecord struct {
+	entry   Entry
+	expires time.Time
+}
+
+func (s *seenRecords) add(records ...Entry) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.entries == nil {
+		s.entries = map[string]seenRecord{}
+	}
+	for id, r := range s.entries {
+		if now.After(r.expires) {
+			delete(s.entries, id)
+		}
+	}
+	for _, e := range records {
+		if e.ID != "" {
+			e.Value = ""
+			s.entries[e.ID] = seenRecord{entry: e, expires: now.Add(recordIDTTL)}
+		}
+	}
+}
+
+// take returns and forgets the record with the given ID, or an entry with
+// only the ID if it wasn't seen.
+func (s *seenRecords) take(id string) Entry {
+	if s == nil {
+		return Entry{ID: id}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.entries[id]
+	delete(s.entries, id)
+	if !ok {
+		return Entry{ID: id}
+	}
+	return r.entry
+}
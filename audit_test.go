@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureAudit makes the audit log be written to the returned buffer until
+// restore is called.
+func captureAudit() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	previous := auditOutput
+	auditOutput = &buf
+	return &buf, func() {
+		auditMu.Lock()
+		defer auditMu.Unlock()
+		auditOutput = previous
+	}
+}
+
+func auditEntries(t *testing.T, buf *bytes.Buffer) []auditEntry {
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e auditEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		assert.NotEmpty(t, e.Time)
+		e.Time = ""
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	buf, restore := captureAudit()
+	defer restore()
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	assert.NoError(t, solver.Present(newChallengeRequest("secret-key", `{"apiKey": "token"}`)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("secret-key", `{"apiKey": "token"}`)))
+	assert.Empty(t, m.records)
+
+	// the challenge record and its owner marker are created and deleted
+	entries := auditEntries(t, buf)
+	if assert.Len(t, entries, 4) {
+		for i, op := range []string{auditCreate, auditCreate, auditDelete, auditDelete} {
+			assert.Equal(t, op, entries[i].Operation)
+		}
+		assert.Equal(t, auditEntry{Log: "audit", Operation: auditDelete, ZoneID: "zone1", RecordName: "_acme-challenge", RecordType: "TXT",
+			RecordID: entries[0].RecordID, Outcome: auditSuccess}, entries[2])
+	}
+	for _, e := range entries {
+		assert.Equal(t, auditSuccess, e.Outcome)
+		assert.Equal(t, "zone1", e.ZoneID, "%+v", e)
+		assert.NotEmpty(t, e.RecordID, "%+v", e)
+	}
+	assert.NotContains(t, buf.String(), "secret-key", "the record value must never be logged")
+	assert.NotContains(t, buf.String(), "token")
+
+	// failures carry the class of the error only
+	buf.Reset()
+	m.statuses = map[string]int{"POST /records": 500}
+	assert.Error(t, solver.Present(newChallengeRequest("secret-key", `{"apiKey": "token"}`)))
+	entries = auditEntries(t, buf)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, auditEntry{Log: "audit", Operation: auditCreate, ZoneID: "zone1", RecordName: "_acme-challenge", RecordType: "TXT",
+			Outcome: auditFailure, ErrorClass: "server_error"}, entries[0])
+	}
+	assert.NotContains(t, buf.String(), "secret-key")
+
+	// records deleted without having been listed are identified by ID
+	buf.Reset()
+	client := NewHetznerClient(srv.URL, "token")
+	client.dryRun = true
+	assert.NoError(t, client.DeleteRecord(context.Background(), "record1"))
+	entries = auditEntries(t, buf)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, auditEntry{Log: "audit", Operation: auditDelete, RecordID: "record1", Outcome: auditSuccess, DryRun: true}, entries[0])
+	}
+}
+
+func TestAuditErrorClass(t *testing.T) {
+	for expected, err := range map[string]error{
+		"circuit_open":   ErrCircuitOpen,
+		"invalid_record": ErrInvalidRecord,
+		"unauthorized":   &apiError{StatusCode: 401},
+		"forbidden":      &apiError{StatusCode: 403},
+		"not_found":      &apiError{StatusCode: 404},
+		"rate_limited":   &apiError{StatusCode: 429},
+		"client_error":   &apiError{StatusCode: 422},
+		"server_error":   &apiError{StatusCode: 502},
+		"network":        errors.New("connection refused"),
+	} {
+		assert.Equal(t, expected, auditErrorClass(err), "%v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ErrAuthFailed is matched by API errors rejecting the API token itself, as
+// opposed to a transient failure of the API's authentication backend.
+// Repeating the request won't help until the token is fixed.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrForbidden is matched by API errors of 403 responses: the API accepted
+// the token, but it lacks access to the zone or record, e.g. because it is
+// scoped to other zones.
+var ErrForbidden = errors.New("forbidden")
+
+// transientAuthMessages are the parts of 401 response bodies which indicate
+// that authentication failed for reasons other than the token, e.g. while
+// the API's authentication backend is unavailable.
+var transientAuthMessages = []string{
+	"temporarily",
+	"try again",
+	"unavailable",
+	"timeout",
+	"timed out",
+}
+
+// isTransientAuthFailure reports whether a 401 response with the given body
+// or headers looks like a transient failure rather than a rejected token.
+// Responses announcing a retry with Retry-After count as transient as well.
+// Anything else, including an empty body, counts as a rejected token.
+func isTransientAuthFailure(header http.Header, body string) bool {
+	if header.Get("Retry-After") != "" {
+		return true
+	}
+	body = strings.ToLower(body)
+	for _, msg := range transientAuthMessages {
+		if strings.Contains(body, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientAuthResponse reports whether resp is a 401 response of a
+// transient authentication failure. The body must have been buffered with
+// bufferBody, it is left for the caller to read.
+func isTransientAuthResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return err == nil && isTransientAuthFailure(resp.Header, string(body))
+}
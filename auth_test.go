@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientAuthFailure(t *testing.T) {
+	for body, transient := range map[string]bool{
+		``: false,
+		`{"message":"Invalid authentication credentials"}`:                     false,
+		`{"error":{"message":"invalid token","code":401}}`:                     false,
+		`{"message":"Authentication service temporarily unavailable"}`:         true,
+		`{"error":{"message":"auth backend timed out, try again","code":401}}`: true,
+	} {
+		assert.Equal(t, transient, isTransientAuthFailure(http.Header{}, body), body)
+	}
+	assert.True(t, isTransientAuthFailure(http.Header{"Retry-After": {"1"}}, ""))
+}
+
+func TestHetznerClient_AuthFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		body      string
+		attempts  int
+		transient bool
+	}{
+		{"rejected token", `{"message":"Invalid authentication credentials"}`, 1, false},
+		{"transient failure", `{"message":"Authentication service temporarily unavailable"}`, 3, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			client := NewHetznerClient(srv.URL, "token")
+			client.maxRetries = 2
+			client.retryBaseDelay = time.Millisecond
+
+			_, err := client.ListRecords(context.Background(), "zone1")
+			assert.Error(t, err)
+			assert.Equal(t, tt.attempts, attempts, "only transient failures may be retried")
+			assert.Equal(t, !tt.transient, errors.Is(err, ErrAuthFailed), "got %v", err)
+			assert.Equal(t, tt.transient, isTransientError(err))
+		})
+	}
+}
+
+func TestHetznerClient_RecoversFromTransientAuthFailure(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"Authentication service temporarily unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"records":[]}`))
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.retryBaseDelay = time.Millisecond
+
+	records, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestPresent_AuthFailed(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	err := solver.Present(newChallengeRequest("key", `{"apiKey": "wrong", "verboseErrors": true}`))
+	assert.True(t, errors.Is(err, ErrAuthFailed), "got %v", err)
+	assert.EqualError(t, err, "listing zones failed with HTTP 401 Unauthorized: Invalid authentication credentials", "no further lookups must be made to describe the error")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrCircuitOpen is returned for requests not sent to the API because the
+// circuit breaker is open after too many consecutive failures.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Defaults of the circuit breaker: it opens after the given number of
+// consecutive failed requests and lets a probe through after the cooldown.
+const (
+	defaultCircuitBreakerThreshold       = 5
+	defaultCircuitBreakerCooldownSeconds = 30
+)
+
+// States of a circuit breaker, as reported by the api_circuit_breaker_state
+// metric.
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// circuitBreaker stops sending requests to the API after threshold
+// consecutive failures, requests failing with ErrCircuitOpen instead. After
+// cooldown, it lets a single request through to probe whether the API
+// recovered, closing again if it succeeds and staying open for another
+// cooldown otherwise. Requests fail if they can't be sent or the API
+// answers with a server error; other responses show the API is up.
+type circuitBreaker struct {
+	apiURL    string
+	threshold int
+	cooldown  time.Duration
+	// now returns the current time, replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(apiURL string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{apiURL: apiURL, threshold: threshold, cooldown: cooldown, now: time.Now}
+	b.setState(circuitClosed)
+	return b
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent. Otherwise,
+// the outcome of the request has to be passed to done, or release called
+// if it tells nothing about the API.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		retryIn := b.cooldown - b.now().Sub(b.openedAt)
+		if retryIn > 0 {
+			return fmt.Errorf("%w: %d consecutive requests to the API failed, trying again in %v", ErrCircuitOpen, b.failures, retryIn.Round(time.Second))
+		}
+		b.setState(circuitHalfOpen)
+		klog.Infof("sending a request to %s to probe whether the API recovered", redactURL(b.apiURL))
+	case circuitHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w: waiting for a probe request to the API", ErrCircuitOpen)
+		}
+	}
+	if b.state == circuitHalfOpen {
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of a request allowed by allow.
+func (b *circuitBreaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		if b.state != circuitClosed {
+			klog.Infof("requests to %s succeed again, closing the circuit breaker", redactURL(b.apiURL))
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state == circuitClosed {
+			klog.Warningf("%d consecutive requests to %s failed, not sending requests for %v", b.failures, redactURL(b.apiURL), b.cooldown)
+		}
+		b.openedAt = b.now()
+		b.setState(circuitOpen)
+	}
+}
+
+// release ends a request allowed by allow without recording its outcome.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// setState changes the state and its metric. b.mu must be held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	apiCircuitBreakerState.WithLabelValues(redactURL(b.apiURL)).Set(float64(state))
+}
+
+// withCircuitBreaker fails requests with ErrCircuitOpen while breaker is
+// open. It goes before retries, so that a request failing after all its
+// attempts counts as a single failure.
+func withCircuitBreaker(breaker *circuitBreaker) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := breaker.allow(); err != nil {
+				return nil, err
+			}
+			resp, err := next.RoundTrip(req)
+			if err != nil && (req.Context().Err() != nil || errors.Is(err, ErrResponseTooLarge)) {
+				// a canceled request or a large response says nothing
+				// about the API being down
+				breaker.release()
+			} else {
+				breaker.done(err != nil || resp.StatusCode >= 500)
+			}
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker("https://dns.example.com/api/v1", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	state := func() float64 {
+		return testutil.ToFloat64(apiCircuitBreakerState.WithLabelValues("https://dns.example.com/api/v1"))
+	}
+	assert.Equal(t, float64(circuitClosed), state())
+
+	// a success resets the consecutive failures
+	for _, failed := range []bool{true, false, true} {
+		assert.NoError(t, b.allow())
+		b.done(failed)
+	}
+	assert.Equal(t, float64(circuitClosed), state())
+
+	assert.NoError(t, b.allow())
+	b.done(true)
+	err := b.allow()
+	assert.True(t, errors.Is(err, ErrCircuitOpen), "%v", err)
+	assert.Equal(t, float64(circuitOpen), state())
+
+	// after the cooldown, a single probe is let through
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.allow())
+	assert.Equal(t, float64(circuitHalfOpen), state())
+	assert.True(t, errors.Is(b.allow(), ErrCircuitOpen), "only one probe may be in flight")
+
+	// a failed probe opens the breaker for another cooldown
+	b.done(true)
+	assert.Equal(t, float64(circuitOpen), state())
+	now = now.Add(30 * time.Second)
+	assert.True(t, errors.Is(b.allow(), ErrCircuitOpen))
+
+	// a probe ending without an outcome lets the next one through
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, b.allow())
+	b.release()
+	assert.Equal(t, float64(circuitHalfOpen), state())
+	assert.NoError(t, b.allow())
+
+	// a successful probe closes it
+	b.done(false)
+	assert.Equal(t, float64(circuitClosed), state())
+	assert.NoError(t, b.allow())
+}
+
+func TestCircuitBreakerFor(t *testing.T) {
+	solver := &hetznerDNSProviderSolver{}
+	b := solver.circuitBreakerFor("https://dns.example.com/api/v1", 2, time.Minute)
+	assert.NoError(t, b.allow())
+	b.done(true)
+
+	// other settings don't replace the breaker and reset its failures
+	assert.NotSame(t, b, solver.circuitBreakerFor("https://dns.example.com/api/v1", 3, time.Minute))
+	assert.NotSame(t, b, solver.circuitBreakerFor("https://dns.example.com/api/v1", 2, time.Second))
+	assert.Same(t, b, solver.circuitBreakerFor("https://dns.example.com/api/v1", 2, time.Minute))
+	assert.NoError(t, b.allow())
+	b.done(true)
+	assert.True(t, errors.Is(b.allow(), ErrCircuitOpen))
+}
+
+func TestHetznerClient_CircuitBreaker(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "maxRetries": 1, "retryBaseDelayMilliseconds": 1, "circuitBreakerThreshold": 2}`)})
+	assert.NoError(t, err)
+	client, err := solver.newClient(context.Background(), cfg, newChallengeRequest("key", ""), "example.com")
+	assert.NoError(t, err)
+	now := time.Now()
+	client.circuitBreaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err = client.ListRecords(context.Background(), "zone1")
+		assert.Contains(t, err.Error(), "HTTP 503")
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "each request must count once however often it was retried")
+
+	// other clients of the same API URL fail fast as well
+	other, err := solver.newClient(context.Background(), cfg, newChallengeRequest("other", ""), "example.org")
+	assert.NoError(t, err)
+	for _, c := range []*HetznerClient{client, other} {
+		_, err = c.ListRecords(context.Background(), "zone1")
+		assert.True(t, errors.Is(err, ErrCircuitOpen), "%v", err)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	now = now.Add(defaultCircuitBreakerCooldownSeconds * time.Second)
+	_, err = client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	_, err = other.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+
+	// client errors show that the API is up
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	for i := 0; i < 3; i++ {
+		_, err = client.ListRecords(context.Background(), "zone1")
+		assert.False(t, errors.Is(err, ErrCircuitOpen), "%v", err)
+	}
+
+	cfg.CircuitBreakerThreshold = -1
+	client, err = solver.newClient(context.Background(), cfg, newChallengeRequest("key", ""), "example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, client.circuitBreaker)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "circuitBreakerCooldownSeconds": -1}`)})
+	assert.EqualError(t, err, "circuitBreakerCooldownSeconds must not be negative but is -1")
+}
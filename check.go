@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+// checkCommand is the first argument running runCheck instead of the
+// webhook server.
+const checkCommand = "check"
+
+// runCheck checks that a zone can be managed with a solver config outside
+// of the webhook server, e.g. before setting up an issuer, and prints a
+// report to out. It returns the exit code of the command.
+//
+// The zone is looked up and its records are listed. Creating the challenge
+// record is only logged unless -write is set, in which case a scratch
+// record is created and deleted again.
+func runCheck(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet(checkCommand, flag.ContinueOnError)
+	fs.SetOutput(out)
+	zone := fs.String("zone", "", "name of the zone to check, e.g. example.com")
+	config := fs.String("config", "{}", "solver config as in the issuer, as JSON; the API token defaults to HETZNER_API_TOKEN")
+	write := fs.Bool("write", false, "create and delete a scratch record instead of only logging the create")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *zone == "" {
+		fmt.Fprintln(out, "-zone is required")
+		fs.Usage()
+		return 2
+	}
+
+	failed := false
+	report := func(step string, err error, format string, args ...interface{}) bool {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(out, "FAIL %s: %v\n", step, err)
+			return false
+		}
+		fmt.Fprintf(out, "PASS %s: %s\n", step, fmt.Sprintf(format, args...))
+		return true
+	}
+
+	ctx := context.Background()
+	solver := &hetznerDNSProviderSolver{}
+	z, ok := solver.checkZone(ctx, []byte(*config), *zone, !*write, nil, report)
+	if !ok {
+		return 1
+	}
+	cfg, client, zoneID := z.cfg, z.client, z.id
+
+	records, err := client.ListRecords(ctx, zoneID)
+	report("list records", err, "%d records", len(records))
+
+	if *write {
+		err = solver.checkZoneWritable(ctx, client, zoneID, z.name)
+		report("create and delete record", err, "created and deleted a scratch %s record", defaultRecordType)
+	} else {
+		_, err = client.CreateRecord(ctx, Entry{Name: preflightRecordName, TTL: cfg.TTL, Type: defaultRecordType, Value: "check", ZoneID: zoneID})
+		report("create record", err, "dry run, the request was logged instead of sent; pass -write to create and delete a scratch record")
+	}
+
+	if failed {
+		fmt.Fprintln(out, "check failed")
+		return 1
+	}
+	fmt.Fprintln(out, "all checks passed")
+	return 0
+}
+
+// stepFunc reports the outcome of the step name of a check, with the detail
+// formatted from format and args if it passed, and returns whether it did.
+type stepFunc func(name string, err error, format string, args ...interface{}) bool
+
+// checkedZone is what checkZone found out about a zone.
+type checkedZone struct {
+	cfg    hetznerDNSProviderConfig
+	client *HetznerClient
+	// name is the zone normalized like the zone of a challenge.
+	name string
+	id   string
+}
+
+// checkZone runs the steps shared by runCheck and /validate-config for the
+// solver config raw and zone, reporting each to step and stopping at the
+// first one that fails: the config is loaded with the solver's defaults and,
+// if allowed is set, checked by it, the API token is resolved and the zone
+// looked up. The client of the result only logs changes if dryRun is set.
+func (c *hetznerDNSProviderSolver) checkZone(ctx context.Context, raw []byte, zone string, dryRun bool, allowed func(hetznerDNSProviderConfig) error, step stepFunc) (z checkedZone, ok bool) {
+	cfg, err := loadConfigWithDefaults(&extapi.JSON{Raw: raw}, c.defaults)
+	if err == nil && allowed != nil {
+		err = allowed(cfg)
+	}
+	if !step("config", err, "valid") {
+		return z, false
+	}
+	cfg.DryRun = dryRun
+	z.cfg = cfg
+
+	z.name, err = toASCII(normalizeName(zone))
+	if !step("zone", err, "%s", z.name) {
+		return z, false
+	}
+	ch := &v1alpha1.ChallengeRequest{ResolvedFQDN: "_acme-challenge." + z.name + ".", ResolvedZone: z.name + "."}
+	z.client, err = c.newClient(ctx, cfg, ch, z.name)
+	if !step("API token", err, "found") {
+		return z, false
+	}
+	z.id, err = c.resolveZoneID(ctx, z.client, cfg, z.name)
+	return z, step("zone lookup", err, "zone %s has the ID %s", z.name, z.id)
+}
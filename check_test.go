@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCheck(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2"},
+		Entry{ID: "record1", Name: "www", Type: "A", Value: "192.0.2.1", ZoneID: "zone1"},
+	)
+	defer srv.Close()
+	m.readOnlyZones = map[string]bool{"zone2": true}
+	config := `{"apiKey": "token", "apiUrl": "` + srv.URL + `"}`
+
+	out := &bytes.Buffer{}
+	assert.Equal(t, 0, runCheck([]string{"-zone", "example.com", "-config", config}, out))
+	assert.Equal(t, `PASS config: valid
+PASS zone: example.com
+PASS API token: found
+PASS zone lookup: zone example.com has the ID zone1
+PASS list records: 1 records
+PASS create record: dry run, the request was logged instead of sent; pass -write to create and delete a scratch record
+all checks passed
+`, out.String())
+	assert.Equal(t, 0, m.countRequests("POST /records"))
+
+	out.Reset()
+	assert.Equal(t, 0, runCheck([]string{"-zone", "example.com", "-config", config, "-write"}, out))
+	assert.Contains(t, out.String(), "PASS create and delete record: created and deleted a scratch TXT record")
+	assert.Equal(t, 1, m.countRequests("POST /records"))
+	assert.Len(t, m.records, 1, "the scratch record must be deleted")
+
+	out.Reset()
+	assert.Equal(t, 1, runCheck([]string{"-zone", "example.org", "-config", config, "-write"}, out))
+	assert.Contains(t, out.String(), "FAIL create and delete record: zone example.org is not writable")
+	assert.True(t, strings.HasSuffix(out.String(), "check failed\n"))
+
+	out.Reset()
+	assert.Equal(t, 1, runCheck([]string{"-zone", "example.net", "-config", config}, out))
+	assert.Contains(t, out.String(), "FAIL zone lookup: zone not found: example.net")
+
+	out.Reset()
+	assert.Equal(t, 1, runCheck([]string{"-zone", "example.com", "-config", `{"apiKey": "wrong", "apiUrl": "` + srv.URL + `"}`}, out))
+	assert.Contains(t, out.String(), "FAIL zone lookup:")
+	assert.Contains(t, out.String(), "HTTP 401")
+
+	out.Reset()
+	assert.Equal(t, 2, runCheck(nil, out))
+	assert.Contains(t, out.String(), "-zone is required")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cleanUpFailures counts the failed CleanUp attempts of each record, to
+// give up on it when CleanUpMaxAttempts is set. Its zero value is empty.
+type cleanUpFailures struct {
+	mu      sync.Mutex
+	entries map[string]cleanUpFailure
+}
+
+type cleanUpFailure struct {
+	attempts int
+	first    time.Time
+}
+
+// add records a failed attempt for key and returns the number of failed
+// attempts so far and the time of the first one.
+func (f *cleanUpFailures) add(key string) (int, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.entries == nil {
+		f.entries = map[string]cleanUpFailure{}
+	}
+	entry, ok := f.entries[key]
+	if !ok {
+		entry.first = time.Now()
+	}
+	entry.attempts++
+	f.entries[key] = entry
+	return entry.attempts, entry.first
+}
+
+// forget drops the failed attempts recorded for key.
+func (f *cleanUpFailures) forget(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.entries, key)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanUpFailures(t *testing.T) {
+	var failures cleanUpFailures
+	attempts, first := failures.add("a")
+	assert.Equal(t, 1, attempts)
+
+	failures.add("b")
+	attempts, again := failures.add("a")
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, first, again, "the time of the first failure must be kept")
+
+	failures.forget("a")
+	attempts, _ = failures.add("a")
+	assert.Equal(t, 1, attempts, "forgotten failures must not be counted")
+
+	failures.entries["b"] = cleanUpFailure{attempts: 1, first: time.Now().Add(-time.Hour)}
+	attempts, first = failures.add("b")
+	assert.Equal(t, 2, attempts)
+	assert.True(t, time.Since(first) >= time.Hour)
+}
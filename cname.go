@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// lookupCNAME resolves the canonical name of a host, replaced in tests.
+var lookupCNAME = net.DefaultResolver.LookupCNAME
+
+// resolveCNAME returns the name fqdn is a CNAME of, lowercased and without
+// the trailing dot, or "" if fqdn is not a CNAME. Chains of CNAMEs are
+// followed to their end.
+func resolveCNAME(ctx context.Context, fqdn string) (string, error) {
+	target, err := lookupCNAME(ctx, fqdn)
+	if err != nil {
+		// a challenge record without a CNAME usually doesn't exist at all
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("error resolving CNAME of %s: %v", fqdn, err)
+	}
+	target = normalizeName(target)
+	if target == "" || target == normalizeName(fqdn) {
+		return "", nil
+	}
+	return target, nil
+}
+
+// defaultMaxZoneWalkDepth is the number of labels findZone strips from a
+// name at most unless MaxZoneWalkDepth is set.
+const defaultMaxZoneWalkDepth = 3
+
+// findZone returns the name of the most specific zone of the account that
+// contains name: name itself if it is a zone, or else the closest parent
+// zone with at most maxDepth of the leftmost labels of name stripped.
+// maxDepth 0 means defaultMaxZoneWalkDepth, a negative one has no limit.
+func findZone(ctx context.Context, client *HetznerClient, name string, maxDepth int) (string, error) {
+	if maxDepth == 0 {
+		maxDepth = defaultMaxZoneWalkDepth
+	}
+	zones, err := client.ListZones(ctx)
+	if err != nil {
+		return "", err
+	}
+	names := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		names[normalizeName(zone.Name)] = true
+	}
+
+	candidate := normalizeName(name)
+	for depth := 0; maxDepth < 0 || depth <= maxDepth; depth++ {
+		if names[candidate] {
+			return candidate, nil
+		}
+		i := strings.Index(candidate, ".")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[i+1:]
+	}
+	if maxDepth > 0 {
+		return "", fmt.Errorf("%w for CNAME target %s within %d labels", ErrZoneNotFound, name, maxDepth)
+	}
+	return "", fmt.Errorf("%w for CNAME target %s", ErrZoneNotFound, name)
+}
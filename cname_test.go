@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveCNAME(t *testing.T) {
+	defer func(f func(context.Context, string) (string, error)) { lookupCNAME = f }(lookupCNAME)
+
+	for _, tt := range []struct {
+		canonical string
+		err       error
+		target    string
+		wantErr   string
+	}{
+		{canonical: "_acme-challenge.Example.com.", target: ""},
+		{canonical: "Example.acme.example.org.", target: "example.acme.example.org"},
+		{err: &net.DNSError{Err: "no such host", Name: "_acme-challenge.example.com.", IsNotFound: true}, target: ""},
+		{err: errors.New("timeout"), wantErr: "error resolving CNAME of _acme-challenge.example.com.: timeout"},
+	} {
+		lookupCNAME = func(ctx context.Context, host string) (string, error) {
+			return tt.canonical, tt.err
+		}
+		target, err := resolveCNAME(context.Background(), "_acme-challenge.example.com.")
+		if tt.wantErr != "" {
+			assert.EqualError(t, err, tt.wantErr)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tt.target, target, tt.canonical)
+	}
+}
+
+func TestPresentAndCleanUp_FollowCNAME(t *testing.T) {
+	defer func(f func(context.Context, string) (string, error)) { lookupCNAME = f }(lookupCNAME)
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		return "example.com.acme.example.org.", nil
+	}
+
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2", "acme.example.org": "zone3"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	ch := newChallengeRequest("key", `{"apiKey": "token", "followCNAME": true}`)
+	assert.NoError(t, solver.Present(ch))
+	assert.Equal(t, []string{"key"}, m.txtValues("example.com"))
+	for _, r := range m.records {
+		assert.Equal(t, "zone3", r.ZoneID)
+	}
+
+	assert.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, m.records)
+
+	// without followCNAME the CNAME is ignored
+	ch = newChallengeRequest("key", `{"apiKey": "token"}`)
+	assert.NoError(t, solver.Present(ch))
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+}
+
+func TestPresent_FollowCNAMEWithoutZone(t *testing.T) {
+	defer func(f func(context.Context, string) (string, error)) { lookupCNAME = f }(lookupCNAME)
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		return "_acme-challenge.example.net.", nil
+	}
+
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	err := solver.Present(newChallengeRequest("key", `{"apiKey": "token", "followCNAME": true}`))
+	assert.EqualError(t, err, "zone not found for CNAME target _acme-challenge.example.net within 3 labels")
+	assert.Empty(t, m.records)
+}
+
+func TestFindZone(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.org": "zone1", "acme.example.org": "zone2", "org": "zone3"})
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	for _, tt := range []struct {
+		name     string
+		maxDepth int
+		zone     string
+		err      string
+	}{
+		{"acme.example.org", 0, "acme.example.org", ""},
+		{"Acme.Example.org.", 1, "acme.example.org", ""},
+		{"a.acme.example.org", 1, "acme.example.org", ""},
+		{"a.b.c.acme.example.org", 0, "acme.example.org", ""},
+		{"a.b.c.d.acme.example.org", 0, "", "zone not found for CNAME target a.b.c.d.acme.example.org within 3 labels"},
+		{"a.b.c.d.acme.example.org", 4, "acme.example.org", ""},
+		{"a.b.c.d.acme.example.org", -1, "acme.example.org", ""},
+		{"a.b.example.net", -1, "", "zone not found for CNAME target a.b.example.net"},
+		{"a.other.org", 2, "org", ""},
+		{"a.other.org", 1, "", "zone not found for CNAME target a.other.org within 1 labels"},
+	} {
+		zone, err := findZone(context.Background(), client, tt.name, tt.maxDepth)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.name)
+			assert.True(t, errors.Is(err, ErrZoneNotFound))
+			continue
+		}
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.zone, zone, tt.name)
+	}
+}
+
+func TestPresent_FollowCNAMEMaxZoneWalkDepth(t *testing.T) {
+	defer func(f func(context.Context, string) (string, error)) { lookupCNAME = f }(lookupCNAME)
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		return "a.b.acme.example.org.", nil
+	}
+
+	m, srv := newMockHetznerAPI(map[string]string{"example.org": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	err := solver.Present(newChallengeRequest("key", `{"apiKey": "token", "followCNAME": true, "maxZoneWalkDepth": 2}`))
+	assert.True(t, errors.Is(err, ErrZoneNotFound), "got %v", err)
+	assert.Empty(t, m.records)
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token", "followCNAME": true}`)))
+	assert.Equal(t, []string{"key"}, m.txtValues("a.b.acme"))
+}
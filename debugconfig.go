@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// debugConfigEndpointEnv enables the /debug/config endpoint when set to
+// "true".
+const debugConfigEndpointEnv = "DEBUG_CONFIG_ENDPOINT"
+
+// effectiveConfig is the configuration the webhook would solve challenges
+// for a zone with, as served by the /debug/config endpoint. It holds no
+// secrets.
+type effectiveConfig struct {
+	Zone string `json:"zone"`
+	// ZoneID is the ID the zone resolves to, ZoneError why it doesn't.
+	ZoneID    string `json:"zoneId,omitempty"`
+	ZoneError string `json:"zoneError,omitempty"`
+
+	CredentialSource string `json:"credentialSource"`
+	APIURL           string `json:"apiUrl"`
+	TTL              int    `json:"ttl"`
+	RecordType       string `json:"recordType"`
+	ZoneLookup       string `json:"zoneLookup"`
+	OwnerMarker      string `json:"ownerMarker,omitempty"`
+	MaxRetries       int    `json:"maxRetries"`
+	RetryBaseDelay   string `json:"retryBaseDelay"`
+	RetryMaxDelay    string `json:"retryMaxDelay"`
+	RetryMaxElapsed  string `json:"retryMaxElapsed"`
+	Timeout          string `json:"timeout"`
+	WriteTimeout     string `json:"writeTimeout"`
+	PerPage          int    `json:"perPage"`
+	UserAgent        string `json:"userAgent"`
+	ExtraHeaders     string `json:"extraHeaders,omitempty"`
+	ProxyURL         string `json:"proxyUrl,omitempty"`
+	DryRun           bool   `json:"dryRun"`
+
+	// LastPresent is the last successful Present in the zone since the
+	// webhook started, with any config.
+	LastPresent *lastOperation `json:"lastPresent,omitempty"`
+}
+
+// debugConfigHandler serves the effective configuration for the zone given
+// by the zone parameter, computed from the default config like the one of
+// a challenge without any options of its own. It only looks up the zone and
+// never changes records.
+type debugConfigHandler struct {
+	solver *hetznerDNSProviderSolver
+}
+
+func (h debugConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	zone := req.URL.Query().Get("zone")
+	if strings.TrimSpace(zone) == "" {
+		http.Error(w, "the zone parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	effective, err := h.solver.effectiveConfig(req.Context(), zone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(effective)
+}
+
+// effectiveConfig returns the configuration challenges without options of
+// their own would use for zone. A zone failing to resolve is reported in
+// ZoneError rather than failing.
+func (c *hetznerDNSProviderSolver) effectiveConfig(ctx context.Context, zone string) (effectiveConfig, error) {
+	zone, err := toASCII(normalizeName(zone))
+	if err != nil {
+		return effectiveConfig{}, fmt.Errorf("invalid zone: %v", err)
+	}
+	cfg, err := loadConfigWithDefaults(nil, c.defaults)
+	if err != nil {
+		return effectiveConfig{}, err
+	}
+	client, err := c.newClient(ctx, cfg, &v1alpha1.ChallengeRequest{}, zone)
+	if err != nil {
+		return effectiveConfig{}, err
+	}
+
+	effective := effectiveConfig{
+		Zone:             zone,
+		CredentialSource: c.credentialSource(zone),
+		APIURL:           redactURL(client.apiURL),
+		TTL:              cfg.TTL,
+		RecordType:       cfg.RecordType,
+		ZoneLookup:       cfg.ZoneLookup,
+		OwnerMarker:      cfg.OwnerMarker,
+		MaxRetries:       client.maxRetries,
+		RetryBaseDelay:   client.retryBaseDelay.String(),
+		RetryMaxDelay:    client.retryMaxDelay.String(),
+		RetryMaxElapsed:  client.retryMaxElapsed.String(),
+		Timeout:          client.timeout.String(),
+		WriteTimeout:     client.writeTimeout.String(),
+		PerPage:          client.perPage,
+		UserAgent:        client.userAgent,
+		ExtraHeaders:     redactHeaders(cfg.ExtraHeaders),
+		ProxyURL:         redactURL(cfg.ProxyURL),
+		DryRun:           cfg.DryRun,
+	}
+	if op, ok := c.lastPresents.get(zone); ok {
+		effective.LastPresent = &op
+	}
+	if effective.ZoneID, err = c.resolveZoneID(ctx, client, cfg, zone); err != nil {
+		effective.ZoneError = err.Error()
+	}
+	return effective, nil
+}
+
+// credentialSource describes where the API token for zone is taken from
+// by the default config, without the token itself.
+func (c *hetznerDNSProviderSolver) credentialSource(zone string) string {
+	var raw hetznerDNSProviderConfig
+	if len(c.defaults.Config) > 0 {
+		// already validated by loadConfigWithDefaults
+		json.Unmarshal(c.defaults.Config, &raw)
+	}
+	switch ref := apiKeySecretRefForZone(raw, zone); {
+	case ref.isSet():
+		return fmt.Sprintf("key %s of secret %s", ref.Key, ref)
+	case strings.TrimSpace(raw.APIKey) != "":
+		return "apiKey"
+	case raw.APIKeyFile != "":
+		return "apiKeyFile " + raw.APIKeyFile
+	case strings.TrimSpace(os.Getenv(apiTokenEnv)) != "":
+		return apiTokenEnv
+	default:
+		return apiTokenFileEnv + " " + os.Getenv(apiTokenFileEnv)
+	}
+}
+
+// debugConfigEndpointEnabled reports whether the /debug/config endpoint is
+// served.
+func debugConfigEndpointEnabled() bool {
+	return os.Getenv(debugConfigEndpointEnv) == "true"
+}
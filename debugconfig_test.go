@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugConfigHandler(t *testing.T) {
+	os.Setenv(apiTokenEnv, "secret-token")
+	defer os.Unsetenv(apiTokenEnv)
+
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	handler := debugConfigHandler{solver: &hetznerDNSProviderSolver{
+		apiURL:   srv.URL,
+		defaults: solverDefaults{Config: []byte(`{"ttl": 120, "maxRetries": 5, "extraHeaders": {"Authorization": "Bearer secret", "X-Team": "platform"}}`)},
+	}}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	// the mock only accepts "token", so the zone doesn't resolve
+	rec := get("/debug/config?zone=Example.com.")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var effective effectiveConfig
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &effective))
+	assert.Equal(t, "example.com", effective.Zone)
+	assert.Equal(t, apiTokenEnv, effective.CredentialSource)
+	assert.Equal(t, 120, effective.TTL)
+	assert.Equal(t, 5, effective.MaxRetries)
+	assert.Equal(t, "Authorization: REDACTED, X-Team: platform", effective.ExtraHeaders)
+	assert.Contains(t, effective.ZoneError, "HTTP 401")
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	os.Setenv(apiTokenEnv, "token")
+	rec = get("/debug/config?zone=example.com")
+	effective = effectiveConfig{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &effective))
+	assert.Equal(t, "zone1", effective.ZoneID)
+	assert.Empty(t, effective.ZoneError)
+	assert.Nil(t, effective.LastPresent)
+
+	handler.solver.lastPresents.record(lastOperation{Zone: "example.com", ZoneID: "zone1", RecordName: "_acme-challenge", RecordID: "record1", Created: true})
+	rec = get("/debug/config?zone=example.com")
+	effective = effectiveConfig{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &effective))
+	if assert.NotNil(t, effective.LastPresent) {
+		assert.Equal(t, "record1", effective.LastPresent.RecordID)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, get("/debug/config").Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/config?zone=example.com", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	for _, r := range m.requests {
+		assert.True(t, strings.HasPrefix(r, "GET "), "the endpoint must not change records, got %s", r)
+	}
+}
+
+func TestCredentialSource(t *testing.T) {
+	solver := &hetznerDNSProviderSolver{defaults: solverDefaults{Config: []byte(`{"apiKeySecretRef": {"name": "hetzner", "key": "token"}, "zoneApiKeySecretRefs": {"example.org": {"name": "org", "key": "token"}}}`)}}
+	assert.Equal(t, "key token of secret hetzner", solver.credentialSource("example.com"))
+	assert.Equal(t, "key token of secret org", solver.credentialSource("sub.example.org"))
+
+	solver = &hetznerDNSProviderSolver{defaults: solverDefaults{Config: []byte(`{"apiKeyFile": "/etc/hetzner/token"}`)}}
+	assert.Equal(t, "apiKeyFile /etc/hetzner/token", solver.credentialSource("example.com"))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// defaultCleanUpWorkers is the number of records CleanUp deletes at a time
+// unless CleanUpWorkers is set.
+const defaultCleanUpWorkers = 3
+
+// deleteRecords calls del for each record, with up to workers calls at a
+// time. A failing call doesn't stop the others, their errors are returned
+// together as a joinedError.
+func deleteRecords(ctx context.Context, workers int, records []Entry, del func(context.Context, Entry) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu   sync.Mutex
+		errs joinedError
+		wg   sync.WaitGroup
+	)
+	queue := make(chan Entry)
+	for i := 0; i < workers && i < len(records); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range queue {
+				if err := del(ctx, e); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, e := range records {
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// joinedError holds several errors, like errors.Join of later Go versions.
+type joinedError []error
+
+func (e joinedError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target.
+func (e joinedError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors matching target.
+func (e joinedError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
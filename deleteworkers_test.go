@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteRecords(t *testing.T) {
+	var records []Entry
+	for i := 0; i < 10; i++ {
+		records = append(records, Entry{ID: fmt.Sprintf("r%d", i)})
+	}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	deleted := map[string]bool{}
+	err := deleteRecords(context.Background(), 3, records, func(ctx context.Context, e Entry) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		deleted[e.ID] = true
+		if e.ID == "r2" || e.ID == "r7" {
+			return fmt.Errorf("failed to delete record %s: %w", e.ID, ErrInvalidRecord)
+		}
+		return nil
+	})
+
+	assert.Len(t, deleted, 10, "a failed deletion must not stop the others")
+	assert.Equal(t, 3, maxInFlight)
+	assert.True(t, errors.Is(err, ErrInvalidRecord))
+	assert.Len(t, err.(joinedError), 2)
+	assert.Contains(t, err.Error(), "failed to delete record r2")
+	assert.Contains(t, err.Error(), "failed to delete record r7")
+
+	assert.NoError(t, deleteRecords(context.Background(), 3, nil, nil))
+}
+
+func TestCleanUp_DeletesStaleRecordsConcurrently(t *testing.T) {
+	var stale []Entry
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		stale = append(stale, Entry{ID: id, Name: "_acme-challenge", Type: "TXT", Value: "stale-" + id, ZoneID: "zone1"})
+	}
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"}, withOwnerMarkers(stale...)...)
+	defer srv.Close()
+	m.statuses = map[string]int{"DELETE /records/c": http.StatusForbidden}
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	err := solver.CleanUp(newChallengeRequest("key", `{"apiKey": "token", "purgeStale": true, "cleanUpWorkers": 2}`))
+	assert.EqualError(t, err, "failed to delete 1 of 5 records named _acme-challenge in zone example.com: failed to delete record c: deleting record c failed with HTTP 403 Forbidden: Forbidden (code 403); the API token may lack access to zone example.com")
+	assert.Equal(t, []string{"stale-c"}, m.txtValues("_acme-challenge"), "the other records must be deleted")
+	assert.Contains(t, m.records, "c-marker", "the owner marker of the record left must be kept")
+}
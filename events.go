@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// podNameEnv is the environment variable holding the name of the webhook's
+// pod, usually set with the downward API. Events are recorded on this pod.
+const podNameEnv = "POD_NAME"
+
+// eventComponent is the source of the events recorded by the webhook.
+const eventComponent = "cert-manager-webhook-hetzner"
+
+// RecordEvent records a Kubernetes event with the given reason and message
+// on the webhook's pod with clientset.
+func RecordEvent(ctx context.Context, clientset kubernetes.Interface, reason, message string) error {
+	pod := strings.TrimSpace(os.Getenv(podNameEnv))
+	if pod == "" {
+		return errors.New(podNameEnv + " is not set")
+	}
+	namespace, err := GetNamespace()
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: pod + ".", Namespace: namespace},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       pod,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeNormal,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := clientset.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("error creating event in namespace %s: %v", namespace, err)
+	}
+	return nil
+}
+
+// emitEvent records an event about a record change with the solver's
+// clientset if the config enables events. Events are an audit trail only,
+// so failing to record one is logged but doesn't fail the challenge.
+func (c *hetznerDNSProviderSolver) emitEvent(ctx context.Context, cfg hetznerDNSProviderConfig, reason, format string, args ...interface{}) {
+	if !cfg.EmitEvents || cfg.DryRun {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	clientset, err := c.kubernetesClient()
+	if err == nil {
+		err = RecordEvent(ctx, clientset, reason, message)
+	}
+	if err != nil {
+		klog.Warningf("failed to record event %s (%s): %v", reason, message, err)
+	}
+}
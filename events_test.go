@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeEvents gives solver a fake clientset collecting the events created
+// with it as "reason: message", failing with err if it isn't nil, until the
+// returned function is called.
+func fakeEvents(solver *hetznerDNSProviderSolver, events *[]string, err error) func() {
+	client := useFakeClientset(solver)
+	client.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if err != nil {
+			return true, nil, err
+		}
+		event := action.(k8stesting.CreateAction).GetObject().(*corev1.Event)
+		*events = append(*events, event.Reason+": "+event.Message)
+		return true, event, nil
+	})
+	restoreName := setEnv(podNameEnv, "webhook-0")
+	restoreNamespace := setEnv(podNamespaceEnv, "webhook")
+	return func() {
+		restoreName()
+		restoreNamespace()
+	}
+}
+
+func TestPresentAndCleanUp_EmitEvents(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"}, withOwnerMarkers(
+		Entry{ID: "old", Name: "_acme-challenge", Type: "TXT", Value: "old-key", ZoneID: "zone1"},
+	)...)
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	config := `{"apiKey": "token", "emitEvents": true, "enforceSingleRecord": true}`
+
+	var events []string
+	defer fakeEvents(solver, &events, nil)()
+
+	assert.NoError(t, solver.Present(newChallengeRequest("secret-key", config)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("secret-key", config)))
+	assert.Empty(t, m.txtValues("_acme-challenge"))
+	assert.Equal(t, []string{
+		"RecordDeleted: deleted previous TXT record old named _acme-challenge in zone example.com",
+		"RecordCreated: created TXT record new-1 named _acme-challenge in zone example.com",
+		"RecordDeleted: deleted TXT record new-1 named _acme-challenge in zone example.com",
+	}, events)
+	for _, event := range events {
+		assert.NotContains(t, event, "secret-key", "events must not contain the key")
+	}
+
+	// without the option no events are recorded
+	events = nil
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	assert.Empty(t, events)
+}
+
+func TestEmitEvent_FailureDoesNotFailChallenge(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	var events []string
+	defer fakeEvents(solver, &events, errors.New("events is forbidden"))()
+
+	logs, restore := captureLogs(0)
+	err := solver.Present(newChallengeRequest("key", `{"apiKey": "token", "emitEvents": true}`))
+	restore()
+
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "failed to record event RecordCreated")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// maxFallbackAPIKeys bounds the number of fallback API tokens, and so the
+// number of attempts of a request rejected by the API.
+const maxFallbackAPIKeys = 3
+
+// apiKeyFailover holds the API tokens of a client, the configured one
+// followed by its fallbacks, and which of them is in use.
+type apiKeyFailover struct {
+	keys []string
+
+	mu      sync.Mutex
+	current int
+}
+
+func (f *apiKeyFailover) inUse() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+func (f *apiKeyFailover) use(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.current = i
+}
+
+// withAPIKeyFailover sends requests with the API token in use and, if the
+// API rejects it with 401 or 403, resends them with the other tokens in
+// turn. The first token accepted stays in use for later requests.
+func withAPIKeyFailover(f *apiKeyFailover) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			first := f.inUse()
+			for i := 0; ; i++ {
+				index := (first + i) % len(f.keys)
+				attemptReq := req.Clone(req.Context())
+				if i > 0 && req.GetBody != nil {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					attemptReq.Body = body
+				}
+				attemptReq.Header.Set("Auth-API-Token", f.keys[index])
+
+				resp, err := next.RoundTrip(attemptReq)
+				rejected := err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)
+				if !rejected {
+					if i > 0 {
+						klog.Infof("API token %d of %d was accepted, using it for the following requests", index+1, len(f.keys))
+						f.use(index)
+					}
+					return resp, err
+				}
+				if i == len(f.keys)-1 {
+					return resp, err
+				}
+				resp.Body.Close()
+				klog.Warningf("API token %d of %d was rejected with HTTP %d, trying the next one", index+1, len(f.keys), resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestWithAPIKeyFailover(t *testing.T) {
+	var sent, bodies []string
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		key := req.Header.Get("Auth-API-Token")
+		sent = append(sent, key)
+		if req.Body != nil {
+			body, _ := ioutil.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+		}
+		switch key {
+		case "revoked":
+			return &http.Response{StatusCode: http.StatusUnauthorized, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		case "read-only":
+			return &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return okTransport(`{}`).RoundTrip(req)
+	})
+	failover := &apiKeyFailover{keys: []string{"revoked", "read-only", "token"}}
+	rt := withAPIKeyFailover(failover)(next)
+
+	req, _ := http.NewRequest("POST", "http://hetzner.invalid/records", strings.NewReader(`{"name":"_acme-challenge"}`))
+	resp, err := rt.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"revoked", "read-only", "token"}, sent)
+	assert.Equal(t, []string{`{"name":"_acme-challenge"}`, `{"name":"_acme-challenge"}`, `{"name":"_acme-challenge"}`}, bodies)
+
+	// the accepted token is used for the following requests
+	sent = nil
+	_, err = rt.RoundTrip(httpGet("http://hetzner.invalid/zones"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"token"}, sent)
+
+	// each token is tried at most once per request
+	sent = nil
+	failover = &apiKeyFailover{keys: []string{"revoked", "read-only"}}
+	resp, err = withAPIKeyFailover(failover)(next).RoundTrip(httpGet("http://hetzner.invalid/zones"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, []string{"revoked", "read-only"}, sent)
+}
+
+func httpGet(url string) *http.Request {
+	req, _ := http.NewRequest("GET", url, nil)
+	return req
+}
+
+func TestPresent_FallbackAPIKeys(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	defer fakeSecrets(solver, map[string]*corev1.Secret{
+		"old": {Data: map[string][]byte{"api-token": []byte("revoked")}},
+		"new": {Data: map[string][]byte{"api-token": []byte("token")}},
+	})()
+	config := `{"apiKeySecretRef": {"name": "old", "key": "api-token"}, "fallbackApiKeySecretRefs": [{"name": "missing", "key": "api-token"}, {"name": "new", "key": "api-token"}]}`
+
+	logs, restore := captureLogs(0)
+	err := solver.Present(newChallengeRequest("key", config))
+	restore()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+	assert.Contains(t, logs.String(), "skipping fallback API token 1: secret webhook/missing not found")
+	assert.Contains(t, logs.String(), "API token 1 of 2 was rejected with HTTP 401, trying the next one")
+	assert.Contains(t, logs.String(), "API token 2 of 2 was accepted")
+	assert.NotContains(t, logs.String(), "revoked")
+
+	for config, expected := range map[string]string{
+		`{"apiKey": "token", "fallbackApiKeySecretRefs": [{"key": "api-token"}]}`:                                                                                       "fallbackApiKeySecretRefs[0].name is required",
+		`{"apiKey": "token", "fallbackApiKeySecretRefs": [{"name": "a", "key": "k"}, {"name": "b", "key": "k"}, {"name": "c", "key": "k"}, {"name": "d", "key": "k"}]}`: "fallbackApiKeySecretRefs must not have more than 3 entries but has 4",
+	} {
+		_, err := loadConfig(&extapi.JSON{Raw: []byte(config)})
+		assert.EqualError(t, err, expected)
+	}
+}
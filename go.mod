@@ -5,7 +5,16 @@ go 1.13
 require (
 	github.com/jetstack/cert-manager v1.2.0
 	github.com/miekg/dns v1.1.31
-	github.com/stretchr/testify v1.6.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/jaeger v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	k8s.io/api v0.19.0
 	k8s.io/apiextensions-apiserver v0.19.0
+	k8s.io/apimachinery v0.19.0
 	k8s.io/client-go v0.19.0
+	k8s.io/klog/v2 v2.3.0
 )
@@ -0,0 +1,989 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// hetznerAPIURL is the base URL of the Hetzner DNS API.
+const hetznerAPIURL = "https://dns.hetzner.com/api/v1"
+
+type Zones struct {
+	Zones []Zone `json:"zones"`
+	Meta  Meta   `json:"meta"`
+}
+
+type Zone struct {
+	ZoneID string `json:"id"`
+	Name   string `json:"name"`
+	// Status is the state of the zone, e.g. "verified", see zoneReady.
+	Status string `json:"status,omitempty"`
+}
+
+// Meta is the meta block of listings, which drives their pagination.
+type Meta struct {
+	Pagination Pagination `json:"pagination"`
+}
+
+// Pagination describes a page of a listing. Responses lacking it decode to
+// the zero value, i.e. a single page.
+type Pagination struct {
+	Page         int `json:"page"`
+	PerPage      int `json:"per_page"`
+	LastPage     int `json:"last_page"`
+	TotalEntries int `json:"total_entries"`
+}
+
+type Entries struct {
+	Records []Entry `json:"records"`
+	Meta    Meta    `json:"meta"`
+}
+
+type Entry struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name"`
+	TTL    int    `json:"ttl"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	ZoneID string `json:"zone_id"`
+	// Created and Modified are the times the API created and last modified
+	// the record, see recordAge.
+	Created  string `json:"created,omitempty"`
+	Modified string `json:"modified,omitempty"`
+}
+
+// apiError is an error response of the API. Its body usually holds an
+// error object, but some errors, e.g. for invalid tokens, only carry a
+// message.
+type apiError struct {
+	// Operation describes the failed request, e.g. "listing zones".
+	Operation string `json:"-"`
+	// Status and StatusCode are the HTTP status of the response.
+	Status     string `json:"-"`
+	StatusCode int    `json:"-"`
+	// Body is the raw response body, used when it isn't a valid error
+	// object.
+	Body string `json:"-"`
+	// transientAuth is set for 401 responses which look like a transient
+	// failure rather than a rejected token, see isTransientAuthFailure.
+	transientAuth bool
+
+	Err struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%s failed with HTTP %s", e.Operation, e.Status)
+	switch {
+	case e.Err.Message != "" && e.Err.Code != 0:
+		return fmt.Sprintf("%s: %s (code %d)", msg, e.Err.Message, e.Err.Code)
+	case e.Err.Message != "":
+		return fmt.Sprintf("%s: %s", msg, e.Err.Message)
+	case e.Message != "":
+		return fmt.Sprintf("%s: %s", msg, e.Message)
+	case e.Body != "":
+		return fmt.Sprintf("%s: %s", msg, e.Body)
+	default:
+		return msg
+	}
+}
+
+// newAPIError returns the error for the non-2xx response to the given
+// operation, falling back to the raw body if it isn't a JSON error.
+func newAPIError(operation string, resp *http.Response) *apiError {
+	apiErr := &apiError{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, apiErr); err != nil || (apiErr.Err.Message == "" && apiErr.Message == "") {
+		apiErr = &apiError{Body: strings.TrimSpace(string(body))}
+	}
+	apiErr.Operation = operation
+	apiErr.Status = resp.Status
+	apiErr.StatusCode = resp.StatusCode
+	apiErr.transientAuth = resp.StatusCode == http.StatusUnauthorized && isTransientAuthFailure(resp.Header, string(body))
+	return apiErr
+}
+
+// Is makes errors of 401 responses rejecting the API token match
+// ErrAuthFailed, and those of 403 responses ErrForbidden.
+func (e *apiError) Is(target error) bool {
+	switch target {
+	case ErrAuthFailed:
+		return e.StatusCode == http.StatusUnauthorized && !e.transientAuth
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// decodeResponse decodes the JSON body of the response to the given
+// operation into v. Errors name the operation, the status and how much of
+// the body was read, to tell truncated bodies from malformed ones.
+func decodeResponse(resp *http.Response, operation string, v interface{}) error {
+	body := &countingReader{r: resp.Body}
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding the response to %s (HTTP %s) after %d bytes: %w", operation, resp.Status, body.n, err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// isSuccess reports whether resp has a 2xx status code.
+func isSuccess(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode <= 299
+}
+
+// isNotFound reports whether err is an API error for a missing resource.
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// HetznerClient is a minimal client for the parts of the Hetzner DNS API
+// needed to present and clean up ACME challenge records.
+//
+// Requests are sent through a chain of middlewares built from the fields
+// below, see middlewares.
+type HetznerClient struct {
+	apiURL string
+	apiKey string
+
+	// transport sends the requests once they went through all middlewares.
+	// Defaults to http.DefaultTransport.
+	transport http.RoundTripper
+
+	// maxRetries is the number of times a failed request is retried, with
+	// an exponential backoff starting at retryBaseDelay, each delay extended
+	// by a random fraction of up to retryJitter. Requests creating records
+	// are only retried if they clearly didn't reach the API, unless
+	// retryNonIdempotent is set. No delay exceeds retryMaxDelay, and no
+	// retry starts later than retryMaxElapsed after the first attempt.
+	maxRetries         int
+	retryBaseDelay     time.Duration
+	retryMaxDelay      time.Duration
+	retryMaxElapsed    time.Duration
+	retryJitter        float64
+	retryNonIdempotent bool
+
+	// apiKeys, if set, holds fallback API tokens tried in turn when the API
+	// rejects the one in use. It replaces apiKey in requests.
+	apiKeys *apiKeyFailover
+
+	// userAgent is sent as the User-Agent header of every request.
+	// Defaults to defaultUserAgent.
+	userAgent string
+
+	// extraHeaders are sent with every request, e.g. for an API gateway.
+	// They never replace the headers set by the client itself.
+	extraHeaders map[string]string
+
+	// correlationHeader and correlationID, if set, are sent with every
+	// request and included in the logs to trace calls back to the
+	// challenge that caused them.
+	correlationHeader string
+	correlationID     string
+
+	// requestID identifies the challenge requests are made for in the API
+	// request logs, usually its UID.
+	requestID string
+
+	// circuitBreaker, if set, fails requests fast during API outages. It
+	// is shared by all clients of the same API URL.
+	circuitBreaker *circuitBreaker
+
+	// rateLimiter, if set, limits the rate of requests. It is shared by all
+	// clients using the same API token.
+	rateLimiter *rateLimiter
+
+	// concurrency, if set, limits the number of requests in flight. It is
+	// shared by all clients of a solver.
+	concurrency semaphore
+
+	// dryRun makes the client log requests modifying records instead of
+	// sending them.
+	dryRun bool
+
+	// liveness, if set, tracks the requests in flight.
+	liveness *liveness
+
+	// timeout is the deadline of each API call reading zones or records,
+	// including its retries and reading the response. Defaults to
+	// defaultTimeout, 0 disables it.
+	timeout time.Duration
+
+	// writeTimeout is the deadline of each API call creating or deleting
+	// records, like timeout. It defaults to the longer defaultWriteTimeout,
+	// as a call timing out may still take effect, see CreateRecord.
+	writeTimeout time.Duration
+
+	// maxResponseBytes limits the size of response bodies, so that a
+	// misbehaving API can't exhaust the webhook's memory. Defaults to
+	// defaultMaxResponseBytes, 0 disables it.
+	maxResponseBytes int64
+
+	// perPage is the page size of zone and record listings. Defaults to
+	// maxPerPage.
+	perPage int
+
+	// ttlFloor is the lowest TTL records are created with, see
+	// applyTTLFloor. Defaults to minTTL. With strictTTL, records with a
+	// lower TTL fail with ErrInvalidRecord instead of being raised to it.
+	ttlFloor  int
+	strictTTL bool
+
+	// rejectLongTXT makes TXT values longer than maxTXTValueLength fail
+	// with ErrInvalidRecord instead of being split, see encodeTXTValue.
+	rejectLongTXT bool
+
+	// seen holds the records listed or created, for the audit log. It is
+	// shared by all clients of a solver.
+	seen *seenRecords
+}
+
+// defaultTimeout is the default deadline of an API call reading zones or
+// records, defaultWriteTimeout the one of an API call changing records.
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultWriteTimeout = 60 * time.Second
+)
+
+// maxPerPage is the largest page size of listings accepted by the API.
+const maxPerPage = 100
+
+// defaultMaxResponseBytes is the default limit of response bodies, far
+// above the size of a page of zones or records.
+const defaultMaxResponseBytes = 4 << 20
+
+// Version is the version of the webhook, set at build time with
+// -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// defaultUserAgent identifies the webhook and its version to the API.
+func defaultUserAgent() string {
+	return "cert-manager-webhook-hetzner/" + Version
+}
+
+// NewHetznerClient returns a client talking to the API at apiURL and
+// authenticating with apiKey.
+func NewHetznerClient(apiURL, apiKey string) *HetznerClient {
+	return &HetznerClient{
+		apiURL:           apiURL,
+		apiKey:           apiKey,
+		maxRetries:       defaultMaxRetries,
+		retryBaseDelay:   defaultRetryBaseDelay,
+		retryMaxDelay:    defaultRetryMaxDelay,
+		retryMaxElapsed:  defaultRetryMaxElapsed,
+		retryJitter:      defaultRetryJitter,
+		timeout:          defaultTimeout,
+		writeTimeout:     defaultWriteTimeout,
+		userAgent:        defaultUserAgent(),
+		maxResponseBytes: defaultMaxResponseBytes,
+		perPage:          maxPerPage,
+		ttlFloor:         minTTL,
+		seen:             &seenRecords{},
+	}
+}
+
+// GetZones returns the zones whose name matches the given zone name. The
+// API filters by substring, so the result may contain other zones as well.
+func (c *HetznerClient) GetZones(ctx context.Context, zone string) ([]Zone, error) {
+	query := url.Values{}
+	query.Set("search_name", zone)
+	return c.listZones(ctx, query)
+}
+
+// GetZonesByName returns the zones whose name is the given zone name. The
+// API matches the name exactly, unlike GetZones.
+func (c *HetznerClient) GetZonesByName(ctx context.Context, zone string) ([]Zone, error) {
+	query := url.Values{}
+	query.Set("name", zone)
+	return c.listZones(ctx, query)
+}
+
+// GetZoneByID returns the zone with the given ID. Unknown IDs fail with an
+// API error for which isNotFound reports true.
+func (c *HetznerClient) GetZoneByID(ctx context.Context, id string) (Zone, error) {
+	operation := "getting zone " + id
+	// Get Zone (GET https://dns.hetzner.com/api/v1/zones/{ZoneID})
+	resp, err := c.do(ctx, "GET", "/zones/"+url.PathEscape(id), nil)
+	if err != nil {
+		return Zone{}, err
+	}
+	defer resp.Body.Close()
+
+	if !isSuccess(resp) {
+		return Zone{}, newAPIError(operation, resp)
+	}
+
+	var zone struct {
+		Zone Zone `json:"zone"`
+	}
+	if err := decodeResponse(resp, operation, &zone); err != nil {
+		return Zone{}, err
+	}
+	return zone.Zone, nil
+}
+
+// ListZones returns all zones the API token has access to.
+func (c *HetznerClient) ListZones(ctx context.Context) ([]Zone, error) {
+	return c.listZones(ctx, url.Values{})
+}
+
+// ValidateToken checks that the API accepts the API token, by listing a
+// single zone.
+func (c *HetznerClient) ValidateToken(ctx context.Context) error {
+	resp, err := c.do(ctx, "GET", "/zones?per_page=1", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case isSuccess(resp):
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("API token was rejected: %w", newAPIError("listing zones", resp))
+	default:
+		return newAPIError("listing zones", resp)
+	}
+}
+
+// listZones returns the zones matching the given query, following the
+// pagination of the API. The API may answer a filter no zone matches with
+// 404 instead of an empty list, e.g. for a zone that was deleted, which is
+// returned as no zones.
+func (c *HetznerClient) listZones(ctx context.Context, query url.Values) ([]Zone, error) {
+	filtered := len(query) > 0
+	var all []Zone
+	for page := 1; ; page++ {
+		// Get Zones (GET https://dns.hetzner.com/api/v1/zones)
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(c.perPage))
+		resp, err := c.do(ctx, "GET", "/zones?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound && filtered {
+			resp.Body.Close()
+			klog.V(4).Infof("no zones match %s", query.Encode())
+			return all, nil
+		}
+		if !isSuccess(resp) {
+			apiErr := newAPIError("listing zones", resp)
+			resp.Body.Close()
+			return nil, apiErr
+		}
+
+		zones := Zones{}
+		err = decodeResponse(resp, "listing zones", &zones)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, zones.Zones...)
+		if len(zones.Zones) == 0 || page >= zones.Meta.Pagination.LastPage {
+			logListing("zones", len(all), page, zones.Meta.Pagination)
+			return all, nil
+		}
+	}
+}
+
+// ListRecords returns all records of the zone with the given ID, following
+// the pagination of the API.
+func (c *HetznerClient) ListRecords(ctx context.Context, zoneID string) ([]Entry, error) {
+	query := url.Values{}
+	query.Set("zone_id", zoneID)
+	return c.listRecords(ctx, zoneID, query)
+}
+
+// ListRecordsByName returns the records of the zone with the given name,
+// of any type. The name is passed to the API to narrow down the listing,
+// and the records are filtered by it as well, since the API may ignore it.
+func (c *HetznerClient) ListRecordsByName(ctx context.Context, zoneID, name string) ([]Entry, error) {
+	query := url.Values{}
+	query.Set("zone_id", zoneID)
+	query.Set("name", name)
+	records, err := c.listRecords(ctx, zoneID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var named []Entry
+	for _, e := range records {
+		if sameName(e.Name, name) {
+			named = append(named, e)
+		}
+	}
+	return named, nil
+}
+
+// listRecords returns the records matching the given query, from all
+// pages.
+func (c *HetznerClient) listRecords(ctx context.Context, zoneID string, query url.Values) ([]Entry, error) {
+	var all []Entry
+	for page := 1; ; page++ {
+		// Get Records (GET https://dns.hetzner.com/api/v1/records)
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(c.perPage))
+		resp, err := c.do(ctx, "GET", "/records?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isSuccess(resp) {
+			apiErr := newAPIError("listing records of zone "+zoneID, resp)
+			resp.Body.Close()
+			return nil, apiErr
+		}
+
+		entries := Entries{}
+		err = decodeResponse(resp, "listing records of zone "+zoneID, &entries)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries.Records {
+			all = append(all, decodeEntry(e))
+		}
+		c.seen.add(entries.Records...)
+		if len(entries.Records) == 0 || page >= entries.Meta.Pagination.LastPage {
+			logListing("records of zone "+zoneID, len(all), page, entries.Meta.Pagination)
+			return all, nil
+		}
+	}
+}
+
+// logListing logs the number of items of a listing over the given number of
+// pages at debug level, with the total reported by the pagination of its
+// last page, to give an idea of the size of zones.
+func logListing(what string, n, pages int, last Pagination) {
+	if last.TotalEntries > 0 && last.TotalEntries != n {
+		klog.V(4).Infof("listed %d %s on %d pages, the API reported %d in total", n, what, pages, last.TotalEntries)
+		return
+	}
+	klog.V(4).Infof("listed %d %s on %d pages", n, what, pages)
+}
+
+// ErrInvalidRecord is returned by CreateRecord for records the API would
+// reject.
+var ErrInvalidRecord = errors.New("invalid record")
+
+// maxRecordNameLength and maxLabelLength are the limits of DNS names, which
+// apply to record names relative to their zone as well. maxTXTValueLength is
+// the longest string of a TXT record, and the longest TXT value the API
+// accepts as a single string.
+const (
+	maxRecordNameLength = 253
+	maxLabelLength      = 63
+	maxTXTValueLength   = 255
+)
+
+// validateEntry checks a record against the limits of the API, to fail
+// before sending a request the API rejects.
+func validateEntry(e Entry) error {
+	if e.TTL != 0 && (e.TTL < minTTL || e.TTL > maxTTL) {
+		return fmt.Errorf("%w: TTL %d of record %s is not between %d and %d", ErrInvalidRecord, e.TTL, e.Name, minTTL, maxTTL)
+	}
+	if e.Name == "" {
+		return fmt.Errorf("%w: empty record name", ErrInvalidRecord)
+	}
+	if len(e.Name) > maxRecordNameLength {
+		return fmt.Errorf("%w: record name %s is %d characters long, more than %d", ErrInvalidRecord, e.Name, len(e.Name), maxRecordNameLength)
+	}
+	for _, label := range strings.Split(e.Name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return fmt.Errorf("%w: record name %s has a label that is empty or longer than %d characters", ErrInvalidRecord, e.Name, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// encodeEntry returns e as it is sent to the API: the value of a TXT record
+// longer than maxTXTValueLength is split into several strings, see
+// encodeTXTValue, or fails with ErrInvalidRecord if rejectLongTXT is set.
+func (c *HetznerClient) encodeEntry(e Entry) (Entry, error) {
+	if e.Type != "TXT" || len(e.Value) <= maxTXTValueLength {
+		return e, nil
+	}
+	if c.rejectLongTXT {
+		return e, fmt.Errorf("%w: value of TXT record %s is %d characters long, more than %d", ErrInvalidRecord, e.Name, len(e.Value), maxTXTValueLength)
+	}
+	e.Value = encodeTXTValue(e.Value)
+	return e, nil
+}
+
+// encodeTXTValue splits a TXT value longer than maxTXTValueLength into
+// strings of at most that length, quoted and separated by spaces as in zone
+// files, e.g. "aaa…" "bbb", which resolvers return as a single value. The
+// API only accepts longer values like that. Shorter values are sent as is,
+// as quoting them would end up in the record.
+func encodeTXTValue(value string) string {
+	if len(value) <= maxTXTValueLength {
+		return value
+	}
+	var b strings.Builder
+	for len(value) > 0 {
+		n := maxTXTValueLength
+		if n > len(value) {
+			n = len(value)
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteByte('"')
+		for _, ch := range []byte(value[:n]) {
+			if ch == '"' || ch == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(ch)
+		}
+		b.WriteByte('"')
+		value = value[n:]
+	}
+	return b.String()
+}
+
+// decodeTXTValue returns the value of a TXT record as returned by the API,
+// joining the strings of values split by encodeTXTValue. Values that aren't
+// made of several quoted strings are returned as is.
+func decodeTXTValue(value string) string {
+	var b strings.Builder
+	strs := 0
+	for i := 0; i < len(value); {
+		switch {
+		case value[i] == ' ' || value[i] == '\t':
+			i++
+			continue
+		case value[i] != '"':
+			return value
+		}
+		i++
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			b.WriteByte(value[i])
+		}
+		if i == len(value) {
+			return value // unterminated string
+		}
+		i++
+		strs++
+	}
+	if strs < 2 {
+		return value
+	}
+	return b.String()
+}
+
+// decodeEntry returns e with its value decoded by decodeTXTValue if it is a
+// TXT record.
+func decodeEntry(e Entry) Entry {
+	if e.Type == "TXT" {
+		e.Value = decodeTXTValue(e.Value)
+	}
+	return e
+}
+
+// applyTTLFloor returns e with its TTL raised to the client's ttlFloor if
+// it is below it, logging a warning, or fails with ErrInvalidRecord if
+// strictTTL is set. A TTL of zero, leaving it to the API, is kept.
+func (c *HetznerClient) applyTTLFloor(e Entry) (Entry, error) {
+	if e.TTL == 0 || e.TTL >= c.ttlFloor {
+		return e, nil
+	}
+	if c.strictTTL {
+		return e, fmt.Errorf("%w: TTL %d of record %s is below the minimum of %d", ErrInvalidRecord, e.TTL, e.Name, c.ttlFloor)
+	}
+	klog.Warningf("TTL %d of record %s is below the minimum of %d, using %d", e.TTL, e.Name, c.ttlFloor, c.ttlFloor)
+	e.TTL = c.ttlFloor
+	return e, nil
+}
+
+// CreateRecord creates the given record and returns it as stored by the
+// API, including its ID. Records the API would reject fail with
+// ErrInvalidRecord without a request. The value is sent as is: ACME
+// validation compares the record's value byte for byte with the key, so
+// quoting added here would end up in the record and fail the challenge.
+// Only TXT values too long for a single string are split, see
+// encodeTXTValue.
+// If the API rejects the record as a duplicate, the existing record is
+// returned instead.
+func (c *HetznerClient) CreateRecord(ctx context.Context, entry Entry) (Entry, error) {
+	created, err := c.createRecord(ctx, entry)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && isDuplicateRecord(apiErr) {
+		// e.g. a concurrent Present created the record after this one
+		// looked for it. The response of the create is closed by now, so
+		// the lookup doesn't wait for its concurrency slot.
+		created, err = c.existingRecord(ctx, entry, err)
+	}
+	if err != nil {
+		c.audit(auditCreate, entry, err)
+		return Entry{}, err
+	}
+	c.seen.add(created)
+	// in a dry run, the API returns no record
+	audited := entry
+	audited.ID = created.ID
+	c.audit(auditCreate, audited, nil)
+	return created, nil
+}
+
+func (c *HetznerClient) createRecord(ctx context.Context, entry Entry) (Entry, error) {
+	entry, err := c.applyTTLFloor(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := validateEntry(entry); err != nil {
+		return Entry{}, err
+	}
+	encoded, err := c.encodeEntry(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	body, err := json.Marshal(encoded)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	// Create Record (POST https://dns.hetzner.com/api/v1/records)
+	resp, err := c.do(ctx, "POST", "/records", body)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the API may have created the record anyway, which the next
+		// Present finds instead of creating it again
+		return Entry{}, fmt.Errorf("%w; the record may have been created nevertheless and is reconciled with the next attempt", err)
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+
+	if !isSuccess(resp) {
+		return Entry{}, newAPIError(fmt.Sprintf("creating %s record %s", entry.Type, entry.Name), resp)
+	}
+
+	created := struct {
+		Record Entry `json:"record"`
+	}{}
+	if err := decodeResponse(resp, fmt.Sprintf("creating %s record %s", entry.Type, entry.Name), &created); err != nil {
+		return Entry{}, err
+	}
+	return decodeEntry(created.Record), nil
+}
+
+// duplicateRecordMessages are the parts of the error messages with which the
+// API rejects creating a record that already exists.
+var duplicateRecordMessages = []string{"already exists", "duplicate"}
+
+// isDuplicateRecord reports whether err rejects creating a record because
+// it already exists. Other conflicts and validation errors don't count.
+func isDuplicateRecord(err *apiError) bool {
+	if err.StatusCode != http.StatusConflict && err.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	msg := strings.ToLower(err.Err.Message + " " + err.Message + " " + err.Body)
+	for _, duplicate := range duplicateRecordMessages {
+		if strings.Contains(msg, duplicate) {
+			return true
+		}
+	}
+	return false
+}
+
+// existingRecord returns the record of the zone with the name, type and
+// value of entry, which the API reported to exist with createErr. It fails
+// with createErr if there is no such record after all.
+func (c *HetznerClient) existingRecord(ctx context.Context, entry Entry, createErr error) (Entry, error) {
+	records, err := c.ListRecordsByName(ctx, entry.ZoneID, entry.Name)
+	if err != nil {
+		return Entry{}, fmt.Errorf("%v, and listing the existing records failed: %w", createErr, err)
+	}
+	for _, e := range records {
+		if e.Type == entry.Type && e.Value == entry.Value {
+			return e, nil
+		}
+	}
+	return Entry{}, createErr
+}
+
+// bulkCreated is the response to a bulk record creation. Records that
+// passed validation are created, invalid ones are returned as they were
+// sent.
+type bulkCreated struct {
+	Records        []Entry `json:"records"`
+	ValidRecords   []Entry `json:"valid_records"`
+	InvalidRecords []Entry `json:"invalid_records"`
+}
+
+// CreateRecordsBulk creates the given records with a single request and
+// returns the ones that were created, as stored by the API. If the API
+// rejects some of the records, the others are still created and returned
+// along with an error naming the rejected ones. APIs without the bulk
+// endpoint get a request per record instead.
+func (c *HetznerClient) CreateRecordsBulk(ctx context.Context, entries []Entry) ([]Entry, error) {
+	entries = append([]Entry(nil), entries...)
+	for i := range entries {
+		var err error
+		if entries[i], err = c.applyTTLFloor(entries[i]); err != nil {
+			return nil, err
+		}
+		if err := validateEntry(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	encoded := make([]Entry, len(entries))
+	for i, e := range entries {
+		var err error
+		if encoded[i], err = c.encodeEntry(e); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := json.Marshal(Entries{Records: encoded})
+	if err != nil {
+		return nil, err
+	}
+
+	// Bulk Create Records (POST https://dns.hetzner.com/api/v1/records/bulk)
+	resp, err := c.do(ctx, "POST", "/records/bulk", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		// releases the concurrency slot of the request, which the
+		// requests per record need with a limit of one
+		resp.Body.Close()
+		return c.createRecordsOneByOne(ctx, entries)
+	}
+	if !isSuccess(resp) {
+		err := newAPIError(fmt.Sprintf("creating %d records", len(entries)), resp)
+		for _, e := range entries {
+			c.audit(auditCreate, e, err)
+		}
+		return nil, err
+	}
+
+	created := bulkCreated{}
+	if err := decodeResponse(resp, fmt.Sprintf("creating %d records", len(entries)), &created); err != nil {
+		// the records may have been created, but their IDs are unknown
+		for _, e := range entries {
+			c.audit(auditCreate, e, err)
+		}
+		return nil, err
+	}
+	for i, e := range created.Records {
+		created.Records[i] = decodeEntry(e)
+		c.audit(auditCreate, created.Records[i], nil)
+	}
+	c.seen.add(created.Records...)
+	for _, e := range created.InvalidRecords {
+		c.audit(auditCreate, e, ErrInvalidRecord)
+	}
+	if len(created.InvalidRecords) > 0 {
+		names := make([]string, len(created.InvalidRecords))
+		for i, e := range created.InvalidRecords {
+			names[i] = e.Type + " " + e.Name
+		}
+		return created.Records, fmt.Errorf("%w: the API rejected %d of %d records: %s",
+			ErrInvalidRecord, len(created.InvalidRecords), len(entries), strings.Join(names, ", "))
+	}
+	return created.Records, nil
+}
+
+// createRecordsOneByOne creates the given records with a request each,
+// continuing after failures, and returns the ones that were created.
+func (c *HetznerClient) createRecordsOneByOne(ctx context.Context, entries []Entry) ([]Entry, error) {
+	var created []Entry
+	var failed []string
+	for _, entry := range entries {
+		e, err := c.CreateRecord(ctx, entry)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		created = append(created, e)
+	}
+	if len(failed) > 0 {
+		return created, fmt.Errorf("creating %d of %d records failed: %s", len(failed), len(entries), strings.Join(failed, "; "))
+	}
+	return created, nil
+}
+
+// DeleteRecord deletes the record with the given ID.
+func (c *HetznerClient) DeleteRecord(ctx context.Context, id string) error {
+	err := c.deleteRecord(ctx, id)
+	c.audit(auditDelete, c.seen.take(id), err)
+	return err
+}
+
+func (c *HetznerClient) deleteRecord(ctx context.Context, id string) error {
+	// Delete Record (DELETE https://dns.hetzner.com/api/v1/records/1)
+	resp, err := c.do(ctx, "DELETE", "/records/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !isSuccess(resp) {
+		return newAPIError("deleting record "+id, resp)
+	}
+
+	return nil
+}
+
+// GetRecord returns the record with the given ID. Unknown IDs fail with an
+// API error for which isNotFound reports true.
+func (c *HetznerClient) GetRecord(ctx context.Context, id string) (Entry, error) {
+	operation := "getting record " + id
+	// Get Record (GET https://dns.hetzner.com/api/v1/records/{RecordID})
+	resp, err := c.do(ctx, "GET", "/records/"+url.PathEscape(id), nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+
+	if !isSuccess(resp) {
+		return Entry{}, newAPIError(operation, resp)
+	}
+
+	var record struct {
+		Record Entry `json:"record"`
+	}
+	if err := decodeResponse(resp, operation, &record); err != nil {
+		return Entry{}, err
+	}
+	c.seen.add(record.Record)
+	return decodeEntry(record.Record), nil
+}
+
+// middlewares returns the middlewares requests are sent through, from the
+// outermost to the innermost one. Retries go before rate limiting, in-flight
+// tracking, metrics and logging so that each attempt is limited, tracked,
+// measured and logged, and after the circuit breaker, which counts a request
+// once.
+func (c *HetznerClient) middlewares() []middleware {
+	middlewares := []middleware{withHeader("Auth-API-Token", c.apiKey)}
+	if c.apiKeys != nil {
+		middlewares[0] = withAPIKeyFailover(c.apiKeys)
+	}
+	if c.userAgent != "" {
+		middlewares = append(middlewares, withHeader("User-Agent", c.userAgent))
+	}
+	if len(c.extraHeaders) > 0 {
+		middlewares = append(middlewares, withExtraHeaders(c.extraHeaders))
+	}
+	if c.correlationHeader != "" && c.correlationID != "" {
+		middlewares = append(middlewares, withCorrelationID(c.correlationHeader, c.correlationID))
+	}
+	if c.dryRun {
+		middlewares = append(middlewares, withDryRun())
+	}
+	if tracingEnabled() {
+		middlewares = append(middlewares, withTracing())
+	}
+	if c.circuitBreaker != nil {
+		middlewares = append(middlewares, withCircuitBreaker(c.circuitBreaker))
+	}
+	middlewares = append(middlewares, withRetry(c.maxRetries, c.retryBaseDelay, c.retryMaxDelay, c.retryMaxElapsed, c.retryJitter, c.retryNonIdempotent))
+	if tracingEnabled() {
+		middlewares = append(middlewares, countAttempts())
+	}
+	if c.rateLimiter != nil {
+		middlewares = append(middlewares, withRateLimit(c.rateLimiter))
+	}
+	if c.concurrency != nil {
+		middlewares = append(middlewares, withConcurrencyLimit(c.concurrency))
+	}
+	if c.liveness != nil {
+		middlewares = append(middlewares, withInFlight(c.liveness))
+	}
+	middlewares = append(middlewares, withMetrics(), withLogging(c.requestID, !bodyLoggingDisabled()))
+	if c.maxResponseBytes > 0 {
+		middlewares = append(middlewares, withBodyLimit(c.maxResponseBytes))
+	}
+	return append(middlewares, withDecompression())
+}
+
+// do sends a request to the API through the middleware chain.
+func (c *HetznerClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	cancel := context.CancelFunc(func() {})
+	timeout := c.timeout
+	if method != "GET" {
+		timeout = c.writeTimeout
+	}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, reqBody)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	transport := c.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := &http.Client{Transport: chain(transport, c.middlewares()...)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	// the deadline applies until the caller is done with the body
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHetznerClient_GetZones_EncodesZoneName(t *testing.T) {
+	for _, zone := range []string{
+		"xn--mnchen-3ya.de",
+		"münchen.de",
+		"example.com&search_name=evil.com",
+	} {
+		var received []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.URL.Query()["search_name"]
+			json.NewEncoder(w).Encode(Zones{Zones: []Zone{{ZoneID: "zone1"}}})
+		}))
+
+		zones, err := NewHetznerClient(srv.URL, "token").GetZones(context.Background(), zone)
+		srv.Close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, []Zone{{ZoneID: "zone1"}}, zones)
+		assert.Equal(t, []string{zone}, received, "zone name must reach the server unmodified")
+	}
+}
+
+func TestHetznerClient_GetZoneByID(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	m.zoneStatuses = map[string]string{"zone1": "verified"}
+	client := NewHetznerClient(srv.URL, "token")
+
+	zone, err := client.GetZoneByID(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Equal(t, Zone{ZoneID: "zone1", Name: "example.com", Status: "verified"}, zone)
+
+	_, err = client.GetZoneByID(context.Background(), "zone2")
+	assert.True(t, isNotFound(err), "got %v", err)
+	assert.Equal(t, []string{"GET /zones/zone1", "GET /zones/zone2"}, m.requests)
+}
+
+func TestHetznerClient_PerPage(t *testing.T) {
+	m, mockSrv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2", "example.net": "zone3"},
+		Entry{ID: "a", Name: "www", Type: "A", Value: "127.0.0.1", ZoneID: "zone1"},
+		Entry{ID: "b", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"},
+		Entry{ID: "c", Name: "mail", Type: "A", Value: "127.0.0.2", ZoneID: "zone1"},
+	)
+	mockSrv.Close()
+
+	var perPage []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perPage = append(perPage, r.URL.Query().Get("per_page"))
+		m.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	// by default all fit on a page of the API's maximum size
+	zones, err := client.ListZones(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, zones, 3)
+	records, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, []string{"100", "100"}, perPage)
+
+	perPage = nil
+	client.perPage = 2
+	zones, err = client.ListZones(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, zones, 3)
+	records, err = client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, []string{"2", "2", "2", "2"}, perPage)
+}
+
+func TestHetznerClient_DecodesMeta(t *testing.T) {
+	pages := map[string]string{
+		"/zones?1":   `{"zones":[{"id":"zone1","name":"example.com"}],"meta":{"pagination":{"page":1,"per_page":1,"last_page":2,"total_entries":2}}}`,
+		"/zones?2":   `{"zones":[{"id":"zone2","name":"example.org"}],"meta":{"pagination":{"page":2,"per_page":1,"last_page":2,"total_entries":2}}}`,
+		"/records?1": `{"records":[{"id":"a","name":"www","type":"A","value":"127.0.0.1","zone_id":"zone1"}],"meta":{"pagination":{"page":1,"per_page":1,"last_page":1,"total_entries":1}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pages[r.URL.Path+"?"+r.URL.Query().Get("page")]))
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	var zones Zones
+	assert.NoError(t, json.Unmarshal([]byte(pages["/zones?2"]), &zones))
+	assert.Equal(t, Pagination{Page: 2, PerPage: 1, LastPage: 2, TotalEntries: 2}, zones.Meta.Pagination)
+	var entries Entries
+	assert.NoError(t, json.Unmarshal([]byte(`{"records":[]}`), &entries))
+	assert.Equal(t, Pagination{}, entries.Meta.Pagination, "a missing meta block must decode to a single page")
+
+	logs, restore := captureLogs(4)
+	all, err := client.ListZones(context.Background())
+	assert.NoError(t, err)
+	records, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	restore()
+
+	assert.Equal(t, []Zone{{ZoneID: "zone1", Name: "example.com"}, {ZoneID: "zone2", Name: "example.org"}}, all)
+	assert.Len(t, records, 1)
+	assert.Contains(t, logs.String(), "listed 2 zones on 2 pages")
+	assert.Contains(t, logs.String(), "listed 1 records of zone zone1 on 1 pages")
+}
+
+func TestHetznerClient_ListRecordsByName(t *testing.T) {
+	m, mockSrv := newMockHetznerAPI(map[string]string{"example.com": "zone1"},
+		Entry{ID: "a", Name: "www", Type: "A", Value: "127.0.0.1", ZoneID: "zone1"},
+		Entry{ID: "b", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"},
+		Entry{ID: "c", Name: "mail", Type: "A", Value: "127.0.0.2", ZoneID: "zone1"},
+	)
+	mockSrv.Close()
+	m.perPage = 1
+
+	var names []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Query().Get("name"))
+		m.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	records, err := client.ListRecordsByName(context.Background(), "zone1", "_acme-challenge")
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{m.records["b"]}, records)
+	assert.Equal(t, []string{"_acme-challenge"}, names)
+
+	// a server ignoring the filter returns all records, on several pages
+	m.ignoreNameFilter = true
+	names = nil
+	records, err = client.ListRecordsByName(context.Background(), "zone1", "_acme-challenge")
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{m.records["b"]}, records)
+	assert.Equal(t, []string{"_acme-challenge", "_acme-challenge", "_acme-challenge"}, names)
+}
+
+func TestHetznerClient_CreateRecordsBulk(t *testing.T) {
+	entries := []Entry{
+		{Name: "_acme-challenge", Type: "TXT", Value: "key1", ZoneID: "zone1"},
+		{Name: "_acme-challenge", Type: "TXT", Value: "key2", ZoneID: "zone1"},
+	}
+
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		var sent Entries
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&sent))
+		created := bulkCreated{}
+		for i, e := range sent.Records {
+			if e.Value == "rejected" {
+				created.InvalidRecords = append(created.InvalidRecords, e)
+				continue
+			}
+			e.ID = fmt.Sprintf("id%d", i)
+			created.Records = append(created.Records, e)
+			created.ValidRecords = append(created.ValidRecords, e)
+		}
+		json.NewEncoder(w).Encode(created)
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	created, err := client.CreateRecordsBulk(context.Background(), entries)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"POST /records/bulk"}, requests)
+	if assert.Len(t, created, 2) {
+		assert.Equal(t, "id0", created[0].ID)
+		assert.Equal(t, "key2", created[1].Value)
+	}
+
+	// rejected records don't keep the others from being created
+	entries[0].Value = "rejected"
+	created, err = client.CreateRecordsBulk(context.Background(), entries)
+	assert.True(t, errors.Is(err, ErrInvalidRecord))
+	assert.EqualError(t, err, "invalid record: the API rejected 1 of 2 records: TXT _acme-challenge")
+	assert.Equal(t, []Entry{{ID: "id1", Name: "_acme-challenge", Type: "TXT", Value: "key2", ZoneID: "zone1"}}, created)
+
+	// records failing validation prevent the request
+	requests = nil
+	_, err = client.CreateRecordsBulk(context.Background(), []Entry{{Name: "", Type: "TXT", Value: "key"}})
+	assert.True(t, errors.Is(err, ErrInvalidRecord))
+	assert.Empty(t, requests)
+}
+
+func TestHetznerClient_CreateRecordsBulk_Unsupported(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	m.readOnlyZones = map[string]bool{"zone2": true}
+	client := NewHetznerClient(srv.URL, "token")
+
+	created, err := client.CreateRecordsBulk(context.Background(), []Entry{
+		{Name: "_acme-challenge", Type: "TXT", Value: "key1", ZoneID: "zone1"},
+		{Name: "_acme-challenge", Type: "TXT", Value: "key2", ZoneID: "zone2"},
+		{Name: "_acme-challenge", Type: "TXT", Value: "key3", ZoneID: "zone1"},
+	})
+	assert.Equal(t, []string{"POST /records/bulk", "POST /records", "POST /records", "POST /records"}, m.requests)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "creating 1 of 3 records failed: creating TXT record _acme-challenge failed with HTTP 403")
+	assert.Len(t, created, 2)
+	assert.Equal(t, []string{"key1", "key3"}, m.txtValues("_acme-challenge"))
+}
+
+func TestHetznerClient_CreateRecordsBulk_UnsupportedSingleSlot(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.concurrency = newSemaphore(1)
+
+	// the requests per record need the slot of the bulk request
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	created, err := client.CreateRecordsBulk(ctx, []Entry{
+		{Name: "_acme-challenge", Type: "TXT", Value: "key1", ZoneID: "zone1"},
+		{Name: "_acme-challenge", Type: "TXT", Value: "key2", ZoneID: "zone1"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, created, 2)
+	assert.Equal(t, []string{"POST /records/bulk", "POST /records", "POST /records"}, m.requests)
+	assert.Len(t, client.concurrency, 0, "all slots must be released")
+}
+
+func TestHetznerClient_CreateRecord_Status(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusCreated, http.StatusUnauthorized, http.StatusConflict, http.StatusUnprocessableEntity} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"error":{"message":"rejected","code":%d}}`, status)
+		}))
+
+		_, err := NewHetznerClient(srv.URL, "token").CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+		srv.Close()
+
+		if status < 300 {
+			assert.NoError(t, err, "HTTP %d", status)
+			continue
+		}
+		assert.Error(t, err, "HTTP %d", status)
+		assert.Contains(t, err.Error(), fmt.Sprintf("HTTP %d %s", status, http.StatusText(status)))
+		assert.Contains(t, err.Error(), fmt.Sprintf("rejected (code %d)", status), "the error message of the API must be part of the error")
+	}
+}
+
+func TestPresent_SendsKeyVerbatim(t *testing.T) {
+	// a key as issued by ACME servers, the base64url encoded SHA-256 digest
+	// of the key authorization, and one with characters encoding/json would
+	// escape, to make sure no quoting or escaping ends up in the record
+	for _, key := range []string{
+		"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0",
+		`-_=+/<&>"key"`,
+	} {
+		m, mockSrv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+		mockSrv.Close()
+		var values []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				body, _ := ioutil.ReadAll(r.Body)
+				var raw map[string]json.RawMessage
+				assert.NoError(t, json.Unmarshal(body, &raw))
+				var value string
+				assert.NoError(t, json.Unmarshal(raw["value"], &value))
+				values = append(values, value)
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			m.ServeHTTP(w, r)
+		}))
+		solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+		assert.NoError(t, solver.Present(newChallengeRequest(key, `{"apiKey": "token", "ownerMarker": "none"}`)))
+		assert.Equal(t, []string{key}, values, "the value sent must be the key byte for byte")
+		assert.Equal(t, []string{key}, m.txtValues("_acme-challenge"))
+		srv.Close()
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	for body, expected := range map[string]string{
+		`{"error":{"message":"invalid zone_id","code":422}}`: "listing zones failed with HTTP 422 Unprocessable Entity: invalid zone_id (code 422)",
+		`{"error":{"message":"invalid zone_id"}}`:            "listing zones failed with HTTP 422 Unprocessable Entity: invalid zone_id",
+		`{"message":"Invalid authentication credentials"}`:   "listing zones failed with HTTP 422 Unprocessable Entity: Invalid authentication credentials",
+		"<html>Bad Gateway</html>\n":                         "listing zones failed with HTTP 422 Unprocessable Entity: <html>Bad Gateway</html>",
+		`{"unexpected":true}`:                                "listing zones failed with HTTP 422 Unprocessable Entity: {\"unexpected\":true}",
+		"":                                                   "listing zones failed with HTTP 422 Unprocessable Entity",
+	} {
+		resp := &http.Response{
+			Status:     "422 Unprocessable Entity",
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		apiErr := newAPIError("listing zones", resp)
+		assert.EqualError(t, apiErr, expected)
+		assert.Equal(t, http.StatusUnprocessableEntity, apiErr.StatusCode)
+	}
+}
+
+func TestHetznerClient_DeleteRecord_Status(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"},
+		Entry{ID: "record1", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"},
+	)
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	assert.NoError(t, client.DeleteRecord(context.Background(), "record1"))
+
+	err := client.DeleteRecord(context.Background(), "record1")
+	assert.EqualError(t, err, "deleting record record1 failed with HTTP 404 Not Found")
+}
+
+func TestHetznerClient_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("zone_id") == "slow" {
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(Entries{})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.timeout = 50 * time.Millisecond
+	client.maxRetries = 0
+
+	_, err := client.ListRecords(context.Background(), "slow")
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+
+	// the deadline must not cut off reading a response in time
+	records, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestHetznerClient_WriteTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(Entries{})
+			return
+		}
+		json.NewEncoder(w).Encode(struct{ Record Entry }{Entry{ID: "new"}})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.maxRetries = 0
+
+	// reads time out, writes don't
+	client.timeout = 20 * time.Millisecond
+	client.writeTimeout = time.Second
+	_, err := client.ListRecords(context.Background(), "zone1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+	_, err = client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", ZoneID: "zone1", Type: "TXT", Value: "key"})
+	assert.NoError(t, err)
+	assert.NoError(t, client.DeleteRecord(context.Background(), "new"))
+
+	// writes time out, reads don't
+	client.timeout = time.Second
+	client.writeTimeout = 20 * time.Millisecond
+	_, err = client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	_, err = client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", ZoneID: "zone1", Type: "TXT", Value: "key"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+	assert.Contains(t, err.Error(), "the record may have been created nevertheless")
+	err = client.DeleteRecord(context.Background(), "new")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+}
+
+func TestHetznerClient_UserAgent(t *testing.T) {
+	var userAgents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		json.NewEncoder(w).Encode(Entries{})
+	}))
+	defer srv.Close()
+
+	client := NewHetznerClient(srv.URL, "token")
+	_, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+
+	client.userAgent = "acme-gateway/1.0"
+	_, err = client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"cert-manager-webhook-hetzner/dev", "acme-gateway/1.0"}, userAgents)
+}
+
+func TestHetznerClient_CompressedResponses(t *testing.T) {
+	zones := Zones{Zones: []Zone{{ZoneID: "zone1", Name: "example.com"}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("search_name")
+		buf := &bytes.Buffer{}
+		var zw io.WriteCloser = gzip.NewWriter(buf)
+		if encoding == "deflate" {
+			zw = zlib.NewWriter(buf)
+		}
+		json.NewEncoder(zw).Encode(zones)
+		zw.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, acceptEncoding := range []string{"", "gzip, deflate"} {
+		client := NewHetznerClient(srv.URL, "token")
+		if acceptEncoding != "" {
+			// the transport leaves decompression to the client then
+			client.extraHeaders = map[string]string{"Accept-Encoding": acceptEncoding}
+		}
+		for _, encoding := range []string{"gzip", "deflate"} {
+			if acceptEncoding == "" && encoding == "deflate" {
+				continue
+			}
+			got, err := client.GetZones(context.Background(), encoding)
+			assert.NoError(t, err, encoding)
+			assert.Equal(t, zones.Zones, got, encoding)
+		}
+	}
+}
+
+func TestHetznerClient_ResponseTooLarge(t *testing.T) {
+	var records []Entry
+	for i := 0; i < 50000; i++ {
+		records = append(records, Entry{ID: fmt.Sprintf("id%d", i), Name: "www", Type: "A", Value: "127.0.0.1", ZoneID: "zone1"})
+	}
+	body, err := json.Marshal(Entries{Records: records, Meta: Meta{Pagination: Pagination{Page: 1, LastPage: 1}}})
+	assert.NoError(t, err)
+	assert.True(t, len(body) > defaultMaxResponseBytes)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("compressed") != "" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	for _, path := range []string{"/records", "/records?compressed=1"} {
+		// the body of GET requests is read before returning the response
+		requests = 0
+		_, err := client.do(context.Background(), "GET", path, nil)
+		assert.True(t, errors.Is(err, ErrResponseTooLarge), path)
+		assert.Contains(t, err.Error(), "response too large: the body exceeds the limit of 4194304 bytes, see maxResponseBytes")
+		assert.Equal(t, 1, requests, "too large responses must not be retried")
+	}
+
+	_, err = client.ListRecords(context.Background(), "zone1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the limit of 4194304 bytes")
+
+	// the body is read along with logging it, which must not be retried
+	_, restore := captureLogs(4)
+	requests = 0
+	_, err = client.ListRecords(context.Background(), "zone1")
+	restore()
+	assert.True(t, errors.Is(err, ErrResponseTooLarge))
+	assert.Equal(t, 1, requests)
+
+	// a body of exactly the limit is fine
+	client.maxResponseBytes = int64(len(body))
+	records, err = client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 50000)
+}
+
+func TestHetznerClient_CreateRecord_Validation(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(map[string]Entry{"record": {ID: "record1"}})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+
+	valid := Entry{Name: "_acme-challenge.sub", TTL: 300, Type: "TXT", Value: strings.Repeat("k", 255)}
+	for _, tt := range []struct {
+		modify func(*Entry)
+		err    string
+	}{
+		{func(e *Entry) {}, ""},
+		{func(e *Entry) { e.TTL = 0 }, ""},
+		{func(e *Entry) { e.Name = "@" }, ""},
+		{func(e *Entry) { e.TTL = 30 }, ""},
+		{func(e *Entry) { e.TTL = 86401 }, "invalid record: TTL 86401 of record _acme-challenge.sub is not between 60 and 86400"},
+		{func(e *Entry) { e.Name = "" }, "invalid record: empty record name"},
+		{func(e *Entry) { e.Name = "_acme-challenge..sub" }, "invalid record: record name _acme-challenge..sub has a label that is empty or longer than 63 characters"},
+		{func(e *Entry) { e.Name = strings.Repeat("a", 64) }, "invalid record: record name " + strings.Repeat("a", 64) + " has a label that is empty or longer than 63 characters"},
+		{func(e *Entry) { e.Name = strings.Repeat("a.", 127) }, "invalid record: record name " + strings.Repeat("a.", 127) + " is 254 characters long, more than 253"},
+		{func(e *Entry) { e.Value += "k" }, ""},
+		{func(e *Entry) { e.Value += "k"; client.rejectLongTXT = true }, "invalid record: value of TXT record _acme-challenge.sub is 256 characters long, more than 255"},
+	} {
+		e := valid
+		client.rejectLongTXT = false
+		tt.modify(&e)
+		requests = 0
+		_, err := client.CreateRecord(context.Background(), e)
+		if tt.err == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, 1, requests)
+			continue
+		}
+		assert.EqualError(t, err, tt.err)
+		assert.True(t, errors.Is(err, ErrInvalidRecord))
+		assert.Equal(t, 0, requests, "invalid records must not be sent")
+	}
+}
+
+func TestHetznerClient_CreateRecord_TTLFloor(t *testing.T) {
+	var sent []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/records/bulk" {
+			var entries Entries
+			json.NewDecoder(r.Body).Decode(&entries)
+			for _, e := range entries.Records {
+				sent = append(sent, e.TTL)
+			}
+			json.NewEncoder(w).Encode(bulkCreated{Records: entries.Records, ValidRecords: entries.Records})
+			return
+		}
+		var e Entry
+		json.NewDecoder(r.Body).Decode(&e)
+		sent = append(sent, e.TTL)
+		json.NewEncoder(w).Encode(map[string]Entry{"record": e})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.ttlFloor = 120
+	entry := Entry{Name: "_acme-challenge", TTL: 30, Type: "TXT", Value: "key"}
+
+	logs, restore := captureLogs(0)
+	_, err := client.CreateRecord(context.Background(), entry)
+	assert.NoError(t, err)
+	_, err = client.CreateRecordsBulk(context.Background(), []Entry{entry})
+	assert.NoError(t, err)
+	restore()
+	assert.Equal(t, []int{120, 120}, sent, "the TTL must be raised to the floor")
+	assert.Equal(t, 30, entry.TTL)
+	assert.Contains(t, logs.String(), "TTL 30 of record _acme-challenge is below the minimum of 120, using 120")
+
+	client.strictTTL = true
+	_, err = client.CreateRecord(context.Background(), entry)
+	assert.True(t, errors.Is(err, ErrInvalidRecord), "got %v", err)
+	assert.EqualError(t, err, "invalid record: TTL 30 of record _acme-challenge is below the minimum of 120")
+	_, err = client.CreateRecordsBulk(context.Background(), []Entry{entry})
+	assert.True(t, errors.Is(err, ErrInvalidRecord), "got %v", err)
+	assert.Len(t, sent, 2, "records below the floor must not be sent in strict mode")
+}
+
+func TestHetznerClient_CreateRecord_Duplicate(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		body    string
+		existed bool
+		err     string
+	}{
+		{http.StatusConflict, `{"error":{"message":"record already exists","code":409}}`, true, ""},
+		{http.StatusUnprocessableEntity, `{"message":"Duplicate record"}`, true, ""},
+		{http.StatusUnprocessableEntity, `{"error":{"message":"invalid value","code":422}}`, true, "creating TXT record _acme-challenge failed with HTTP 422 Unprocessable Entity: invalid value (code 422)"},
+		{http.StatusConflict, `{"error":{"message":"record already exists","code":409}}`, false, "creating TXT record _acme-challenge failed with HTTP 409 Conflict: record already exists (code 409)"},
+	} {
+		m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"},
+			Entry{ID: "other", Name: "_acme-challenge", Type: "TXT", Value: "other", ZoneID: "zone1"},
+		)
+		if tt.existed {
+			m.records["existing"] = Entry{ID: "existing", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"}
+		}
+		client := NewHetznerClient(srv.URL, "token")
+		client.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == "POST" {
+				return &http.Response{StatusCode: tt.status, Status: fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)), Body: ioutil.NopCloser(strings.NewReader(tt.body)), Header: http.Header{}}, nil
+			}
+			return http.DefaultTransport.RoundTrip(req)
+		})
+
+		created, err := client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"})
+		srv.Close()
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.body)
+			continue
+		}
+		assert.NoError(t, err, tt.body)
+		assert.Equal(t, "existing", created.ID, "the existing record must be returned")
+	}
+}
+
+func TestHetznerClient_CreateRecord_DuplicateSingleSlot(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"},
+		Entry{ID: "existing", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"},
+	)
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.concurrency = newSemaphore(1)
+	client.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" {
+			return &http.Response{StatusCode: http.StatusConflict, Status: "409 Conflict", Body: ioutil.NopCloser(strings.NewReader(`{"error":{"message":"record already exists","code":409}}`)), Header: http.Header{}}, nil
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	// the lookup of the existing record needs the slot of the create
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	created, err := client.CreateRecord(ctx, Entry{Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "existing", created.ID)
+	assert.Len(t, client.concurrency, 0, "all slots must be released")
+	assert.Equal(t, 1, m.countRequests("GET /records"))
+}
+
+func TestPresent_ConcurrentlyCreatedRecord(t *testing.T) {
+	m, mockSrv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	mockSrv.Close()
+
+	// another Present creates the record between the lookup and the create
+	// of this one, so the API rejects it as a duplicate
+	created := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && !created {
+			created = true
+			m.Lock()
+			m.records["raced"] = Entry{ID: "raced", Name: "_acme-challenge", Type: "TXT", Value: "key", ZoneID: "zone1"}
+			m.Unlock()
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error":{"message":"record already exists","code":422}}`))
+			return
+		}
+		m.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// the existing record is looked up after the rejected create
+	// released its concurrency slot
+	for _, config := range []string{
+		`{"apiKey": "token", "ownerMarker": "none"}`,
+		`{"apiKey": "token", "ownerMarker": "none", "maxConcurrentRequests": 1, "operationTimeoutSeconds": 5}`,
+	} {
+		created = false
+		solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+		assert.NoError(t, solver.Present(newChallengeRequest("key", config)), config)
+		assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"), config)
+
+		assert.NoError(t, solver.CleanUp(newChallengeRequest("key", config)), config)
+		assert.Empty(t, m.records, "CleanUp must delete the record created by the other Present")
+	}
+}
+
+func TestEncodeTXTValue(t *testing.T) {
+	long := strings.Repeat("a", 254) + `"\` + strings.Repeat("b", 300)
+	encoded := encodeTXTValue(long)
+	assert.Equal(t, `"`+strings.Repeat("a", 254)+`\"" "\\`+strings.Repeat("b", 254)+`" "`+strings.Repeat("b", 46)+`"`, encoded)
+	assert.Equal(t, long, decodeTXTValue(encoded))
+
+	for _, value := range []string{"key", strings.Repeat("k", 255), `"v=spf1 -all"`, `"a" b`, `"a" "b`, ""} {
+		assert.Equal(t, value, encodeTXTValue(value), "short values must be sent as is")
+		assert.Equal(t, value, decodeTXTValue(value), "values that aren't split must be kept")
+	}
+	assert.Equal(t, "ab", decodeTXTValue(`"a"  "b"`))
+}
+
+func TestPresentAndCleanUp_LongTXTValue(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	key := strings.Repeat("k", 300)
+
+	assert.NoError(t, solver.Present(newChallengeRequest(key, `{"apiKey": "token"}`)))
+	assert.Equal(t, []string{`"` + strings.Repeat("k", 255) + `" "` + strings.Repeat("k", 45) + `"`}, m.txtValues("_acme-challenge"))
+
+	// the split value is found again by its joined value
+	assert.NoError(t, solver.Present(newChallengeRequest(key, `{"apiKey": "token"}`)))
+	assert.Len(t, m.txtValues("_acme-challenge"), 1)
+	assert.NoError(t, solver.CleanUp(newChallengeRequest(key, `{"apiKey": "token"}`)))
+	assert.Empty(t, m.records)
+
+	err := solver.Present(newChallengeRequest(key, `{"apiKey": "token", "rejectLongTxtValues": true}`))
+	assert.True(t, errors.Is(err, ErrInvalidRecord), "%v", err)
+	assert.Empty(t, m.records)
+}
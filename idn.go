@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts domain names to the ASCII form the API stores them
+// in, e.g. münchen.de to xn--mnchen-3ya.de. Unlike idna.Lookup it accepts
+// underscores, as in _acme-challenge.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
+// toASCII returns name in lowercase ASCII form, converting internationalized
+// labels to punycode.
+func toASCII(name string) (string, error) {
+	return idnaProfile.ToASCII(name)
+}
+
+// normalizeName returns the zone or record name in the form names are
+// compared in: lowercase and without trailing dots, as the API may return
+// zones like example.com. and cert-manager passes fully qualified names.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimRight(name, "."))
+}
+
+// sameName reports whether the record or zone names a and b are equal once
+// normalized and converted to ASCII.
+func sameName(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == b {
+		return true
+	}
+	asciiA, errA := toASCII(a)
+	asciiB, errB := toASCII(b)
+	return errA == nil && errB == nil && asciiA == asciiB
+}
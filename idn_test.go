@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToASCII(t *testing.T) {
+	for name, expected := range map[string]string{
+		"münchen.de":                  "xn--mnchen-3ya.de",
+		"xn--mnchen-3ya.de":           "xn--mnchen-3ya.de",
+		"_acme-challenge.MÜNCHEN.de.": "_acme-challenge.xn--mnchen-3ya.de.",
+		"_acme-challenge":             "_acme-challenge",
+		"@":                           "@",
+	} {
+		ascii, err := toASCII(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, ascii, name)
+	}
+
+	assert.True(t, sameName("_acme-challenge.bücher", "_acme-challenge.xn--bcher-kva"))
+	assert.True(t, sameName("_acme-challenge", "_acme-challenge"))
+	assert.False(t, sameName("_acme-challenge.bücher", "_acme-challenge.bucher"))
+}
+
+func TestNormalizeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"example.com":               "example.com",
+		"example.com.":              "example.com",
+		"Example.COM..":             "example.com",
+		"_ACME-Challenge.":          "_acme-challenge",
+		"_acme-challenge.Bücher.de": "_acme-challenge.bücher.de",
+		"@":                         "@",
+	} {
+		assert.Equal(t, expected, normalizeName(name), name)
+	}
+
+	assert.True(t, sameName("example.com.", "Example.com"))
+	assert.True(t, sameName("_acme-challenge.BÜCHER.", "_acme-challenge.xn--bcher-kva"))
+	assert.False(t, sameName("example.com", "example.com.au"))
+}
+
+func TestPresentAndCleanUp_NameVariants(t *testing.T) {
+	// the API returns the zone and the record with trailing dots and in
+	// other case than the challenge
+	m, srv := newMockHetznerAPI(map[string]string{"Example.com.": "zone1"},
+		Entry{ID: "a", Name: "_ACME-challenge.", Type: "TXT", Value: "key", ZoneID: "zone1"},
+	)
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	for _, zone := range []string{"example.com.", "EXAMPLE.com", "example.com.."} {
+		ch := newChallengeRequest("key", `{"apiKey": "token", "zoneLookup": "search_name", "ownerMarker": "none"}`)
+		ch.ResolvedFQDN, ch.ResolvedZone = "_acme-challenge."+zone, zone
+
+		assert.NoError(t, solver.Present(ch), zone)
+		assert.Equal(t, 0, m.countRequests("POST /records"), "the existing record must be found for %s", zone)
+	}
+
+	ch := newChallengeRequest("key", `{"apiKey": "token"}`)
+	ch.ResolvedFQDN, ch.ResolvedZone = "_acme-challenge.Example.com.", "example.COM."
+	assert.NoError(t, (&hetznerDNSProviderSolver{apiURL: srv.URL}).CleanUp(ch))
+	assert.Empty(t, m.records)
+}
+
+func TestPresentAndCleanUp_IDN(t *testing.T) {
+	for _, tt := range []struct {
+		fqdn, zone string
+	}{
+		{"_acme-challenge.bücher.münchen.de.", "münchen.de."},
+		{"_acme-challenge.bücher.münchen.de.", "xn--mnchen-3ya.de."},
+		{"_acme-challenge.xn--bcher-kva.xn--mnchen-3ya.de.", "münchen.de."},
+	} {
+		m, srv := newMockHetznerAPI(map[string]string{"xn--mnchen-3ya.de": "zone1"})
+		solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+		ch := newChallengeRequest("key", `{"apiKey": "token"}`)
+		ch.ResolvedFQDN, ch.ResolvedZone = tt.fqdn, tt.zone
+
+		assert.NoError(t, solver.Present(ch), tt.fqdn)
+		assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge.xn--bcher-kva"), tt.fqdn)
+		assert.NoError(t, solver.CleanUp(ch), tt.fqdn)
+		assert.Empty(t, m.records, tt.fqdn)
+		srv.Close()
+	}
+
+	// records the API returns with Unicode names are matched as well
+	m, srv := newMockHetznerAPI(map[string]string{"xn--mnchen-3ya.de": "zone1"},
+		Entry{ID: "a", Name: "_acme-challenge.bücher", Type: "TXT", Value: "key", ZoneID: "zone1"},
+	)
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	assert.NoError(t, solver.CleanUp(&v1alpha1.ChallengeRequest{
+		ResolvedFQDN: "_acme-challenge.bücher.münchen.de.",
+		ResolvedZone: "münchen.de.",
+		Key:          "key",
+		Config:       newChallengeRequest("key", `{"apiKey": "token"}`).Config,
+	}))
+	assert.Empty(t, m.records)
+}
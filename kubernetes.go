@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// podNamespaceEnv is the environment variable holding the namespace of the
+// webhook, usually set with the downward API.
+const podNamespaceEnv = "POD_NAMESPACE"
+
+// namespaceFile holds the namespace of the webhook pod's service account. It
+// is a variable so that tests can replace it.
+var namespaceFile = "/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// GetNamespace returns the namespace the webhook is running in, from the
+// POD_NAMESPACE environment variable or else the service account.
+func GetNamespace() (string, error) {
+	if namespace := strings.TrimSpace(os.Getenv(podNamespaceEnv)); namespace != "" {
+		return namespace, nil
+	}
+
+	data, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("error determining the webhook namespace: %s is not set and reading %s failed: %v", podNamespaceEnv, namespaceFile, err)
+	}
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("error determining the webhook namespace: %s is not set and %s is empty", podNamespaceEnv, namespaceFile)
+	}
+	return namespace, nil
+}
+
+// namespaceSource returns where GetNamespace takes the webhook's namespace
+// from: "env", "file" or "none" if neither is available.
+func namespaceSource() string {
+	if strings.TrimSpace(os.Getenv(podNamespaceEnv)) != "" {
+		return "env"
+	}
+	if _, err := os.Stat(namespaceFile); err == nil {
+		return "file"
+	}
+	return "none"
+}
+
+// disableKubernetesClientEnv is the environment variable disabling the
+// Kubernetes client when set to "true", for deployments taking the API token
+// only from the solver config, the environment or files, whose service
+// account may not read secrets.
+const disableKubernetesClientEnv = "DISABLE_KUBERNETES_CLIENT"
+
+// ErrKubernetesClientDisabled is returned when reading secrets or recording
+// events while the Kubernetes client is disabled.
+var ErrKubernetesClientDisabled = errors.New("the Kubernetes client is disabled with " + disableKubernetesClientEnv)
+
+// kubernetesClientDisabled reports whether DISABLE_KUBERNETES_CLIENT is set.
+func kubernetesClientDisabled() bool {
+	return os.Getenv(disableKubernetesClientEnv) == "true"
+}
+
+// inClusterConfig loads the config of the cluster the webhook is running
+// in, replaced in tests.
+var inClusterConfig = rest.InClusterConfig
+
+// NewKubernetesConfig returns a clientset for the cluster the webhook is
+// running in.
+func NewKubernetesConfig() (kubernetes.Interface, error) {
+	config, err := inClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading in-cluster config: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newClientset builds the clientset, replaced in tests.
+var newClientset = NewKubernetesConfig
+
+// kubernetesClient returns the solver's clientset, building it from the
+// in-cluster config on first use unless it was injected or set up by
+// Initialize. It is only built once a challenge references a secret or
+// emits an event, so that deployments not doing so work without access to
+// the Kubernetes API.
+func (c *hetznerDNSProviderSolver) kubernetesClient() (kubernetes.Interface, error) {
+	if kubernetesClientDisabled() {
+		return nil, ErrKubernetesClientDisabled
+	}
+
+	c.kubeClientMu.Lock()
+	defer c.kubeClientMu.Unlock()
+	if c.kubeClient == nil {
+		client, err := newClientset()
+		if err != nil {
+			return nil, err
+		}
+		c.kubeClient = client
+	}
+	return c.kubeClient, nil
+}
+
+// checkKubernetesClient logs at startup whether secrets can be read, so
+// that a missing in-cluster config doesn't only show when a challenge
+// references a secret.
+func checkKubernetesClient() {
+	if kubernetesClientDisabled() {
+		klog.Infof("%s is set, challenges can't use apiKeySecretRef, apiKeySecretSelector or emitEvents", disableKubernetesClientEnv)
+		return
+	}
+	if _, err := inClusterConfig(); err != nil {
+		klog.Warningf("the in-cluster Kubernetes config is unavailable, challenges using apiKeySecretRef, apiKeySecretSelector or emitEvents will fail: %v; "+
+			"set %s=true if API tokens are only taken from the solver config, the environment or files", err, disableKubernetesClientEnv)
+	}
+}
+
+// GetSecret returns the secret with the given name in the given namespace,
+// or in the webhook's namespace if namespace is empty. Transient failures
+// of the Kubernetes API are retried, see getSecretWithRetry.
+func GetSecret(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*corev1.Secret, error) {
+	if namespace == "" {
+		var err error
+		if namespace, err = GetNamespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	return getSecretWithRetry(ctx, clientset.CoreV1().Secrets(namespace), namespace, name)
+}
+
+// getSecretRetries is the number of times getSecretWithRetry retries a
+// transient failure, getSecretRetryDelay the delay before the first retry,
+// doubled for each further one.
+var (
+	getSecretRetries    = 3
+	getSecretRetryDelay = 500 * time.Millisecond
+)
+
+// getSecretWithRetry gets the secret with the given name from secrets, the
+// secrets of the given namespace. Transient failures, like a timeout or an
+// unavailable API server, are retried up to getSecretRetries times. A missing
+// secret or missing permissions fail right away, as retrying won't help.
+func getSecretWithRetry(ctx context.Context, secrets corev1client.SecretInterface, namespace, name string) (*corev1.Secret, error) {
+	delay := getSecretRetryDelay
+	for attempt := 0; ; attempt++ {
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			return secret, nil
+		case apierrors.IsNotFound(err):
+			return nil, fmt.Errorf("secret %s/%s not found: %v", namespace, name, err)
+		case apierrors.IsForbidden(err):
+			return nil, fmt.Errorf("the webhook is not allowed to read secret %s/%s, its service account needs get access to secrets in namespace %s: %v", namespace, name, namespace, err)
+		case !isTransientKubernetesError(err) || attempt >= getSecretRetries:
+			return nil, fmt.Errorf("error getting secret %s/%s: %v", namespace, name, err)
+		}
+
+		klog.V(2).Infof("error getting secret %s/%s, retrying in %v: %v", namespace, name, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error getting secret %s/%s: %v", namespace, name, err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientKubernetesError reports whether err is a failure of the
+// Kubernetes API that may go away when the request is repeated, i.e. a
+// network error, a timeout, rate limiting or a server error.
+func isTransientKubernetesError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
+
+// ListSecrets returns the secrets matching the given label selector in the
+// given namespace, or in the webhook's namespace if namespace is empty.
+func ListSecrets(ctx context.Context, clientset kubernetes.Interface, namespace, selector string) ([]corev1.Secret, error) {
+	if namespace == "" {
+		var err error
+		if namespace, err = GetNamespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if apierrors.IsForbidden(err) {
+		return nil, fmt.Errorf("the webhook is not allowed to list secrets in namespace %s, its service account needs list access to them: %v", namespace, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets matching %s in namespace %s: %v", selector, namespace, err)
+	}
+	return secrets.Items, nil
+}
+
+// secretKeySelector references a key of a secret like
+// cmmeta.SecretKeySelector, optionally in another namespace than the
+// webhook's, e.g. the one of the issuer in multi-tenant setups.
+type secretKeySelector struct {
+	cmmeta.SecretKeySelector `json:",inline"`
+
+	// Namespace of the secret, defaults to the webhook's namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// selector selects the secret by its labels instead of its name. It is
+	// set from apiKeySecretSelector.
+	selector string
+}
+
+// isSet returns whether the reference selects a secret.
+func (ref secretKeySelector) isSet() bool {
+	return ref.Name != "" || ref.selector != ""
+}
+
+// String returns the name of the secret, qualified with its namespace if
+// it is set.
+func (ref secretKeySelector) String() string {
+	name := ref.Name
+	if name == "" {
+		name = "matching " + ref.selector
+	}
+	if ref.Namespace != "" {
+		return ref.Namespace + "/" + name
+	}
+	return name
+}
+
+// inNamespace returns the reference with its namespace set to namespace,
+// unless it sets one itself.
+func (ref secretKeySelector) inNamespace(namespace string) secretKeySelector {
+	if ref.Namespace == "" {
+		ref.Namespace = namespace
+	}
+	return ref
+}
+
+// Values of SecretNamespaceSource besides a namespace.
+const (
+	secretNamespaceWebhook   = "webhook"
+	secretNamespaceChallenge = "challenge"
+)
+
+// namespacePattern matches valid namespace names.
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// secretNamespace returns the namespace of secret references without a
+// namespace according to SecretNamespaceSource, or "" for the webhook's
+// namespace.
+func secretNamespace(cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest) (string, error) {
+	switch cfg.SecretNamespaceSource {
+	case "", secretNamespaceWebhook:
+		return "", nil
+	case secretNamespaceChallenge:
+		if ch.ResourceNamespace == "" {
+			return "", errors.New("secretNamespaceSource is challenge but the challenge has no resource namespace")
+		}
+		return ch.ResourceNamespace, nil
+	}
+	return cfg.SecretNamespaceSource, nil
+}
+
+// findSecret returns the secret referenced by ref, looking it up by its
+// labels if ref has a selector. The selector has to match exactly one
+// secret.
+func findSecret(ctx context.Context, clientset kubernetes.Interface, ref secretKeySelector) (*corev1.Secret, error) {
+	if ref.selector == "" {
+		return GetSecret(ctx, clientset, ref.Namespace, ref.Name)
+	}
+
+	secrets, err := ListSecrets(ctx, clientset, ref.Namespace, ref.selector)
+	if err != nil {
+		return nil, err
+	}
+	switch len(secrets) {
+	case 0:
+		return nil, fmt.Errorf("no secret matches apiKeySecretSelector %s", ref.selector)
+	case 1:
+		return &secrets[0], nil
+	}
+	names := make([]string, len(secrets))
+	for i, secret := range secrets {
+		names[i] = secret.Name
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("apiKeySecretSelector %s matches %d secrets instead of one: %s", ref.selector, len(secrets), strings.Join(names, ", "))
+}
+
+// getApiKeyFromSecret returns the API token stored in the referenced
+// secret key, read with clientset. The secret is read on every call and not
+// cached, so a rotated token is used for the next challenge.
+func getApiKeyFromSecret(ctx context.Context, clientset kubernetes.Interface, ref secretKeySelector) (string, error) {
+	secret, err := findSecret(ctx, clientset, ref)
+	if err != nil {
+		return "", err
+	}
+	if ref.selector != "" {
+		ref.Name = secret.Name
+	}
+
+	data, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", ref, ref.Key)
+	}
+	apiKey := strings.TrimSpace(string(data))
+	if apiKey == "" {
+		return "", fmt.Errorf("empty API token in key %s of secret %s", ref.Key, ref)
+	}
+	return apiKey, nil
+}
+
+// apiKeyFromSecret returns the API token stored in the referenced secret
+// key, read with the solver's clientset.
+func (c *hetznerDNSProviderSolver) apiKeyFromSecret(ctx context.Context, ref secretKeySelector) (string, error) {
+	clientset, err := c.kubernetesClient()
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %s: %w", ref, err)
+	}
+	return getApiKeyFromSecret(ctx, clientset, ref)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeSecrets gives solver a fake clientset holding the given secrets until
+// the returned function is called. Secrets in the webhook's namespace,
+// "webhook", are keyed by their name, others by namespace/name.
+func fakeSecrets(solver *hetznerDNSProviderSolver, secrets map[string]*corev1.Secret) func() {
+	var objects []runtime.Object
+	for key, secret := range secrets {
+		secret = secret.DeepCopy()
+		secret.Namespace, secret.Name = "webhook", key
+		if i := strings.Index(key, "/"); i >= 0 {
+			secret.Namespace, secret.Name = key[:i], key[i+1:]
+		}
+		objects = append(objects, secret)
+	}
+	useFakeClientset(solver, objects...)
+	return setEnv(podNamespaceEnv, "webhook")
+}
+
+// setEnv sets the environment variable name to value until the returned
+// function is called.
+func setEnv(name, value string) func() {
+	previous, set := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if set {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestPresent_RotatedSecret(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	config := `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}, "zoneCacheSeconds": 60}`
+
+	defer fakeSecrets(solver, map[string]*corev1.Secret{
+		"hetzner": {Data: map[string][]byte{"api-token": []byte("revoked")}},
+	})()
+
+	assert.Error(t, solver.Present(newChallengeRequest("key", config)))
+
+	// the rotated token is used for the next challenge without a restart
+	secrets := solver.kubeClient.CoreV1().Secrets("webhook")
+	secret, err := secrets.Get(context.Background(), "hetzner", metav1.GetOptions{})
+	assert.NoError(t, err)
+	secret.Data["api-token"] = []byte("token\n")
+	_, err = secrets.Update(context.Background(), secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, solver.Present(newChallengeRequest("key", config)))
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+}
+
+// fakeSecretList gives solver a fake clientset holding the given secrets
+// until the returned function is called.
+func fakeSecretList(solver *hetznerDNSProviderSolver, secrets ...corev1.Secret) func() {
+	objects := make([]runtime.Object, len(secrets))
+	for i := range secrets {
+		objects[i] = &secrets[i]
+	}
+	useFakeClientset(solver, objects...)
+	return setEnv(podNamespaceEnv, "webhook")
+}
+
+func TestPresent_SecretSelector(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	secret := func(name string, labels map[string]string, token string) corev1.Secret {
+		return corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tenant", Labels: labels},
+			Data:       map[string][]byte{"api-token": []byte(token)},
+		}
+	}
+	defer fakeSecretList(solver,
+		secret("team-a", map[string]string{"team": "a", "dns": "hetzner"}, "token"),
+		secret("team-b", map[string]string{"team": "b", "dns": "hetzner"}, "revoked"),
+		secret("team-b-old", map[string]string{"team": "b", "dns": "hetzner"}, "revoked"),
+	)()
+
+	config := func(team string) string {
+		return `{"apiKeySecretRef": {"key": "api-token", "namespace": "tenant"}, "apiKeySecretSelector": {"matchLabels": {"team": "` + team + `", "dns": "hetzner"}}}`
+	}
+	assert.NoError(t, solver.Present(newChallengeRequest("key", config("a"))))
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+
+	assert.EqualError(t, solver.Present(newChallengeRequest("key", config("b"))),
+		"apiKeySecretSelector dns=hetzner,team=b matches 2 secrets instead of one: team-b, team-b-old")
+	assert.EqualError(t, solver.Present(newChallengeRequest("key", config("c"))),
+		"no secret matches apiKeySecretSelector dns=hetzner,team=c")
+
+	for config, expected := range map[string]string{
+		`{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}, "apiKeySecretSelector": {"matchLabels": {"team": "a"}}}`: "only one of apiKeySecretRef.name and apiKeySecretSelector may be set",
+		`{"apiKeySecretSelector": {"matchLabels": {"team": "a"}}}`:                                                             "apiKeySecretRef.key is required when apiKeySecretSelector is set",
+		`{"apiKeySecretRef": {"key": "api-token"}, "apiKeySecretSelector": {}}`:                                                "apiKeySecretSelector must select by at least one label",
+	} {
+		_, err := loadConfig(&extapi.JSON{Raw: []byte(config)})
+		assert.EqualError(t, err, expected, config)
+	}
+}
+
+func TestPresent_SecretNamespace(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	defer fakeSecrets(solver, map[string]*corev1.Secret{
+		"hetzner":        {Data: map[string][]byte{"api-token": []byte("revoked")}},
+		"tenant/hetzner": {Data: map[string][]byte{"api-token": []byte("token")}},
+	})()
+
+	config := `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token", "namespace": "tenant"}}`
+	assert.NoError(t, solver.Present(newChallengeRequest("key", config)))
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+
+	config = `{"apiKeySecretRef": {"name": "hetzner", "key": "other", "namespace": "tenant"}}`
+	assert.EqualError(t, solver.Present(newChallengeRequest("key", config)), "secret tenant/hetzner has no key other")
+
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKeySecretRef": {"namespace": "tenant"}}`)})
+	assert.EqualError(t, err, "apiKeySecretRef.name is required when apiKeySecretRef.namespace is set")
+}
+
+func TestPresent_SecretNamespaceSource(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	defer fakeSecrets(solver, map[string]*corev1.Secret{
+		"hetzner":        {Data: map[string][]byte{"api-token": []byte("revoked")}},
+		"tenant/hetzner": {Data: map[string][]byte{"api-token": []byte("token")}},
+		"shared/hetzner": {Data: map[string][]byte{"api-token": []byte("token")}},
+	})()
+
+	for _, tt := range []struct {
+		source string
+		ok     bool
+	}{
+		{"", false},
+		{"webhook", false},
+		{"challenge", true},
+		{"shared", true},
+		{"other", false},
+	} {
+		ch := newChallengeRequest("key-"+tt.source, `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}, "secretNamespaceSource": "`+tt.source+`"}`)
+		ch.ResourceNamespace = "tenant"
+		err := solver.Present(ch)
+		if tt.ok {
+			assert.NoError(t, err, tt.source)
+		} else {
+			assert.Error(t, err, tt.source)
+		}
+	}
+
+	// a namespace in the reference takes precedence
+	ch := newChallengeRequest("key", `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token", "namespace": "shared"}, "secretNamespaceSource": "challenge"}`)
+	ch.ResourceNamespace = "other"
+	assert.NoError(t, solver.Present(ch))
+
+	ch.ResourceNamespace = ""
+	ch.Config.Raw = []byte(`{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}, "secretNamespaceSource": "challenge"}`)
+	assert.EqualError(t, solver.Present(ch), "secretNamespaceSource is challenge but the challenge has no resource namespace")
+
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "secretNamespaceSource": "Not_A_Namespace"}`)})
+	assert.EqualError(t, err, `secretNamespaceSource must be webhook, challenge or a namespace but is "Not_A_Namespace"`)
+}
+
+func TestGetNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "namespace")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(file string) { namespaceFile = file }(namespaceFile)
+	namespaceFile = filepath.Join(dir, "namespace")
+	os.Unsetenv(podNamespaceEnv)
+
+	_, err = GetNamespace()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error determining the webhook namespace: POD_NAMESPACE is not set and reading "+namespaceFile+" failed")
+
+	assert.NoError(t, ioutil.WriteFile(namespaceFile, []byte("\n"), 0600))
+	_, err = GetNamespace()
+	assert.EqualError(t, err, "error determining the webhook namespace: POD_NAMESPACE is not set and "+namespaceFile+" is empty")
+
+	assert.NoError(t, ioutil.WriteFile(namespaceFile, []byte("cert-manager\n"), 0600))
+	namespace, err := GetNamespace()
+	assert.NoError(t, err)
+	assert.Equal(t, "cert-manager", namespace)
+
+	os.Setenv(podNamespaceEnv, "webhook")
+	defer os.Unsetenv(podNamespaceEnv)
+	namespace, err = GetNamespace()
+	assert.NoError(t, err)
+	assert.Equal(t, "webhook", namespace, "POD_NAMESPACE takes precedence over the service account")
+}
+
+// countClientsets replaces newClientset with a function counting its calls
+// until the returned function is called.
+func countClientsets(calls *int) func() {
+	newClientset = func() (kubernetes.Interface, error) {
+		*calls++
+		return &kubernetes.Clientset{}, nil
+	}
+	return func() { newClientset = NewKubernetesConfig }
+}
+
+func TestKubernetesClient_BuiltOnFirstUse(t *testing.T) {
+	calls := 0
+	defer countClientsets(&calls)()
+
+	solver := &hetznerDNSProviderSolver{}
+	_, err := solver.kubernetesClient()
+	assert.NoError(t, err)
+	_, err = solver.kubernetesClient()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	// each solver has a clientset of its own
+	other := &hetznerDNSProviderSolver{kubeClient: fake.NewSimpleClientset()}
+	client, err := other.kubernetesClient()
+	assert.NoError(t, err)
+	assert.Equal(t, other.kubeClient, client)
+	assert.NotEqual(t, solver.kubeClient, client)
+	assert.Equal(t, 1, calls)
+}
+
+func TestKubernetesClient_Disabled(t *testing.T) {
+	calls := 0
+	defer countClientsets(&calls)()
+	os.Setenv(disableKubernetesClientEnv, "true")
+	defer os.Unsetenv(disableKubernetesClientEnv)
+	os.Setenv(podNameEnv, "webhook")
+	defer os.Unsetenv(podNameEnv)
+
+	// even an injected clientset isn't used
+	solver := &hetznerDNSProviderSolver{kubeClient: fake.NewSimpleClientset()}
+	_, err := solver.kubernetesClient()
+	assert.True(t, errors.Is(err, ErrKubernetesClientDisabled))
+	ref := secretKeySelector{SecretKeySelector: cmmeta.SecretKeySelector{LocalObjectReference: cmmeta.LocalObjectReference{Name: "hetzner"}, Key: "api-token"}}
+	_, err = solver.apiKeyFromSecret(context.Background(), ref)
+	assert.True(t, errors.Is(err, ErrKubernetesClientDisabled))
+	assert.EqualError(t, err, "error reading secret hetzner: the Kubernetes client is disabled with DISABLE_KUBERNETES_CLIENT")
+	_, err = (&hetznerDNSProviderSolver{}).kubernetesClient()
+	assert.True(t, errors.Is(err, ErrKubernetesClientDisabled))
+	assert.Equal(t, 0, calls)
+}
+
+func TestPresent_WithoutClientset(t *testing.T) {
+	calls := 0
+	defer countClientsets(&calls)()
+	os.Setenv(apiTokenEnv, "token")
+	defer os.Unsetenv(apiTokenEnv)
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	// API tokens from the environment or the config don't need the clientset
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{}`)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	assert.Empty(t, m.txtValues("_acme-challenge"))
+	assert.Equal(t, 0, calls)
+
+	os.Setenv(disableKubernetesClientEnv, "true")
+	defer os.Unsetenv(disableKubernetesClientEnv)
+	err := solver.Present(newChallengeRequest("key", `{"apiKeySecretRef": {"name": "hetzner", "key": "token"}}`))
+	assert.True(t, errors.Is(err, ErrKubernetesClientDisabled))
+}
+
+func TestCheckKubernetesClient(t *testing.T) {
+	defer func() { inClusterConfig = rest.InClusterConfig }()
+	inClusterConfig = func() (*rest.Config, error) {
+		return nil, rest.ErrNotInCluster
+	}
+
+	logs, restore := captureLogs(0)
+	checkKubernetesClient()
+	restore()
+	assert.Contains(t, logs.String(), "the in-cluster Kubernetes config is unavailable, challenges using apiKeySecretRef, apiKeySecretSelector or emitEvents will fail")
+	assert.Contains(t, logs.String(), "set DISABLE_KUBERNETES_CLIENT=true")
+
+	// no warning when the client is disabled on purpose
+	os.Setenv(disableKubernetesClientEnv, "true")
+	defer os.Unsetenv(disableKubernetesClientEnv)
+	logs, restore = captureLogs(0)
+	checkKubernetesClient()
+	restore()
+	assert.NotContains(t, logs.String(), "unavailable")
+}
+
+// useFakeClientset injects a fake clientset holding the given objects into
+// solver and returns it.
+func useFakeClientset(solver *hetznerDNSProviderSolver, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	solver.kubeClient = client
+	return client
+}
+
+func TestGetApiKeyFromSecret_Clientset(t *testing.T) {
+	os.Setenv(podNamespaceEnv, "webhook")
+	defer os.Unsetenv(podNamespaceEnv)
+	secret := func(namespace, name string, labels map[string]string, data map[string]string) *corev1.Secret {
+		s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}, Data: map[string][]byte{}}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+	client := useFakeClientset(&hetznerDNSProviderSolver{},
+		secret("webhook", "hetzner", nil, map[string]string{"api-token": "token\n", "blank": " "}),
+		secret("team-a", "hetzner", map[string]string{"dns": "hetzner"}, map[string]string{"api-token": "team-a-token"}),
+	)
+	ref := func(namespace, name, key string) secretKeySelector {
+		return secretKeySelector{SecretKeySelector: cmmeta.SecretKeySelector{LocalObjectReference: cmmeta.LocalObjectReference{Name: name}, Key: key}, Namespace: namespace}
+	}
+
+	apiKey, err := getApiKeyFromSecret(context.Background(), client, ref("", "hetzner", "api-token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "token", apiKey)
+
+	apiKey, err = getApiKeyFromSecret(context.Background(), client, ref("team-a", "hetzner", "api-token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a-token", apiKey)
+
+	apiKey, err = getApiKeyFromSecret(context.Background(), client, secretKeySelector{SecretKeySelector: cmmeta.SecretKeySelector{Key: "api-token"}, Namespace: "team-a", selector: "dns=hetzner"})
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a-token", apiKey)
+
+	_, err = getApiKeyFromSecret(context.Background(), client, ref("", "hetzner", "missing"))
+	assert.EqualError(t, err, "secret hetzner has no key missing")
+
+	_, err = getApiKeyFromSecret(context.Background(), client, ref("", "hetzner", "blank"))
+	assert.EqualError(t, err, "empty API token in key blank of secret hetzner")
+
+	_, err = getApiKeyFromSecret(context.Background(), client, ref("", "missing", "api-token"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "secret webhook/missing not found")
+
+	_, err = getApiKeyFromSecret(context.Background(), client, ref("team-b", "hetzner", "api-token"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "secret team-b/hetzner not found")
+}
+
+func TestPresent_SecretFromClientset(t *testing.T) {
+	os.Setenv(podNamespaceEnv, "cert-manager")
+	defer os.Unsetenv(podNamespaceEnv)
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	useFakeClientset(solver, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cert-manager", Name: "hetzner"},
+		Data:       map[string][]byte{"api-token": []byte("token")},
+	})
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}}`)))
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+
+	err := solver.Present(newChallengeRequest("key", `{"apiKeySecretRef": {"name": "other", "key": "api-token"}}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "secret cert-manager/other not found")
+}
+
+func TestInitKubernetesClient(t *testing.T) {
+	calls := 0
+	defer countClientsets(&calls)()
+
+	// the config passed by cert-manager replaces the in-cluster config
+	solver := &hetznerDNSProviderSolver{}
+	assert.NoError(t, solver.initKubernetesClient(&rest.Config{Host: "https://kubernetes.default"}))
+	assert.NotNil(t, solver.kubeClient)
+	client, err := solver.kubernetesClient()
+	assert.NoError(t, err)
+	assert.Equal(t, solver.kubeClient, client)
+	assert.Equal(t, 0, calls)
+
+	// without one, the clientset is built on first use
+	solver = &hetznerDNSProviderSolver{}
+	assert.NoError(t, solver.initKubernetesClient(nil))
+	assert.Nil(t, solver.kubeClient)
+	_, err = solver.kubernetesClient()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+// flakySecrets is a fake secrets client whose Get fails with the given
+// errors, one per call, before returning the secret.
+type flakySecrets struct {
+	corev1client.SecretInterface
+	errs   []error
+	secret *corev1.Secret
+	gets   int
+}
+
+func (f *flakySecrets) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	f.gets++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return f.secret, nil
+}
+
+func TestGetSecretWithRetry(t *testing.T) {
+	defer func(d time.Duration) { getSecretRetryDelay = d }(getSecretRetryDelay)
+	getSecretRetryDelay = time.Millisecond
+	secret := &corev1.Secret{Data: map[string][]byte{"api-token": []byte("token")}}
+
+	// transient failures are retried
+	secrets := &flakySecrets{errs: []error{
+		apierrors.NewServiceUnavailable("etcd is unavailable"),
+		apierrors.NewTooManyRequests("slow down", 1),
+	}, secret: secret}
+	got, err := getSecretWithRetry(context.Background(), secrets, "cert-manager", "hetzner")
+	assert.NoError(t, err)
+	assert.Equal(t, secret, got)
+	assert.Equal(t, 3, secrets.gets)
+
+	// missing secrets are not
+	secrets = &flakySecrets{errs: []error{apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "hetzner")}, secret: secret}
+	_, err = getSecretWithRetry(context.Background(), secrets, "cert-manager", "hetzner")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "secret cert-manager/hetzner not found")
+	assert.Equal(t, 1, secrets.gets)
+
+	// neither are missing permissions
+	secrets = &flakySecrets{errs: []error{apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "hetzner", errors.New("denied"))}, secret: secret}
+	_, err = getSecretWithRetry(context.Background(), secrets, "cert-manager", "hetzner")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "the webhook is not allowed to read secret cert-manager/hetzner")
+	assert.Equal(t, 1, secrets.gets)
+
+	// retries are bounded
+	unavailable := apierrors.NewInternalError(errors.New("boom"))
+	secrets = &flakySecrets{errs: []error{unavailable, unavailable, unavailable, unavailable, unavailable}, secret: secret}
+	_, err = getSecretWithRetry(context.Background(), secrets, "cert-manager", "hetzner")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error getting secret cert-manager/hetzner: Internal error occurred: boom")
+	assert.Equal(t, getSecretRetries+1, secrets.gets)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// lastOperation describes the last successful Present in a zone.
+type lastOperation struct {
+	Zone       string `json:"zone"`
+	ZoneID     string `json:"zoneId"`
+	RecordName string `json:"recordName"`
+	// RecordID is empty in a dry run. Created is false if the record
+	// existed already.
+	RecordID string    `json:"recordId,omitempty"`
+	Created  bool      `json:"created"`
+	Time     time.Time `json:"time"`
+	// Duration is how long Present took, including waiting for
+	// propagation.
+	Duration string `json:"duration"`
+}
+
+// lastOperations holds the last successful Present of each zone, for the
+// diagnostic endpoints. Its zero value is empty.
+type lastOperations struct {
+	mu      sync.Mutex
+	entries map[string]lastOperation
+}
+
+// record stores op as the last operation in its zone.
+func (l *lastOperations) record(op lastOperation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.entries == nil {
+		l.entries = map[string]lastOperation{}
+	}
+	l.entries[normalizeName(op.Zone)] = op
+}
+
+// get returns the last operation in zone, if any.
+func (l *lastOperations) get(zone string) (lastOperation, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	op, ok := l.entries[normalizeName(zone)]
+	return op, ok
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresent_RecordsLastOperation(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	_, ok := solver.lastPresents.get("example.com")
+	assert.False(t, ok)
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	op, ok := solver.lastPresents.get("example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", op.Zone)
+	assert.Equal(t, "zone1", op.ZoneID)
+	assert.Equal(t, "_acme-challenge", op.RecordName)
+	assert.True(t, op.Created)
+	assert.Contains(t, m.records, op.RecordID)
+	assert.False(t, op.Time.IsZero())
+	assert.NotEmpty(t, op.Duration)
+	created := op
+
+	// presenting the record again finds the existing one
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	op, _ = solver.lastPresents.get("example.com")
+	assert.False(t, op.Created)
+	assert.Equal(t, created.RecordID, op.RecordID)
+	assert.False(t, op.Time.Before(created.Time))
+
+	// failures leave the last successful operation in place
+	assert.Error(t, solver.Present(newChallengeRequest("other", `{"apiKey": "wrong"}`)))
+	op, _ = solver.lastPresents.get("example.com")
+	assert.Equal(t, created.RecordID, op.RecordID)
+}
+
+func TestLastOperations_Concurrent(t *testing.T) {
+	var l lastOperations
+	var wg sync.WaitGroup
+	for _, zone := range []string{"example.com", "example.org", "example.com."} {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			l.record(lastOperation{Zone: zone, ZoneID: zone})
+			l.get(zone)
+		}(zone)
+	}
+	wg.Wait()
+	_, ok := l.get("example.org")
+	assert.True(t, ok)
+	assert.Len(t, l.entries, 2)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// livenessMaxInFlightEnv and livenessStuckSecondsEnv configure when the
+// liveness endpoint reports the webhook as stuck: if more than the given
+// number of API calls are in flight for longer than the given number of
+// seconds.
+const (
+	livenessMaxInFlightEnv  = "LIVENESS_MAX_IN_FLIGHT"
+	livenessStuckSecondsEnv = "LIVENESS_STUCK_SECONDS"
+)
+
+// defaultLivenessMaxInFlight and defaultLivenessStuckAfter are used when the
+// environment variables above are not set.
+const (
+	defaultLivenessMaxInFlight = 10
+	defaultLivenessStuckAfter  = 5 * time.Minute
+)
+
+// liveness tracks the API calls in flight and reports the webhook as stuck
+// on the liveness endpoint when too many of them are for too long, so that
+// Kubernetes restarts it, and also while the HTTPS server is unhealthy if
+// serving is set. Its zero value never reports the webhook as stuck.
+type liveness struct {
+	serving *servingCheck
+
+	maxInFlight int
+	stuckAfter  time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	// exceededSince is when inFlight last rose above maxInFlight, zero
+	// while it is at or below.
+	exceededSince time.Time
+}
+
+// configure sets the thresholds from the environment.
+func (l *liveness) configure() error {
+	maxInFlight := defaultLivenessMaxInFlight
+	if env := os.Getenv(livenessMaxInFlightEnv); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s: %q is not a non-negative number", livenessMaxInFlightEnv, env)
+		}
+		maxInFlight = n
+	}
+	stuckAfter := defaultLivenessStuckAfter
+	if env := os.Getenv(livenessStuckSecondsEnv); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s: %q is not a positive number", livenessStuckSecondsEnv, env)
+		}
+		stuckAfter = time.Duration(n) * time.Second
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxInFlight = maxInFlight
+	l.stuckAfter = stuckAfter
+	return nil
+}
+
+func (l *liveness) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight++
+	if l.inFlight > l.maxInFlight && l.exceededSince.IsZero() {
+		l.exceededSince = time.Now()
+	}
+}
+
+func (l *liveness) done() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.inFlight <= l.maxInFlight {
+		l.exceededSince = time.Time{}
+	}
+}
+
+// check returns an error if the webhook is stuck.
+func (l *liveness) check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stuckAfter == 0 || l.exceededSince.IsZero() {
+		return nil
+	}
+	if d := time.Since(l.exceededSince); d > l.stuckAfter {
+		return fmt.Errorf("%d API calls in flight, more than %d for %v", l.inFlight, l.maxInFlight, d.Round(time.Second))
+	}
+	return nil
+}
+
+func (l *liveness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := l.check()
+	if err == nil {
+		err = l.serving.check()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// withInFlight tracks requests in l while they are in flight. It goes after
+// withConcurrencyLimit, so that requests waiting for a slot, the rate limiter
+// or their next retry don't count as stuck.
+func withInFlight(l *liveness) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			l.start()
+			defer l.done()
+			return next.RoundTrip(req)
+		})
+	}
+}
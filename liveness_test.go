@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveness(t *testing.T) {
+	l := &liveness{maxInFlight: 1, stuckAfter: 10 * time.Millisecond}
+
+	l.start()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, l.check(), "calls up to the threshold are fine")
+
+	l.start()
+	assert.NoError(t, l.check(), "exceeding the threshold briefly is fine")
+	time.Sleep(20 * time.Millisecond)
+	assert.Error(t, l.check())
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "2 API calls in flight, more than 1")
+
+	l.done()
+	assert.NoError(t, l.check())
+	rec = httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestLiveness_ZeroValue(t *testing.T) {
+	l := &liveness{}
+	l.start()
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, l.check())
+}
+
+func TestLiveness_Configure(t *testing.T) {
+	l := &liveness{}
+	assert.NoError(t, l.configure())
+	assert.Equal(t, defaultLivenessMaxInFlight, l.maxInFlight)
+	assert.Equal(t, defaultLivenessStuckAfter, l.stuckAfter)
+
+	os.Setenv(livenessMaxInFlightEnv, "3")
+	defer os.Unsetenv(livenessMaxInFlightEnv)
+	os.Setenv(livenessStuckSecondsEnv, "60")
+	defer os.Unsetenv(livenessStuckSecondsEnv)
+	assert.NoError(t, l.configure())
+	assert.Equal(t, 3, l.maxInFlight)
+	assert.Equal(t, time.Minute, l.stuckAfter)
+
+	os.Setenv(livenessStuckSecondsEnv, "0")
+	assert.EqualError(t, l.configure(), `invalid LIVENESS_STUCK_SECONDS: "0" is not a positive number`)
+	os.Setenv(livenessMaxInFlightEnv, "many")
+	assert.EqualError(t, l.configure(), `invalid LIVENESS_MAX_IN_FLIGHT: "many" is not a non-negative number`)
+}
+
+func TestWithInFlight(t *testing.T) {
+	l := &liveness{}
+	var inFlight int
+	rt := chain(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		inFlight = l.inFlight
+		return okTransport(`{}`).RoundTrip(req)
+	}), withInFlight(l))
+
+	_, err := rt.RoundTrip(httptest.NewRequest("GET", "http://hetzner.invalid/zones", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+	assert.Equal(t, 0, l.inFlight)
+	assert.True(t, l.exceededSince.IsZero())
+}
+
+func TestLiveness_Serving(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	os.Setenv(servingHealthURLEnv, srv.URL+"/healthz")
+	defer os.Unsetenv(servingHealthURLEnv)
+	serving, err := newServingCheck()
+	assert.NoError(t, err)
+	l := &liveness{serving: serving}
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	srv.Close()
+	rec = httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "HTTPS server health check failed")
+}
+
+func TestHetznerClient_InFlightExcludesWaiting(t *testing.T) {
+	l := &liveness{}
+	sem := newSemaphore(1)
+	sem <- struct{}{}
+	client := newTestClient("http://hetzner.invalid")
+	client.transport = okTransport(`{"zones": []}`)
+	client.liveness = l
+	client.concurrency = sem
+
+	done := make(chan error)
+	go func() {
+		resp, err := client.do(context.Background(), "GET", "/zones", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.mu.Lock()
+	assert.Equal(t, 0, l.inFlight, "a request waiting for a slot isn't in flight")
+	l.mu.Unlock()
+	<-sem
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// keyedMutex provides a mutex per key. Mutexes are dropped once no one
+// holds or waits for them. Its zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex of key and returns the function unlocking it.
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*refCountedMutex{}
+	}
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refCountedMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if m.refs--; m.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
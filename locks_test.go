@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var k keyedMutex
+	var wg sync.WaitGroup
+	held := map[string]int{}
+	var mu sync.Mutex
+
+	for i := 0; i < 50; i++ {
+		key := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := k.lock(key)
+			defer unlock()
+
+			mu.Lock()
+			held[key]++
+			assert.Equal(t, 1, held[key], "the lock of a key must be held once at most")
+			mu.Unlock()
+
+			mu.Lock()
+			held[key]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, k.locks, "unused locks must be dropped")
+}
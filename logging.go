@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// logFormatEnv selects the format of the log, logFormatText, the default,
+// or logFormatJSON. logLevelEnv sets the klog verbosity, like -v.
+const (
+	logFormatEnv  = "LOG_FORMAT"
+	logLevelEnv   = "LOG_LEVEL"
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// configureLogging sets up klog as configured by logFormatEnv and
+// logLevelEnv, writing JSON logs to out. Invalid values are logged and
+// leave the defaults in place.
+func configureLogging(out io.Writer) {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+
+	if level := strings.TrimSpace(os.Getenv(logLevelEnv)); level != "" {
+		if v, err := strconv.Atoi(level); err != nil || v < 0 {
+			klog.Errorf("invalid %s %q, it must be a verbosity like 0 or 4", logLevelEnv, level)
+		} else {
+			fs.Set("v", level)
+		}
+	}
+
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv(logFormatEnv))); format {
+	case "", logFormatText:
+	case logFormatJSON:
+		// klog writes each entry to the outputs of its severity and all
+		// lower ones, so only the info output gets all of them once
+		fs.Set("logtostderr", "false")
+		fs.Set("alsologtostderr", "false")
+		fs.Set("stderrthreshold", "FATAL")
+		klog.SetOutputBySeverity("INFO", &jsonLogWriter{w: out})
+		for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+			klog.SetOutputBySeverity(severity, ioutil.Discard)
+		}
+	default:
+		klog.Errorf("invalid %s %q, it must be %s or %s, using %s", logFormatEnv, format, logFormatText, logFormatJSON, logFormatText)
+	}
+}
+
+// klogHeader matches the header klog prefixes log entries with, e.g.
+// "I0102 15:04:05.000000    1 main.go:42] ".
+var klogHeader = regexp.MustCompile(`^([IWEF])(\d{4} \d{2}:\d{2}:\d{2}\.\d{6})\s+\d+ ([^\]]+)\] `)
+
+// klogSeverities maps the severity letters of klog headers to levels.
+var klogSeverities = map[string]string{"I": "info", "W": "warning", "E": "error", "F": "fatal"}
+
+// jsonLogWriter turns the log entries klog writes into JSON lines with the
+// time, level, caller and message of each entry. klog writes an entry at a
+// time, so each write is one entry.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// jsonLogEntry is a log entry written by jsonLogWriter.
+type jsonLogEntry struct {
+	Time   string `json:"ts"`
+	Level  string `json:"level"`
+	Caller string `json:"caller,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	entry := jsonLogEntry{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: "info", Msg: line}
+	if m := klogHeader.FindStringSubmatch(line); m != nil {
+		entry.Level = klogSeverities[m[1]]
+		entry.Caller = m[3]
+		entry.Msg = line[len(m[0]):]
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding log entry: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
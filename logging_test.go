@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &jsonLogWriter{w: buf}
+
+	line := []byte("W0102 15:04:05.000000    1 main.go:42] something \"odd\" happened\n")
+	n, err := w.Write(line)
+	assert.NoError(t, err)
+	assert.Equal(t, len(line), n)
+	var entry jsonLogEntry
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry.Level)
+	assert.Equal(t, "main.go:42", entry.Caller)
+	assert.Equal(t, `something "odd" happened`, entry.Msg)
+	assert.NotEmpty(t, entry.Time)
+
+	// lines without a klog header are logged as they are
+	buf.Reset()
+	_, err = w.Write([]byte("no header\n"))
+	assert.NoError(t, err)
+	entry = jsonLogEntry{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "info", entry.Level)
+	assert.Equal(t, "no header", entry.Msg)
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer os.Unsetenv(logFormatEnv)
+	defer os.Unsetenv(logLevelEnv)
+	defer func() {
+		fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+		klog.InitFlags(fs)
+		fs.Set("logtostderr", "true")
+		fs.Set("stderrthreshold", "ERROR")
+		fs.Set("v", "0")
+		klog.SetOutput(os.Stderr)
+	}()
+	os.Setenv(logFormatEnv, "json")
+	os.Setenv(logLevelEnv, "4")
+
+	buf := &bytes.Buffer{}
+	configureLogging(buf)
+
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	_, err := NewHetznerClient(srv.URL, "token").ListZones(context.Background())
+	assert.NoError(t, err)
+	klog.Warning("warned")
+	klog.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.True(t, len(lines) > 1, "the API request must be logged at verbosity 4")
+	levels := map[string]int{}
+	for _, line := range lines {
+		var entry jsonLogEntry
+		if assert.NoError(t, json.Unmarshal([]byte(line), &entry), line) {
+			levels[entry.Level]++
+		}
+		assert.NotContains(t, line, "token", "the API token must not be logged")
+	}
+	assert.Equal(t, 1, levels["warning"], "each entry must be logged once")
+}
@@ -2,17 +2,31 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
-	//"k8s.io/client-go/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
 
+	"github.com/jetstack/cert-manager/pkg/acme/webhook"
 	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/jetstack/cert-manager/pkg/acme/webhook/cmd"
 )
@@ -20,8 +34,29 @@ import (
 var GroupName = os.Getenv("GROUP_NAME")
 
 func main() {
-	if GroupName == "" {
-		panic("GROUP_NAME must be specified")
+	configureLogging(os.Stderr)
+	rand.Seed(time.Now().UnixNano())
+
+	if len(os.Args) > 1 && os.Args[1] == checkCommand {
+		os.Exit(runCheck(os.Args[2:], os.Stdout))
+	}
+
+	groupName, err := normalizeGroupName(GroupName)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	solverName, err := normalizeSolverName(os.Getenv(solverNameEnv))
+	if err != nil {
+		panic(err.Error())
+	}
+
+	solvers := []webhook.Solver{
+		&hetznerDNSProviderSolver{name: solverName},
+	}
+	for _, solver := range solvers {
+		klog.Infof("serving solver %s in group %s, issuers must set groupName: %s and solverName: %s",
+			solver.Name(), groupName, groupName, solver.Name())
 	}
 
 	// This will register our custom DNS provider with the webhook serving
@@ -29,9 +64,68 @@ func main() {
 	// You can register multiple DNS provider implementations with a single
 	// webhook, where the Name() method will be used to disambiguate between
 	// the different implementations.
-	cmd.RunWebhookServer(GroupName,
-		&hetznerDNSProviderSolver{},
-	)
+	cmd.RunWebhookServer(groupName, solvers...)
+
+	// the server stopped on SIGTERM, wait for the challenges in flight
+	grace, err := shutdownGrace()
+	if err != nil {
+		klog.Errorf("%v, using %v", err, defaultShutdownGrace)
+		grace = defaultShutdownGrace
+	}
+	for _, solver := range solvers {
+		if s, ok := solver.(*hetznerDNSProviderSolver); ok && !s.operations.shutdown(grace) {
+			klog.Warningf("solver %s shut down with challenges in flight, their records may have to be cleaned up by cert-manager's retries", s.Name())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	defer cancel()
+	if err := flushTracing(ctx); err != nil {
+		klog.Errorf("failed to export the remaining spans: %v", err)
+	}
+}
+
+// groupNamePattern matches valid API group names: lowercase DNS names of at
+// least two labels, as in acme.example.com.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)+$`)
+
+// normalizeGroupName returns the group name set in GROUP_NAME without
+// surrounding whitespace, lowercased and without a trailing dot, or an error
+// if it isn't a valid API group name.
+func normalizeGroupName(name string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("GROUP_NAME must be specified, e.g. acme.example.com")
+	}
+	normalized := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if len(normalized) > 253 || !groupNamePattern.MatchString(normalized) {
+		return "", fmt.Errorf("GROUP_NAME %q is not a valid API group name, it must be a DNS name like acme.example.com", name)
+	}
+	return normalized, nil
+}
+
+// solverNameEnv sets the name the solver is served under, defaultSolverName
+// if unset, so that the webhook can be deployed several times in different
+// groups, e.g. for different accounts.
+const solverNameEnv = "SOLVER_NAME"
+
+const defaultSolverName = "hetzner"
+
+// solverNamePattern matches valid solver names, which are resource names in
+// the webhook's API group: lowercase DNS labels, as in hetzner.
+var solverNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// normalizeSolverName returns the solver name set in SOLVER_NAME without
+// surrounding whitespace, defaultSolverName if it is empty, or an error if
+// it isn't a valid solver name.
+func normalizeSolverName(name string) (string, error) {
+	normalized := strings.TrimSpace(name)
+	if normalized == "" {
+		return defaultSolverName, nil
+	}
+	if len(normalized) > 63 || !solverNamePattern.MatchString(normalized) {
+		return "", fmt.Errorf("SOLVER_NAME %q is not a valid solver name, it must be a lowercase DNS label like hetzner", name)
+	}
+	return normalized, nil
 }
 
 // hetznerDNSProviderSolver implements the provider-specific logic needed to
@@ -39,13 +133,112 @@ func main() {
 // To do so, it must implement the `github.com/jetstack/cert-manager/pkg/acme/webhook.Solver`
 // interface.
 type hetznerDNSProviderSolver struct {
-	// If a Kubernetes 'clientset' is needed, you must:
-	// 1. uncomment the additional `client` field in this structure below
-	// 2. uncomment the "k8s.io/client-go/kubernetes" import at the top of the file
-	// 3. uncomment the relevant code in the Initialize method below
-	// 4. ensure your webhook's service account has the required RBAC role
-	//    assigned to it for interacting with the Kubernetes APIs you need.
-	//client kubernetes.Clientset
+	// kubeClient reads secrets and records events. Initialize builds it
+	// from the config cert-manager passes, unless it is already set, e.g.
+	// to a fake in tests, and kubernetesClient from the in-cluster config
+	// if neither did. It is passed to GetSecret, ListSecrets and
+	// RecordEvent.
+	kubeClient   kubernetes.Interface
+	kubeClientMu sync.Mutex
+
+	// name is the name the solver is registered under, defaulting to
+	// "hetzner". Several solvers can be registered with different names
+	// and defaults.
+	name string
+
+	// defaults are the solver's defaults for options the config of a
+	// challenge doesn't set.
+	defaults solverDefaults
+
+	// apiURL is the Hetzner DNS API base URL used when the challenge config
+	// doesn't set one, e.g. for tests.
+	apiURL string
+
+	// writableZones caches the IDs of zones that passed the pre-flight
+	// writability check.
+	writableZones   map[string]bool
+	writableZonesMu sync.Mutex
+
+	// configuredZones caches the zones of configured zone IDs, by API URL,
+	// token and ID, once they have been looked up, see checkConfiguredZone.
+	configuredZones   map[string]Zone
+	configuredZonesMu sync.Mutex
+
+	// rateLimiters holds the rate limiter of each API token, so that the
+	// limit applies across all challenges using it.
+	rateLimiters   map[string]*rateLimiter
+	rateLimitersMu sync.Mutex
+
+	// circuitBreakers holds the circuit breaker of each API URL and its
+	// settings, so that an outage stops the requests of all challenges.
+	circuitBreakers   map[circuitBreakerKey]*circuitBreaker
+	circuitBreakersMu sync.Mutex
+
+	// semaphores holds the semaphore of each maxConcurrentRequests, so that
+	// the limit applies across all challenges configured with it.
+	semaphores   map[int]semaphore
+	semaphoresMu sync.Mutex
+
+	// recentPresents holds the time of the last successful Present of each
+	// zone, name and value, to debounce retries by cert-manager.
+	recentPresents   map[string]time.Time
+	recentPresentsMu sync.Mutex
+
+	// caBundle holds the PEM encoded CAs from HETZNER_CA_BUNDLE_PATH, used
+	// to verify the API's certificate when the config sets no CA bundle.
+	caBundle string
+
+	// transports holds the transport of each proxy URL and CA bundle, so
+	// that connections to the API are reused across challenges.
+	transports   map[transportKey]*http.Transport
+	transportsMu sync.Mutex
+
+	// recordLocks serializes Present and CleanUp calls for the same record
+	// name.
+	recordLocks keyedMutex
+
+	// zoneCache caches zone IDs when enabled by ZoneCacheSeconds.
+	zoneCache zoneCache
+
+	// recordIDs holds the IDs of presented records, so that CleanUp can
+	// delete them directly.
+	recordIDs recordIDs
+
+	// cleanUpFailures counts failed CleanUp attempts when CleanUpMaxAttempts
+	// is set.
+	cleanUpFailures cleanUpFailures
+
+	// seenRecords holds the records listed or created by the clients of
+	// the solver, for the audit log.
+	seenRecords seenRecords
+
+	// lastPresents holds the last successful Present of each zone.
+	lastPresents lastOperations
+
+	// ready reports whether the API token from the environment was
+	// validated on startup and the HTTPS server is healthy.
+	ready readiness
+
+	// live reports whether API calls are stuck or the HTTPS server is
+	// unhealthy.
+	live liveness
+
+	// operations tracks the Present and CleanUp calls in flight, for a
+	// graceful shutdown.
+	operations operations
+}
+
+// solverDefaults holds defaults set when constructing a solver, so that
+// solvers registered under different names can behave differently. Options
+// set in the config of a challenge override them; zero values leave the
+// built-in defaults in place.
+type solverDefaults struct {
+	TTL        int
+	ZoneLookup string
+	MaxRetries int
+	// Config is a solver config in JSON the config of each challenge is
+	// merged over, read from the file in configFileEnv by Initialize.
+	Config []byte
 }
 
 // hetznerDNSProviderConfig is a structure that is used to decode into when
@@ -68,9 +261,455 @@ type hetznerDNSProviderConfig struct {
 	// These fields will be set by users in the
 	// `issuer.spec.acme.dns01.providers.webhook.config` field.
 
+	// APIKeySecretRef references the key of a secret holding the API token,
+	// in the webhook's namespace unless its namespace is set. It takes
+	// precedence over all other sources of the API token.
+	APIKeySecretRef secretKeySelector `json:"apiKeySecretRef"`
+
+	// APIKeySecretSelector selects the secret holding the API token by its
+	// labels instead of apiKeySecretRef.name, e.g. for a secret per team.
+	// Exactly one secret in the namespace of APIKeySecretRef has to match,
+	// its key is the one of APIKeySecretRef.
+	APIKeySecretSelector *metav1.LabelSelector `json:"apiKeySecretSelector"`
+
+	// ZoneAPIKeySecretRefs maps zone names to the secret key holding the API
+	// token of the account owning the zone, for setups managing zones in
+	// several accounts. An entry applies to the zone and all its subzones,
+	// the most specific entry wins. Zones without an entry use
+	// APIKeySecretRef or the other sources of the API token.
+	ZoneAPIKeySecretRefs map[string]secretKeySelector `json:"zoneApiKeySecretRefs"`
+
+	// FallbackAPIKeySecretRefs reference secret keys holding further API
+	// tokens for the same zones, tried in turn when the API rejects the
+	// token in use, e.g. while rotating tokens with an overlap.
+	FallbackAPIKeySecretRefs []secretKeySelector `json:"fallbackApiKeySecretRefs"`
+
+	// SecretNamespaceSource is the namespace of secret references without
+	// a namespace: "webhook", the default, for the webhook's namespace,
+	// "challenge" for the namespace of the issuer or certificate of the
+	// challenge, so that each namespace can own its token, or the name of
+	// a namespace.
+	SecretNamespaceSource string `json:"secretNamespaceSource"`
+
+	// APIKey is the API token. Deprecated, use APIKeySecretRef instead.
 	APIKey string `json:"apiKey"`
+
+	// APIKeyFile is the path of a file containing the API token, e.g. a
+	// mounted secret. It is used when neither APIKeySecretRef nor APIKey is
+	// set, and takes precedence over the HETZNER_API_TOKEN and
+	// HETZNER_API_TOKEN_FILE environment variables. The file is read again
+	// for every Present and CleanUp, so that rotated tokens are picked up.
+	APIKeyFile string `json:"apiKeyFile"`
+
+	// EnforceSingleRecord makes Present remove existing TXT records with
+	// the same name but a different value, and duplicates of the one with
+	// the challenge's value, so that only a single challenge record exists
+	// per name. Records with a different value are only removed if they
+	// carry the OwnerMarker. By default records are appended, which allows
+	// concurrent validations for the same name.
+	EnforceSingleRecord bool `json:"enforceSingleRecord"`
+
+	// ZoneCountWarningThreshold is the number of zones above which a warning
+	// is logged when a zone has to be resolved by listing all zones of the
+	// account. Defaults to 500, a negative value disables the warning.
+	ZoneCountWarningThreshold int `json:"zoneCountWarningThreshold"`
+
+	// ValidateAPIKeyFormat enables checking the API token against
+	// APIKeyPattern before it is used.
+	ValidateAPIKeyFormat bool `json:"validateApiKeyFormat"`
+
+	// APIKeyPattern is the regular expression API tokens must match when
+	// ValidateAPIKeyFormat is set. Defaults to defaultAPIKeyPattern.
+	APIKeyPattern string `json:"apiKeyPattern"`
+
+	// TTL is the TTL in seconds of the created TXT record. Defaults to 300
+	// when omitted. A TTL below MinTTL is raised to it, unless StrictTTL is
+	// set.
+	TTL int `json:"ttl"`
+
+	// MinTTL is the lowest TTL records are created with. Defaults to minTTL,
+	// the lowest one the API accepts.
+	MinTTL int `json:"minTtl"`
+
+	// StrictTTL makes a TTL below MinTTL fail instead of being raised.
+	StrictTTL bool `json:"strictTtl"`
+
+	// RejectLongTXTValues makes TXT values longer than 255 characters fail
+	// instead of being split into several strings.
+	RejectLongTXTValues bool `json:"rejectLongTxtValues"`
+
+	// TTLStrategy selects the TTL of created records, ttlStrategyFixed, the
+	// default, or ttlStrategyMinimum. After loading the config, TTL holds
+	// the TTL it selects.
+	TTLStrategy string `json:"ttlStrategy"`
+
+	// PreflightZoneCheck makes Present verify that a zone is writable by
+	// creating and removing a scratch record before the first challenge
+	// record is created in it.
+	PreflightZoneCheck bool `json:"preflightZoneCheck"`
+
+	// CorrelationHeader is the name of a header, e.g. X-Correlation-Id, in
+	// which the UID of the challenge request is sent along with every API
+	// call.
+	CorrelationHeader string `json:"correlationHeader"`
+
+	// ExtraHeaders are sent with every API request, e.g. for an internal
+	// API gateway. They can't replace the Auth-API-Token and Content-Type
+	// headers.
+	ExtraHeaders map[string]string `json:"extraHeaders"`
+
+	// RetryNonIdempotent makes failed requests creating records be retried
+	// like all other requests. By default they are only retried if they
+	// clearly didn't reach the API, as retrying a request that succeeded
+	// may create duplicate records.
+	RetryNonIdempotent bool `json:"retryNonIdempotent"`
+
+	// ZoneCacheSeconds is the number of seconds zone IDs are cached for,
+	// saving the zone lookup when many challenges for the same zone are
+	// solved at once. 0, the default, disables caching. ZoneCacheSize is
+	// the maximum number of cached zone IDs, defaulting to 1000.
+	ZoneCacheSeconds int `json:"zoneCacheSeconds"`
+	ZoneCacheSize    int `json:"zoneCacheSize"`
+
+	// PrewarmZones are zones whose IDs are looked up and cached on startup,
+	// see prewarmZoneCache. It only has an effect in the config file in
+	// configFileEnv, and requires ZoneCacheSeconds.
+	PrewarmZones []string `json:"prewarmZones"`
+
+	// ReconcileOnStartup makes the webhook delete the challenge records it
+	// created that were last modified at least ReconcileMinAgeSeconds ago,
+	// defaulting to a day, on startup, see sweepOrphanedRecords. The sweep
+	// covers ReconcileZones, or all zones of the API token if unset. It
+	// only has an effect in the config file in configFileEnv, and requires
+	// the OwnerMarker.
+	ReconcileOnStartup     bool     `json:"reconcileOnStartup"`
+	ReconcileMinAgeSeconds int      `json:"reconcileMinAgeSeconds"`
+	ReconcileZones         []string `json:"reconcileZones"`
+
+	// RecordName replaces the name of the challenge record, relative to the
+	// zone, e.g. for setups delegating _acme-challenge to a dedicated zone.
+	// RecordNamePrefix is prepended to the name instead. By default the name
+	// is derived from the resolved FQDN of the challenge.
+	RecordName       string `json:"recordName"`
+	RecordNamePrefix string `json:"recordNamePrefix"`
+
+	// RecordNameTemplate computes the name of the challenge record,
+	// relative to the zone, with a text/template evaluated with the fields
+	// of recordNameData, e.g. "_acme-challenge-{{.Namespace}}.{{.Entry}}".
+	RecordNameTemplate string `json:"recordNameTemplate"`
+
+	// RecordNameSuffix maps zone names to a string appended to the name of
+	// the challenge record in that zone, including any separator, e.g. for
+	// acme validation delegated to a subzone like "acme" whose records are
+	// named _acme-challenge.acme. Zones without an entry get no suffix, and
+	// no two entries may name the same zone.
+	RecordNameSuffix map[string]string `json:"recordNameSuffix"`
+
+	// VerboseErrors appends a snapshot of the resolved zone and the number of
+	// existing challenge records to errors. This costs additional API calls
+	// when an operation fails.
+	VerboseErrors bool `json:"verboseErrors"`
+
+	// APIURL overrides the base URL of the Hetzner DNS API, e.g. to go
+	// through an internal API proxy. Defaults to the HETZNER_API_URL
+	// environment variable or hetznerAPIURL.
+	APIURL string `json:"apiUrl"`
+
+	// ProxyURL is the URL of an HTTP(S) proxy requests to the API are sent
+	// through. Defaults to the proxy configured by the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `json:"proxyUrl"`
+
+	// LocalAddress is the IP address connections to the API, or to the
+	// proxy, are made from, e.g. the one egress is allowed for on nodes
+	// with several addresses.
+	LocalAddress string `json:"localAddress"`
+
+	// DNSResolver is the DNS server, as host or host:port, the host name of
+	// the API, or of the proxy, is resolved with instead of the system
+	// resolver, e.g. where the cluster DNS can't resolve dns.hetzner.com.
+	// After loading the config, it has a port.
+	DNSResolver string `json:"dnsResolver"`
+
+	// DisableHTTP2 makes connections to the API, or to the proxy, use
+	// HTTP/1.1, for proxies stalling HTTP/2 requests. It is also set by the
+	// DISABLE_HTTP2 environment variable.
+	DisableHTTP2 bool `json:"disableHttp2"`
+
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// open for later requests, in total and per host, for up to
+	// IdleConnTimeoutSeconds each. Zero values use the defaults.
+	MaxIdleConns           int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost    int `json:"maxIdleConnsPerHost"`
+	IdleConnTimeoutSeconds int `json:"idleConnTimeoutSeconds"`
+
+	// CABundle holds PEM encoded CA certificates used instead of the system
+	// CAs to verify the API's certificate, e.g. of a TLS intercepting
+	// egress proxy. CABundlePath is the path of a file containing them.
+	// Defaults to the file at HETZNER_CA_BUNDLE_PATH.
+	CABundle     string `json:"caBundle"`
+	CABundlePath string `json:"caBundlePath"`
+
+	// RateLimit is the maximum number of API requests per second sent with
+	// the same API token. 0, the default, disables rate limiting.
+	RateLimit float64 `json:"rateLimit"`
+
+	// MaxConcurrentRequests is the maximum number of API requests in
+	// flight at once across all challenges with the same limit, to stay
+	// within the API's rate limits during large renewal bursts. Further
+	// requests wait for one to finish. Defaults to 5, a negative value
+	// disables the limit.
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+
+	// CircuitBreakerThreshold is the number of consecutive failed API
+	// requests, counting each request once however often it was retried,
+	// after which requests to the API URL fail fast for
+	// CircuitBreakerCooldownSeconds, before a single request probes
+	// whether the API recovered. Defaults to 5, a negative value disables
+	// the circuit breaker.
+	CircuitBreakerThreshold       int `json:"circuitBreakerThreshold"`
+	CircuitBreakerCooldownSeconds int `json:"circuitBreakerCooldownSeconds"`
+
+	// PresentDebounceSeconds makes Present return immediately, without any
+	// API call, if the same record was presented successfully within the
+	// given number of seconds. 0, the default, disables debouncing.
+	PresentDebounceSeconds int `json:"presentDebounceSeconds"`
+
+	// FollowCNAME makes the challenge record be created at the target of a
+	// CNAME on the challenge FQDN, in the zone of the account containing
+	// it, e.g. when _acme-challenge is delegated to a dedicated zone.
+	// RecordName and RecordNamePrefix don't apply to the CNAME target.
+	FollowCNAME bool `json:"followCNAME"`
+
+	// MaxZoneWalkDepth is the number of leftmost labels stripped from a
+	// CNAME target at most when looking for the zone containing it, so
+	// that a too broad zone isn't used by accident. Defaults to
+	// defaultMaxZoneWalkDepth, a negative value removes the limit.
+	MaxZoneWalkDepth int `json:"maxZoneWalkDepth"`
+
+	// ZoneID is the ID of the zone the record is created in. When set, the
+	// zone is not looked up by its name, which avoids ambiguous matches.
+	ZoneID string `json:"zoneId"`
+
+	// ZoneLookup is the query parameter zones are looked up by, either
+	// zoneLookupSearchName, the default, or zoneLookupName.
+	ZoneLookup string `json:"zoneLookup"`
+
+	// StrictZoneNameCase makes zones of the account only match the zone of
+	// a challenge if their names have the same case. cert-manager resolves
+	// zones in lowercase, so that zones stored as e.g. Example.com are then
+	// not found. By default, the case of zone names is ignored.
+	StrictZoneNameCase bool `json:"strictZoneNameCase"`
+
+	// MaxRetries is the number of times a failed API request is retried.
+	// Defaults to 3, a negative value disables retries. It is capped at
+	// maxMaxRetries.
+	MaxRetries int `json:"maxRetries"`
+
+	// RetryBaseDelayMilliseconds is the delay before the first retry of a
+	// failed API request, doubled for each further one. Defaults to one
+	// second and is capped at maxRetryBaseDelayMilliseconds.
+	RetryBaseDelayMilliseconds int `json:"retryBaseDelayMilliseconds"`
+
+	// RetryMaxDelayMilliseconds caps the delay before each retry, so that
+	// the backoff doesn't grow to minutes. Defaults to 30 seconds.
+	RetryMaxDelayMilliseconds int `json:"retryMaxDelayMilliseconds"`
+
+	// RetryMaxElapsedSeconds caps the time from the first attempt of an API
+	// request to the start of its last retry. Defaults to two minutes.
+	RetryMaxElapsedSeconds int `json:"retryMaxElapsedSeconds"`
+
+	// PurgeStale makes CleanUp delete all TXT records with the name of the
+	// challenge record, not only the one with the challenge's value, to
+	// remove records left behind by earlier challenges. Only records
+	// carrying the OwnerMarker are deleted. It breaks other challenges for
+	// the same name that are still pending.
+	PurgeStale bool `json:"purgeStale"`
+
+	// CleanUpWorkers is the number of records CleanUp deletes at a time,
+	// e.g. when purging many stale records with PurgeStale. Requests are
+	// still limited by MaxConcurrentRequests. Defaults to 3, a negative
+	// value deletes them one by one.
+	CleanUpWorkers int `json:"cleanUpWorkers"`
+
+	// VerifyBeforeDelete makes CleanUp fetch each record again right before
+	// deleting it, and keep it if its value changed since it was listed,
+	// e.g. because a newer Present reused it. It costs a request per record.
+	VerifyBeforeDelete bool `json:"verifyBeforeDelete"`
+
+	// CleanUpDelaySeconds delays CleanUp before it looks up and deletes the
+	// records, e.g. to let a concurrent Present for the same name finish.
+	// Capped at maxCleanUpDelaySeconds.
+	CleanUpDelaySeconds int `json:"cleanUpDelaySeconds"`
+
+	// OwnerMarker marks the records created by the webhook, so that
+	// PurgeStale and EnforceSingleRecord only delete those and leave
+	// manually created records alone. As the API has no comment field, a
+	// TXT record holding the marker and a hash of the record's value is
+	// created next to each record. Defaults to
+	// "cert-manager-webhook-hetzner", "none" disables marking and makes
+	// all records count as created by the webhook. After loading the
+	// config, it is empty if marking is disabled.
+	OwnerMarker string `json:"ownerMarker"`
+
+	// DryRun makes Present and CleanUp only look up the zone and records and
+	// log the records they would create or delete, e.g. to validate the
+	// config of a new issuer against production DNS.
+	DryRun bool `json:"dryRun"`
+
+	// RetryJitter is the maximum fraction by which each retry delay is
+	// randomly extended, so that challenges failing at the same time don't
+	// retry in lockstep. Defaults to 0.5, a negative value disables it.
+	RetryJitter float64 `json:"retryJitter"`
+
+	// StartJitterSeconds makes Present and CleanUp wait a random time of up
+	// to the given number of seconds before their first API call, to spread
+	// out renewals of many certificates at once. 0, the default, disables
+	// the delay.
+	StartJitterSeconds int `json:"startJitterSeconds"`
+
+	// CleanUpMaxAttempts makes CleanUp give up on a record and report
+	// success after the given number of failed attempts, so that the
+	// finalizer of the challenge is released when the API keeps failing.
+	// The record is left behind and has to be removed manually. 0, the
+	// default, retries forever.
+	CleanUpMaxAttempts int `json:"cleanUpMaxAttempts"`
+
+	// CleanUpGiveUpSeconds is the minimum number of seconds between the
+	// first failed CleanUp attempt of a record and giving up on it with
+	// CleanUpMaxAttempts, so that a burst of quick retries doesn't
+	// exhaust the attempts.
+	CleanUpGiveUpSeconds int `json:"cleanUpGiveUpSeconds"`
+
+	// TimeoutSeconds is the deadline of each API call reading zones or
+	// records, including retries, e.g. for clusters with slow egress.
+	// Defaults to 30 seconds and is capped at maxTimeoutSeconds.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+
+	// WriteTimeoutSeconds is the deadline of each API call creating or
+	// deleting records, like TimeoutSeconds. A call timing out may still
+	// take effect, so it defaults to the longer of 60 seconds and
+	// TimeoutSeconds. Present and CleanUp look the records up again when
+	// retried, so a record created despite a timeout is not duplicated.
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds"`
+
+	// OperationTimeoutSeconds is the deadline of a whole Present or CleanUp,
+	// including all of its API calls, retries and pages, so that retries
+	// can't hold a challenge for minutes. Unlimited by default.
+	OperationTimeoutSeconds int `json:"operationTimeoutSeconds"`
+
+	// MaxResponseBytes limits the size of API responses, so that a
+	// misbehaving API, e.g. behind a custom apiUrl, can't exhaust the
+	// webhook's memory. Defaults to 4 MiB, a negative value disables it.
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+
+	// PerPage is the page size of zone and record listings, to trade the
+	// number of requests for their size. Defaults to and is capped at the
+	// API's maximum of 100.
+	PerPage int `json:"perPage"`
+
+	// PropagationSeconds makes Present wait for up to the given number of
+	// seconds until a created record is listed by the API before returning.
+	// Failed lookups are retried within that time if they are transient,
+	// while other API errors fail Present. Present doesn't fail when the
+	// record isn't listed in time, as cert-manager's self-check still waits
+	// for it. 0, the default, doesn't wait.
+	PropagationSeconds int `json:"propagationSeconds"`
+
+	// PropagationNameservers makes Present wait for the record to be
+	// served by each of these nameservers, given as host or host:port,
+	// rather than to be listed by the API, e.g. the zone's authoritative
+	// nameservers the ACME server will query. Requires PropagationSeconds.
+	// After loading the config, each has a port.
+	PropagationNameservers []string `json:"propagationNameservers"`
+
+	// RecordType is the type of the challenge records, TXT by default as
+	// required by ACME DNS-01. Other types are meant for debugging and
+	// testing.
+	RecordType string `json:"recordType"`
+
+	// UserAgent replaces the User-Agent header identifying the webhook and
+	// its version to the API.
+	UserAgent string `json:"userAgent"`
+
+	// EmitEvents records a Kubernetes event on the webhook's pod for each
+	// record created or deleted, as an in-cluster audit trail.
+	EmitEvents bool `json:"emitEvents"`
 }
 
+// zoneLookupSearchName looks zones up with the search_name parameter, which
+// matches substrings. The results are reduced to the zone with exactly the
+// name looked for. zoneLookupName looks them up with the name parameter,
+// which only returns exact matches.
+const (
+	zoneLookupSearchName = "search_name"
+	zoneLookupName       = "name"
+)
+
+// ttlStrategyFixed creates records with the configured TTL.
+// ttlStrategyMinimum creates them with MinTTL, the lowest TTL allowed, so
+// that resolvers don't cache the short-lived records, and a record whose
+// self check failed isn't cached with the wrong value for long.
+const (
+	ttlStrategyFixed   = "fixed"
+	ttlStrategyMinimum = "minimum"
+)
+
+// defaultRecordType is the type of challenge records unless RecordType is
+// set.
+const defaultRecordType = "TXT"
+
+// recordTypes are the record types accepted by the Hetzner DNS API.
+var recordTypes = []string{"A", "AAAA", "NS", "MX", "CNAME", "RP", "TXT", "SOA", "HINFO", "SRV", "DANE", "TLSA", "DS", "CAA"}
+
+// defaultZoneCountWarningThreshold is used when ZoneCountWarningThreshold is
+// not set.
+const defaultZoneCountWarningThreshold = 500
+
+// maxMaxRetries and maxRetryBaseDelayMilliseconds cap MaxRetries and
+// RetryBaseDelayMilliseconds, so that a misconfigured issuer can't keep
+// retrying requests for hours.
+const (
+	maxMaxRetries                 = 10
+	maxRetryBaseDelayMilliseconds = 30000
+)
+
+// maxCleanUpDelaySeconds caps CleanUpDelaySeconds, as the delay holds the
+// lock of the record name.
+const maxCleanUpDelaySeconds = 60
+
+// maxTimeoutSeconds caps TimeoutSeconds, so that a stuck call can't hold
+// the lock of its record name for too long.
+const maxTimeoutSeconds = 300
+
+// defaultTTL is the TTL of the created TXT record when none is configured.
+// minTTL and maxTTL are the bounds accepted by the Hetzner DNS API.
+const (
+	defaultTTL = 300
+	minTTL     = 60
+	maxTTL     = 86400
+)
+
+// apiTokenEnv and apiTokenFileEnv are the environment variables holding the
+// API token, or the path of a file containing it, used when the config sets
+// neither apiKeySecretRef, apiKey nor apiKeyFile.
+const (
+	apiTokenEnv     = "HETZNER_API_TOKEN"
+	apiTokenFileEnv = "HETZNER_API_TOKEN_FILE"
+)
+
+// caBundlePathEnv is the environment variable holding the path of the CA
+// bundle used when the config sets none.
+const caBundlePathEnv = "HETZNER_CA_BUNDLE_PATH"
+
+// configFileEnv is the environment variable holding the path of a solver
+// config in JSON providing defaults for the configs of all challenges.
+const configFileEnv = "SOLVER_CONFIG_FILE"
+
+// defaultAPIKeyPattern matches the 32 alphanumeric characters of a Hetzner
+// DNS API token.
+const defaultAPIKeyPattern = `^[a-zA-Z0-9]{32}$`
+
 // Name is used as the name for this DNS solver when referencing it on the ACME
 // Issuer resource.
 // This should be unique **within the group name**, i.e. you can have two
@@ -78,28 +717,10 @@ type hetznerDNSProviderConfig struct {
 // within a single webhook deployment**.
 // For example, `cloudflare` may be used as the name of a solver.
 func (c *hetznerDNSProviderSolver) Name() string {
-	return "hetzner"
-}
-
-type Zones struct {
-	Zones []Zone `json:"zones"`
-}
-
-type Zone struct {
-	ZoneID string `json:"id"`
-}
-
-type Entries struct {
-	Records []Entry `json:"records"`
-}
-
-type Entry struct {
-	ID     string `json:"id,omitempty"`
-	Name   string `json:"name"`
-	TTL    int    `json:"ttl"`
-	Type   string `json:"type"`
-	Value  string `json:"value"`
-	ZoneID string `json:"zone_id"`
+	if c.name != "" {
+		return c.name
+	}
+	return defaultSolverName
 }
 
 // Present is responsible for actually presenting the DNS record with the
@@ -107,193 +728,1905 @@ type Entry struct {
 // This method should tolerate being called multiple times with the same value.
 // cert-manager itself will later perform a self check to ensure that the
 // solver has correctly configured the DNS provider.
-func (c *hetznerDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
-	cfg, err := loadConfig(ch.Config)
+func (c *hetznerDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
+	defer func() { observeChallenge("present", err); logChallenge("present", ch, err) }()
+	klog.V(2).InfoS("presenting challenge record", challengeLogFields(ch)...)
+
+	// a record without a value would never pass the self check, and
+	// CleanUp couldn't tell it apart from those of other challenges
+	if strings.TrimSpace(ch.ResolvedFQDN) == "" {
+		return errors.New("the challenge has no resolved FQDN, not creating a record")
+	}
+	if ch.Key == "" {
+		return fmt.Errorf("the challenge for %s has no key, not creating a record with an empty value", ch.ResolvedFQDN)
+	}
+
+	cfg, err := loadConfigWithDefaults(ch.Config, c.defaults)
 	if err != nil {
 		return err
 	}
 
-	// TODO: do something more useful with the decoded configuration
-	fmt.Printf("Decoded configuration %v", cfg)
-
-	name, zone := c.getDomainAndEntry(ch)
+	name, zone, err := c.getDomainAndEntry(ch)
+	if err != nil {
+		return err
+	}
+	if name, err = challengeRecordName(cfg, ch, name, zone); err != nil {
+		return err
+	}
+	debounceKey := zone + "/" + name + "/" + ch.Key
+	if c.presentedRecently(debounceKey, time.Duration(cfg.PresentDebounceSeconds)*time.Second) {
+		klog.V(2).Infof("record %s in zone %s was presented less than %ds ago, skipping", name, zone, cfg.PresentDebounceSeconds)
+		return nil
+	}
 
-	// Get Zones (GET https://dns.hetzner.com/api/v1/zones)
-	// Create client
-	client := &http.Client{}
+	ctx, done, err := c.operations.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, s := startSpan(ctx, "Present", "challenge.uid", string(ch.UID), "challenge.fqdn", ch.ResolvedFQDN)
+	defer func() { endSpan(s, err) }()
+	ctx, cancel := withOperationTimeout(ctx, cfg)
+	defer cancel()
+	defer func() { err = operationTimedOut(ctx, cfg, "present", err) }()
 
-	// Create request
-	req, err := http.NewRequest("GET", "https://dns.hetzner.com/api/v1/zones?search_name="+zone, nil)
-	// Headers
-	req.Header.Add("Auth-API-Token", cfg.APIKey)
+	if err := startJitter(ctx, cfg.StartJitterSeconds); err != nil {
+		return err
+	}
 
-	// Fetch Request
-	resp, err := client.Do(req)
+	client, name, zone, err := c.challengeRecord(ctx, cfg, ch, name, zone)
 	if err != nil {
-		fmt.Println("Failure : ", err)
+		return err
 	}
 
-	// Read Response Body
-	respBody := Zones{}
-	json.NewDecoder(resp.Body).Decode(&respBody)
+	// Challenges for the same name, e.g. of a wildcard and an apex domain,
+	// are solved one at a time so that they don't race on the records.
+	unlock := c.recordLocks.lock(normalizeName(zone) + "/" + normalizeName(name))
+	defer unlock()
 
-	// Display Results
-	fmt.Println("response Status : ", resp.Status)
-	fmt.Println("response Headers : ", resp.Header)
-	fmt.Println("response Body : ", respBody.Zones[0].ZoneID)
+	if err := c.present(ctx, client, cfg, ch, name, zone); err != nil {
+		c.checkZoneID(ctx, client, cfg, zone)
+		return c.describeError(ctx, client, cfg, name, zone, err)
+	}
+	c.setPresented(debounceKey, cfg.PresentDebounceSeconds > 0 && !cfg.DryRun)
+	return nil
+}
 
-	// Create DNS
-	entry, err := json.Marshal(Entry{"", name, 300, "TXT", ch.Key, respBody.Zones[0].ZoneID})
-	body := bytes.NewBuffer(entry)
+func (c *hetznerDNSProviderSolver) present(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest, name, zone string) (err error) {
+	start := time.Now()
+	zoneID, err := c.resolveZoneID(ctx, client, cfg, zone)
+	if err != nil {
+		return err
+	}
+	op := lastOperation{Zone: zone, ZoneID: zoneID, RecordName: name, Time: start}
+	defer func() {
+		if err == nil {
+			op.Duration = time.Since(start).String()
+			c.lastPresents.record(op)
+		}
+	}()
 
-	// Create request
-	req, err = http.NewRequest("POST", "https://dns.hetzner.com/api/v1/records", body)
-	// Headers
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Auth-API-Token", cfg.APIKey)
+	// the scratch record of the check is never created in a dry run
+	if cfg.PreflightZoneCheck && !cfg.DryRun {
+		if err := c.checkZoneWritable(ctx, client, zoneID, zone); err != nil {
+			return err
+		}
+	}
 
-	// Fetch Request
-	resp, err = client.Do(req)
+	records, err := client.ListRecordsByName(ctx, zoneID, name)
 	if err != nil {
-		fmt.Println("Failure : ", err)
+		return err
+	}
+	owners, records := newOwnership(cfg.OwnerMarker, records)
+
+	plan := planRecords(records, cfg.RecordType, name, []string{ch.Key})
+	duplicates := 0
+	for _, e := range plan.delete {
+		if e.Value == ch.Key {
+			duplicates++
+		}
+		if !cfg.EnforceSingleRecord {
+			continue
+		}
+		if e.Value != ch.Key && !owners.owns(e) {
+			klog.V(2).Infof("keeping previous record %s named %s in zone %s, it wasn't created by the webhook", e.ID, name, zone)
+			continue
+		}
+		klog.V(4).Infof("deleting previous record %s", e.ID)
+		if err := client.DeleteRecord(ctx, e.ID); err != nil {
+			return fmt.Errorf("failed to delete previous record %s: %v", e.ID, err)
+		}
+		c.emitEvent(ctx, cfg, "RecordDeleted", "deleted previous %s record %s named %s in zone %s", cfg.RecordType, e.ID, name, zone)
+		if e.Value != ch.Key {
+			marker, _ := owners.markerOf(e)
+			deleteMarker(ctx, client, marker.ID)
+		}
 	}
 
-	// Read Response Body
-	respBody2, _ := ioutil.ReadAll(resp.Body)
+	idKey := recordIDKey(client, zone, name, ch.Key)
+	if len(plan.keep) > 0 {
+		// logged at info level, as cert-manager presenting a record again
+		// usually means its self-check failed, and this shows the record
+		// is there and the problem lies elsewhere, e.g. in propagation
+		existing := plan.keep[0]
+		klog.Infof("record %s already exists in zone %s (id %s) as %s record %s with value %q, not creating it again; "+
+			"if the self-check fails, check propagation to the nameservers and resolvers",
+			recordFQDN(name, zone), zone, zoneID, existing.Type, existing.ID, existing.Value)
+		// duplicates from earlier versions are left to CleanUp's lookup,
+		// unless they were just deleted
+		op.RecordID = existing.ID
+		if duplicates == 0 || cfg.EnforceSingleRecord {
+			c.recordIDs.put(idKey, plan.keep[0].ID)
+			c.recordIDs.put(markerIDKey(idKey), markRecord(ctx, client, owners, plan.keep[0]))
+		}
+		return nil
+	}
 
-	// Display Results
-	fmt.Println("response Status : ", resp.Status)
-	fmt.Println("response Headers : ", resp.Header)
-	fmt.Println("response Body : ", string(respBody2))
-	// TODO: add code that sets a record in the DNS provider's console
+	created, err := client.CreateRecord(ctx, Entry{
+		Name:   name,
+		TTL:    cfg.TTL,
+		Type:   cfg.RecordType,
+		Value:  ch.Key,
+		ZoneID: zoneID,
+	})
+	if err != nil {
+		return err
+	}
+	op.RecordID, op.Created = created.ID, true
+	if created.ID != "" {
+		klog.Infof("created record %s named %s in zone %s", created.ID, name, zone)
+		c.recordIDs.put(idKey, created.ID)
+		c.emitEvent(ctx, cfg, "RecordCreated", "created %s record %s named %s in zone %s", cfg.RecordType, created.ID, name, zone)
+		c.recordIDs.put(markerIDKey(idKey), markRecord(ctx, client, owners, created))
+	}
+	if cfg.PropagationSeconds > 0 && !cfg.DryRun {
+		timeout := time.Duration(cfg.PropagationSeconds) * time.Second
+		start := time.Now()
+		source := propagationSourceAPI
+		var err error
+		if len(cfg.PropagationNameservers) > 0 {
+			source = propagationSourceDNS
+			err = waitForRecordInDNS(ctx, cfg.PropagationNameservers, recordFQDN(name, zone), ch.Key, timeout)
+		} else {
+			err = waitForRecord(ctx, client, zoneID, Entry{Name: name, Type: cfg.RecordType, Value: ch.Key}, zone, timeout)
+		}
+		if err == nil {
+			observePropagation(zone, source, start)
+		}
+		if errors.Is(err, ErrPropagationTimeout) {
+			// cert-manager's self-check will still wait for the record
+			klog.Warningf("%v, continuing", err)
+			return nil
+		}
+		return err
+	}
 	return nil
 }
 
+// recordFQDN returns the fully qualified name of the record with the given
+// name relative to zone.
+func recordFQDN(name, zone string) string {
+	zone = normalizeName(zone) + "."
+	if name == "@" {
+		return zone
+	}
+	return name + "." + zone
+}
+
+// recordIDKey identifies a record in recordIDs. Record IDs are only valid
+// for the account of the token they were looked up with.
+func recordIDKey(client *HetznerClient, zone, name, value string) string {
+	return client.apiURL + "\x00" + client.apiKey + "\x00" + normalizeName(zone) + "/" + normalizeName(name) + "/" + value
+}
+
+// markerIDKey identifies the owner marker of the record identified by
+// idKey in recordIDs.
+func markerIDKey(idKey string) string {
+	return idKey + "\x00marker"
+}
+
 // CleanUp should delete the relevant TXT record from the DNS provider console.
 // If multiple TXT records exist with the same record name (e.g.
 // _acme-challenge.example.com) then **only** the record with the same `key`
 // value provided on the ChallengeRequest should be cleaned up.
 // This is in order to facilitate multiple DNS validations for the same domain
 // concurrently.
-func (c *hetznerDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
-	cfg, err := loadConfig(ch.Config)
+// If deleting any of the records fails, the others are still deleted and
+// CleanUp returns the errors of all failed deletions, so that cert-manager
+// retries it.
+func (c *hetznerDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (err error) {
+	defer func() { observeChallenge("cleanup", err); logChallenge("cleanup", ch, err) }()
+	klog.V(2).InfoS("cleaning up challenge record", challengeLogFields(ch)...)
+
+	cfg, err := loadConfigWithDefaults(ch.Config, c.defaults)
 	if err != nil {
 		return err
 	}
 
-	// TODO: do something more useful with the decoded configuration
-	fmt.Printf("Decoded configuration %v", cfg)
-
-	name, zone := c.getDomainAndEntry(ch)
+	name, zone, err := c.getDomainAndEntry(ch)
+	if err != nil {
+		return err
+	}
+	if name, err = challengeRecordName(cfg, ch, name, zone); err != nil {
+		return err
+	}
+	key := zone + "/" + name + "/" + ch.Key
+	c.setPresented(key, false)
+	defer func() { err = c.giveUpCleanUp(cfg, key, err) }()
 
-	// Get Zones (GET https://dns.hetzner.com/api/v1/zones)
-	// Create client
-	client := &http.Client{}
+	ctx, done, err := c.operations.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, s := startSpan(ctx, "CleanUp", "challenge.uid", string(ch.UID), "challenge.fqdn", ch.ResolvedFQDN)
+	defer func() { endSpan(s, err) }()
+	ctx, cancel := withOperationTimeout(ctx, cfg)
+	defer cancel()
+	defer func() { err = operationTimedOut(ctx, cfg, "clean up", err) }()
 
-	// Create request
-	zReq, err := http.NewRequest("GET", "https://dns.hetzner.com/api/v1/zones?search_name="+zone, nil)
-	// Headers
-	zReq.Header.Add("Auth-API-Token", cfg.APIKey)
+	if err := startJitter(ctx, cfg.StartJitterSeconds); err != nil {
+		return err
+	}
 
-	// Fetch Request
-	zResp, err := client.Do(zReq)
+	client, name, zone, err := c.challengeRecord(ctx, cfg, ch, name, zone)
 	if err != nil {
-		fmt.Println("Failure : ", err)
+		return err
 	}
 
-	// Read Response Body
-	zRespBody := Zones{}
-	json.NewDecoder(zResp.Body).Decode(&zRespBody)
+	unlock := c.recordLocks.lock(normalizeName(zone) + "/" + normalizeName(name))
+	defer unlock()
 
-	// Display Results
-	fmt.Println("response Status : ", zResp.Status)
-	fmt.Println("response Headers : ", zResp.Header)
-	fmt.Println("response Body : ", zRespBody.Zones[0].ZoneID)
-	fmt.Println("response Body : ", name)
+	if err := c.cleanUp(ctx, client, cfg, ch, name, zone); err != nil {
+		c.checkZoneID(ctx, client, cfg, zone)
+		return c.describeError(ctx, client, cfg, name, zone, err)
+	}
+	return nil
+}
 
-	// Create request
-	eReq, err := http.NewRequest("GET", "https://dns.hetzner.com/api/v1/records?zone_id="+zRespBody.Zones[0].ZoneID, nil)
-	// Headers
-	eReq.Header.Add("Auth-API-Token", cfg.APIKey)
+// challengeLogFields returns the structured log fields identifying ch, to
+// correlate log lines with the certificate and challenge that caused them.
+// The UID is also logged with each API request as its requestID.
+func challengeLogFields(ch *v1alpha1.ChallengeRequest) []interface{} {
+	return []interface{}{
+		"uid", string(ch.UID),
+		"resourceNamespace", ch.ResourceNamespace,
+		"dnsName", ch.DNSName,
+		"fqdn", ch.ResolvedFQDN,
+	}
+}
 
-	// Fetch Request
-	eResp, err := client.Do(eReq)
+// logChallenge logs the outcome of the given action on ch.
+func logChallenge(action string, ch *v1alpha1.ChallengeRequest, err error) {
 	if err != nil {
-		fmt.Println("Failure : ", err)
+		klog.ErrorS(err, action+" failed", challengeLogFields(ch)...)
+		return
 	}
+	klog.V(2).InfoS(action+" succeeded", challengeLogFields(ch)...)
+}
 
-	// Read Response Body
-	eRespBody := Entries{}
-	json.NewDecoder(eResp.Body).Decode(&eRespBody)
-
-	// Display Results
-	fmt.Println("response Status : ", eResp.Status)
-	fmt.Println("response Headers : ", eResp.Header)
-	fmt.Println("response Body : ", eRespBody)
-
-	for _, e := range eRespBody.Records {
-		if e.Type == "TXT" && e.Name == name && e.Value == ch.Key {
-			fmt.Println("Found DOMAIN: ", e)
-			// Delete Record (DELETE https://dns.hetzner.com/api/v1/records/1)
-			// Create request
-			req, err := http.NewRequest("DELETE", "https://dns.hetzner.com/api/v1/records/"+e.ID, nil)
-
-			// Headers
-			req.Header.Add("Auth-API-Token", cfg.APIKey)
+// giveUpCleanUp returns err, or nil if CleanUpMaxAttempts is set and the
+// CleanUp of the record identified by key failed that often, for at least
+// CleanUpGiveUpSeconds.
+func (c *hetznerDNSProviderSolver) giveUpCleanUp(cfg hetznerDNSProviderConfig, key string, err error) error {
+	if cfg.CleanUpMaxAttempts == 0 {
+		return err
+	}
+	if err == nil {
+		c.cleanUpFailures.forget(key)
+		return nil
+	}
 
-			// Fetch Request
-			resp, err := client.Do(req)
+	attempts, first := c.cleanUpFailures.add(key)
+	window := time.Duration(cfg.CleanUpGiveUpSeconds) * time.Second
+	if attempts < cfg.CleanUpMaxAttempts || time.Since(first) < window {
+		return err
+	}
+	c.cleanUpFailures.forget(key)
+	klog.Errorf("GIVING UP cleaning up record %s after %d failed attempts since %s, it is left behind and has to be removed manually: %v", key, attempts, first.Format(time.RFC3339), err)
+	c.emitEvent(context.Background(), cfg, "CleanUpAbandoned", "gave up cleaning up record %s after %d failed attempts, it has to be removed manually: %v", key, attempts, err)
+	return nil
+}
 
+// challengeRecord returns the client, name and zone to solve ch with. They
+// are name and zone unless FollowCNAME is set and the challenge FQDN is a
+// CNAME, in which case the record is created at the CNAME target instead.
+func (c *hetznerDNSProviderSolver) challengeRecord(ctx context.Context, cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest, name, zone string) (*HetznerClient, string, string, error) {
+	if cfg.FollowCNAME {
+		target, err := resolveCNAME(ctx, ch.ResolvedFQDN)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if target != "" {
+			// the target name selects the API token like a zone would
+			client, err := c.newClient(ctx, cfg, ch, target)
 			if err != nil {
-				fmt.Println("Failure : ", err)
+				return nil, "", "", err
 			}
-
-			// Read Response Body
-			respBody, _ := ioutil.ReadAll(resp.Body)
-
-			// Display Results
-			fmt.Println("response Status : ", resp.Status)
-			fmt.Println("response Headers : ", resp.Header)
-			fmt.Println("response Body : ", string(respBody))
+			targetZone, err := findZone(ctx, client, target, cfg.MaxZoneWalkDepth)
+			if err != nil {
+				return nil, "", "", err
+			}
+			entry := strings.TrimSuffix(strings.TrimSuffix(target, targetZone), ".")
+			if entry == "" {
+				entry = "@"
+			}
+			klog.V(2).Infof("following CNAME of %s to record %s in zone %s", ch.ResolvedFQDN, entry, targetZone)
+			return client, entry, targetZone, nil
 		}
 	}
 
-	// TODO: add code that deletes a record from the DNS provider's console
-	return nil
+	client, err := c.newClient(ctx, cfg, ch, zone)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return client, name, zone, nil
 }
 
-// Initialize will be called when the webhook first starts.
-// This method can be used to instantiate the webhook, i.e. initialising
-// connections or warming up caches.
-// Typically, the kubeClientConfig parameter is used to build a Kubernetes
-// client that can be used to fetch resources from the Kubernetes API, e.g.
-// Secret resources containing credentials used to authenticate with DNS
-// provider accounts.
-// The stopCh can be used to handle early termination of the webhook, in cases
-// where a SIGTERM or similar signal is sent to the webhook process.
-func (c *hetznerDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
-	return nil
-}
+func (c *hetznerDNSProviderSolver) cleanUp(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest, name, zone string) error {
+	if cfg.CleanUpDelaySeconds > 0 {
+		klog.V(2).Infof("waiting %ds before cleaning up record %s in zone %s", cfg.CleanUpDelaySeconds, name, zone)
+		select {
+		case <-time.After(time.Duration(cfg.CleanUpDelaySeconds) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-// loadConfig is a small helper function that decodes JSON configuration into
-// the typed config struct.
-func loadConfig(cfgJSON *extapi.JSON) (hetznerDNSProviderConfig, error) {
-	cfg := hetznerDNSProviderConfig{}
-	// handle the 'base case' where no configuration has been provided
-	if cfgJSON == nil {
-		return cfg, nil
+	// Records presented by this process are deleted by their ID, without
+	// listing the records of the zone. With VerifyBeforeDelete, records
+	// that changed or can't be verified are looked up like the others.
+	idKey := recordIDKey(client, zone, name, ch.Key)
+	markerID, _ := c.recordIDs.take(markerIDKey(idKey))
+	id, ok := c.recordIDs.take(idKey)
+	if ok && cfg.VerifyBeforeDelete {
+		ok, _ = recordUnchanged(ctx, client, id, ch.Key)
 	}
-	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
-		return cfg, fmt.Errorf("error decoding solver config: %v", err)
+	if ok && !cfg.PurgeStale {
+		err := client.DeleteRecord(ctx, id)
+		if err == nil {
+			klog.V(4).Infof("deleted record %s by its ID", id)
+			c.emitEvent(ctx, cfg, "RecordDeleted", "deleted %s record %s named %s in zone %s", cfg.RecordType, id, name, zone)
+			deleteMarker(ctx, client, markerID)
+			return nil
+		}
+		if isNotFound(err) {
+			klog.V(4).Infof("record %s was already deleted", id)
+			deleteMarker(ctx, client, markerID)
+			return nil
+		}
+		klog.V(2).Infof("failed to delete record %s by its ID, looking it up: %v", id, err)
 	}
 
-	return cfg, nil
-}
+	// A record that is already gone, along with its zone or not, counts as
+	// cleaned up. Failing would make cert-manager retry forever.
+	zoneID, err := c.resolveZoneID(ctx, client, cfg, zone)
+	if errors.Is(err, ErrZoneNotFound) {
+		klog.Infof("zone %s not found, nothing to clean up for record %s", zone, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records, err := client.ListRecordsByName(ctx, zoneID, name)
+	if isNotFound(err) {
+		klog.Infof("zone %s (id %s) not found, nothing to clean up for record %s", zone, zoneID, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owners, records := newOwnership(cfg.OwnerMarker, records)
+
+	found := false
+	var doomed []Entry
+	for _, e := range records {
+		if e.Type != cfg.RecordType || !sameName(e.Name, name) {
+			continue
+		}
+		switch {
+		case e.Value == ch.Key:
+			found = true
+			klog.V(4).Infof("deleting record %s", e.ID)
+		case !cfg.PurgeStale:
+			continue
+		case !owners.owns(e):
+			klog.V(2).Infof("keeping stale record %s named %s in zone %s, it wasn't created by the webhook", e.ID, name, zone)
+			continue
+		default:
+			klog.Infof("deleting stale record %s named %s from zone %s", e.ID, name, zone)
+		}
+		doomed = append(doomed, e)
+	}
+	if !found {
+		klog.Infof("record %s in zone %s not found, nothing to clean up", name, zone)
+	}
+
+	workers := cfg.CleanUpWorkers
+	if workers == 0 {
+		workers = defaultCleanUpWorkers
+	}
+	err = deleteRecords(ctx, workers, doomed, func(ctx context.Context, e Entry) error {
+		if cfg.VerifyBeforeDelete {
+			unchanged, err := recordUnchanged(ctx, client, e.ID, e.Value)
+			if err != nil {
+				return fmt.Errorf("failed to verify record %s before deleting it: %w", e.ID, err)
+			}
+			if !unchanged {
+				klog.Infof("record %s named %s in zone %s changed or is gone since it was listed, not deleting it", e.ID, name, zone)
+				return nil
+			}
+		}
+		if err := client.DeleteRecord(ctx, e.ID); err != nil {
+			if isNotFound(err) {
+				klog.V(2).Infof("record %s was already deleted", e.ID)
+				return nil
+			}
+			klog.Errorf("failed to delete record %s: %v", e.ID, err)
+			return fmt.Errorf("failed to delete record %s: %w", e.ID, err)
+		}
+		c.emitEvent(ctx, cfg, "RecordDeleted", "deleted %s record %s named %s in zone %s", cfg.RecordType, e.ID, name, zone)
+		marker, _ := owners.markerOf(e)
+		deleteMarker(ctx, client, marker.ID)
+		return nil
+	})
+	if failed, ok := err.(joinedError); ok {
+		return fmt.Errorf("failed to delete %d of %d records named %s in zone %s: %w", len(failed), len(doomed), name, zone, err)
+	}
+	return err
+}
+
+// recordUnchanged reports whether the record with the given ID still has
+// the given value, fetching it again. Records that are gone count as
+// changed.
+func recordUnchanged(ctx context.Context, client *HetznerClient, id, value string) (bool, error) {
+	e, err := client.GetRecord(ctx, id)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return e.Value == value, nil
+}
+
+// withOperationTimeout bounds ctx by OperationTimeoutSeconds, if set.
+func withOperationTimeout(ctx context.Context, cfg hetznerDNSProviderConfig) (context.Context, context.CancelFunc) {
+	if cfg.OperationTimeoutSeconds == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(cfg.OperationTimeoutSeconds)*time.Second)
+}
+
+// operationTimedOut returns err, or an error wrapping
+// context.DeadlineExceeded that names OperationTimeoutSeconds if the
+// operation failed because ctx, bounded by withOperationTimeout, expired.
+func operationTimedOut(ctx context.Context, cfg hetznerDNSProviderConfig, action string, err error) error {
+	if err == nil || cfg.OperationTimeoutSeconds == 0 || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return fmt.Errorf("%w: failed to %s within operationTimeoutSeconds of %ds: %v", context.DeadlineExceeded, action, cfg.OperationTimeoutSeconds, err)
+}
+
+// startJitter waits a random time of up to the given number of seconds,
+// or until ctx is done.
+func startJitter(ctx context.Context, seconds int) error {
+	if seconds <= 0 {
+		return nil
+	}
+	delay := time.Duration(rand.Int63n(int64(seconds) * int64(time.Second)))
+	klog.V(2).Infof("waiting %v before the first API call", delay)
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("canceled while waiting before the first API call: %w", ctx.Err())
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// presentedRecently reports whether the record identified by key was
+// presented successfully within the given window.
+func (c *hetznerDNSProviderSolver) presentedRecently(key string, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	c.recentPresentsMu.Lock()
+	defer c.recentPresentsMu.Unlock()
+
+	at, ok := c.recentPresents[key]
+	return ok && time.Since(at) < window
+}
+
+// setPresented records whether the record identified by key is currently
+// presented, i.e. until it is cleaned up.
+func (c *hetznerDNSProviderSolver) setPresented(key string, presented bool) {
+	c.recentPresentsMu.Lock()
+	defer c.recentPresentsMu.Unlock()
+
+	if !presented {
+		delete(c.recentPresents, key)
+		return
+	}
+	if c.recentPresents == nil {
+		c.recentPresents = map[string]time.Time{}
+	}
+	c.recentPresents[key] = time.Now()
+}
+
+// describeError appends a snapshot of the zone and its challenge records to
+// err if verbose errors are enabled, to give immediate context in the
+// challenge status and in issue reports.
+func (c *hetznerDNSProviderSolver) describeError(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, name, zone string, err error) error {
+	if errors.Is(err, ErrForbidden) {
+		// the token was accepted, so the lookups would be rejected as well
+		return fmt.Errorf("%w; the API token may lack access to zone %s", err, zone)
+	}
+	if !cfg.VerboseErrors || errors.Is(err, ErrAuthFailed) {
+		return err
+	}
+
+	zoneID, zoneErr := c.resolveZoneID(ctx, client, cfg, zone)
+	if zoneErr != nil {
+		return fmt.Errorf("%w (zone %s: lookup failed: %v)", err, zone, zoneErr)
+	}
+
+	records, listErr := client.ListRecordsByName(ctx, zoneID, name)
+	if listErr != nil {
+		return fmt.Errorf("%w (zone %s, id %s: listing records failed: %v)", err, zone, zoneID, listErr)
+	}
+
+	count := 0
+	for _, e := range records {
+		if e.Type == cfg.RecordType && sameName(e.Name, name) {
+			count++
+		}
+	}
+	return fmt.Errorf("%w (zone %s, id %s, %d %s records named %s)", err, zone, zoneID, count, cfg.RecordType, name)
+}
+
+// resolveZoneID looks up the ID of the given zone. The zones returned by the
+// name lookup are filtered for an exact name match, as the API may return
+// other zones containing the name as well, ignoring case unless
+// StrictZoneNameCase is set. If none of them matches, it falls back to
+// listing all zones. It fails unless exactly one zone matches. Present and
+// CleanUp both resolve zones with it, so that CleanUp looks for records in
+// the zone Present created them in.
+func (c *hetznerDNSProviderSolver) resolveZoneID(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, zone string) (string, error) {
+	if cfg.ZoneID != "" {
+		if err := c.checkConfiguredZone(ctx, client, cfg.ZoneID); err != nil {
+			return "", err
+		}
+		return cfg.ZoneID, nil
+	}
+	zone = strings.TrimRight(zone, ".")
+	if cfg.ZoneCacheSeconds == 0 {
+		return c.lookupZoneID(ctx, client, cfg, zone)
+	}
+
+	// zone IDs are only valid for the account of the token they were
+	// looked up with
+	cached := normalizeName(zone)
+	if cfg.StrictZoneNameCase {
+		cached = "strict\x00" + zone
+	}
+	key := client.apiURL + "\x00" + client.apiKey + "\x00" + cached
+	if zoneID, ok := c.zoneCache.get(key); ok {
+		klog.V(4).Infof("using cached ID %s of zone %s", zoneID, zone)
+		return zoneID, nil
+	}
+
+	zoneID, err := c.lookupZoneID(ctx, client, cfg, zone)
+	if err != nil {
+		return "", err
+	}
+	size := cfg.ZoneCacheSize
+	if size == 0 {
+		size = defaultZoneCacheSize
+	}
+	c.zoneCache.put(key, zoneID, time.Duration(cfg.ZoneCacheSeconds)*time.Second, size)
+	return zoneID, nil
+}
+
+// checkConfiguredZone looks up the zone of a configured zone ID the first
+// time it is used, to fail early on a typo rather than with the record
+// changes. The zone is cached, so that later challenges don't look it up
+// again. If the lookup fails for other reasons than an unknown ID, the ID is
+// used as is and looked up again with the next challenge.
+func (c *hetznerDNSProviderSolver) checkConfiguredZone(ctx context.Context, client *HetznerClient, zoneID string) error {
+	key := client.apiURL + "\x00" + client.apiKey + "\x00" + zoneID
+	c.configuredZonesMu.Lock()
+	_, ok := c.configuredZones[key]
+	c.configuredZonesMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	z, err := client.GetZoneByID(ctx, zoneID)
+	if isNotFound(err) {
+		return fmt.Errorf("%w: the configured zoneId %s does not exist: %v", ErrZoneNotFound, zoneID, err)
+	}
+	if err != nil {
+		klog.V(2).Infof("could not look up the configured zoneId %s, using it as is: %v", zoneID, err)
+		return nil
+	}
+	klog.V(4).Infof("configured zoneId %s is zone %s", zoneID, z.Name)
+
+	c.configuredZonesMu.Lock()
+	defer c.configuredZonesMu.Unlock()
+	if c.configuredZones == nil {
+		c.configuredZones = map[string]Zone{}
+	}
+	c.configuredZones[key] = z
+	return nil
+}
+
+// checkZoneID warns if the configured zone ID is not the one zone resolves
+// to by its name. It is only called after an operation failed, as the point
+// of configuring the zone ID is to skip the lookup.
+func (c *hetznerDNSProviderSolver) checkZoneID(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, zone string) {
+	if cfg.ZoneID == "" {
+		return
+	}
+	zoneID, err := c.lookupZoneID(ctx, client, cfg, zone)
+	if err != nil {
+		klog.V(2).Infof("could not look up zone %s to compare it with zoneId %s: %v", zone, cfg.ZoneID, err)
+		return
+	}
+	if zoneID != cfg.ZoneID {
+		klog.Warningf("zoneId %s is configured, but zone %s has the ID %s", cfg.ZoneID, zone, zoneID)
+	}
+}
+
+// lookupZoneID returns the ID of the given zone, looked up with the API.
+// If the account has no such zone, the error names zones of the account
+// that are parents or children of it, as the zone of the challenge is
+// often one of these.
+func (c *hetznerDNSProviderSolver) lookupZoneID(ctx context.Context, client *HetznerClient, cfg hetznerDNSProviderConfig, zone string) (string, error) {
+	// the case of zone is kept for StrictZoneNameCase
+	zone = strings.TrimRight(zone, ".")
+	getZones := client.GetZones
+	if cfg.ZoneLookup == zoneLookupName {
+		getZones = client.GetZonesByName
+	}
+	zones, err := getZones(ctx, normalizeName(zone))
+	if err != nil {
+		return "", err
+	}
+	zones = filterZonesByName(zones, zone, cfg.StrictZoneNameCase)
+	if len(zones) > 0 {
+		return singleZoneID(zone, zones)
+	}
+
+	all, err := client.ListZones(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	threshold := cfg.ZoneCountWarningThreshold
+	if threshold == 0 {
+		threshold = defaultZoneCountWarningThreshold
+	}
+	if threshold > 0 && len(all) > threshold {
+		klog.Warningf("resolving zone %s required listing all %d zones of the account, which is slow; "+
+			"make sure the zone can be found by its name to avoid this", zone, len(all))
+	}
+
+	zoneID, err := singleZoneID(zone, filterZonesByName(all, zone, cfg.StrictZoneNameCase))
+	if errors.Is(err, ErrZoneNotFound) {
+		if related := relatedZones(all, zone); related != "" {
+			err = fmt.Errorf("%w, but the account has the related zones %s", err, related)
+		}
+	}
+	return zoneID, err
+}
+
+// maxRelatedZones is the maximum number of related zones named when a zone
+// is not found.
+const maxRelatedZones = 5
+
+// relatedZones returns the names of the zones that are a parent or a child
+// of zone, sorted and limited to maxRelatedZones, or "" if there are none.
+func relatedZones(zones []Zone, zone string) string {
+	zone = normalizeName(zone)
+	var related []string
+	for _, z := range zones {
+		name := normalizeName(z.Name)
+		if strings.HasSuffix(zone, "."+name) || strings.HasSuffix(name, "."+zone) {
+			related = append(related, z.Name)
+		}
+	}
+	sort.Strings(related)
+	if len(related) > maxRelatedZones {
+		return fmt.Sprintf("%s and %d more", strings.Join(related[:maxRelatedZones], ", "), len(related)-maxRelatedZones)
+	}
+	return strings.Join(related, ", ")
+}
+
+var (
+	// ErrZoneNotFound is returned when no zone of the account has the name
+	// of the challenge's zone.
+	ErrZoneNotFound = errors.New("zone not found")
+	// ErrAmbiguousZone is returned when several zones of the account have
+	// the name of the challenge's zone.
+	ErrAmbiguousZone = errors.New("ambiguous zone")
+	// ErrZoneNotReady is returned when the zone of the challenge is in a
+	// state in which the API rejects record changes, e.g. being deleted.
+	ErrZoneNotReady = errors.New("zone not ready for record changes")
+)
+
+// readyZoneStatuses are the zone states in which records can be changed.
+// Zones without a status are assumed to be ready.
+var readyZoneStatuses = map[string]bool{
+	"":         true,
+	"verified": true,
+	"active":   true,
+}
+
+// zoneReady fails with ErrZoneNotReady unless the status of z allows
+// changing its records.
+func zoneReady(z Zone) error {
+	if readyZoneStatuses[strings.ToLower(z.Status)] {
+		return nil
+	}
+	return fmt.Errorf("%w: zone %s (id %s) has the status %q", ErrZoneNotReady, z.Name, z.ZoneID, z.Status)
+}
+
+// singleZoneID returns the ID of the only zone in zones, which are the
+// zones named zone, if it is ready for record changes.
+func singleZoneID(zone string, zones []Zone) (string, error) {
+	switch len(zones) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrZoneNotFound, zone)
+	case 1:
+		if err := zoneReady(zones[0]); err != nil {
+			return "", err
+		}
+		return zones[0].ZoneID, nil
+	}
+	candidates := make([]string, len(zones))
+	for i, z := range zones {
+		candidates[i] = fmt.Sprintf("%s (id %s)", z.Name, z.ZoneID)
+	}
+	return "", fmt.Errorf("%w: %s matches %s", ErrAmbiguousZone, zone, strings.Join(candidates, ", "))
+}
+
+// filterZonesByName returns the zones whose name equals name, see sameName.
+// With strictCase, names only match if their case is the same as well.
+func filterZonesByName(zones []Zone, name string, strictCase bool) []Zone {
+	var matches []Zone
+	for _, z := range zones {
+		if strictCase && strings.TrimRight(z.Name, ".") != strings.TrimRight(name, ".") {
+			continue
+		}
+		if sameName(z.Name, name) {
+			matches = append(matches, z)
+		}
+	}
+	return matches
+}
+
+// preflightRecordName is the name of the scratch record created by the
+// pre-flight writability check.
+const preflightRecordName = "_cert-manager-webhook-hetzner-preflight"
+
+// checkZoneWritable verifies that records can be created in the given zone
+// by creating a scratch TXT record, checking that it shows up and removing
+// it again. Successful checks are cached per zone.
+func (c *hetznerDNSProviderSolver) checkZoneWritable(ctx context.Context, client *HetznerClient, zoneID, zone string) error {
+	c.writableZonesMu.Lock()
+	defer c.writableZonesMu.Unlock()
+
+	if c.writableZones[zoneID] {
+		return nil
+	}
+
+	_, err := client.CreateRecord(ctx, Entry{
+		Name:   preflightRecordName,
+		TTL:    client.ttlFloor,
+		Type:   "TXT",
+		Value:  "preflight",
+		ZoneID: zoneID,
+	})
+	if err != nil {
+		return fmt.Errorf("zone %s is not writable with the configured API token; "+
+			"make sure the token belongs to the account owning the zone and is not read-only: %v", zone, err)
+	}
+
+	records, err := client.ListRecords(ctx, zoneID)
+	if err != nil {
+		return fmt.Errorf("pre-flight check for zone %s failed: %v", zone, err)
+	}
+
+	created := false
+	for _, e := range records {
+		if e.Type == "TXT" && sameName(e.Name, preflightRecordName) {
+			created = true
+			if err := client.DeleteRecord(ctx, e.ID); err != nil {
+				klog.Warningf("failed to remove pre-flight record %s from zone %s: %v", e.ID, zone, err)
+			}
+		}
+	}
+	if !created {
+		return fmt.Errorf("zone %s is not writable with the configured API token; "+
+			"make sure the token belongs to the account owning the zone and is not read-only", zone)
+	}
+
+	if c.writableZones == nil {
+		c.writableZones = map[string]bool{}
+	}
+	c.writableZones[zoneID] = true
+	return nil
+}
+
+// Initialize will be called when the webhook first starts.
+// This method can be used to instantiate the webhook, i.e. initialising
+// connections or warming up caches.
+// Typically, the kubeClientConfig parameter is used to build a Kubernetes
+// client that can be used to fetch resources from the Kubernetes API, e.g.
+// Secret resources containing credentials used to authenticate with DNS
+// provider accounts.
+// The stopCh can be used to handle early termination of the webhook, in cases
+// where a SIGTERM or similar signal is sent to the webhook process.
+func (c *hetznerDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
+	for _, env := range []string{apiTokenEnv, apiTokenFileEnv} {
+		if os.Getenv(env) != "" {
+			klog.Infof("%s is set, it is used for challenges whose config sets neither apiKeySecretRef, apiKey nor apiKeyFile", env)
+			break
+		}
+	}
+	c.logStartup()
+	if err := c.initKubernetesClient(kubeClientConfig); err != nil {
+		return err
+	}
+
+	if path := os.Getenv(caBundlePathEnv); path != "" {
+		caBundle, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", caBundlePathEnv, err)
+		}
+		if _, err := parseCABundle(caBundle); err != nil {
+			return fmt.Errorf("invalid %s: %v", caBundlePathEnv, err)
+		}
+		c.caBundle = string(caBundle)
+	}
+
+	if path := os.Getenv(configFileEnv); path != "" {
+		defaults, err := withConfigFile(c.defaults, path)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", configFileEnv, err)
+		}
+		c.defaults = defaults
+		klog.Infof("using the solver config in %s as defaults for the configs of challenges", path)
+	}
+	go c.prewarmZoneCache(stopCh)
+	go c.reconcileOnStartup(stopCh)
+
+	if err := c.live.configure(); err != nil {
+		return err
+	}
+
+	addr, err := metricsAddr()
+	if err != nil {
+		return err
+	}
+	if _, err := shutdownGrace(); err != nil {
+		return err
+	}
+
+	// stop accepting challenges as soon as the server is shutting down
+	go func() {
+		<-stopCh
+		c.operations.stop()
+	}()
+
+	serving, err := newServingCheck()
+	if err != nil {
+		return err
+	}
+	c.ready.serving = serving
+	c.live.serving = serving
+
+	c.startTokenValidation(stopCh)
+	handlers := map[string]http.Handler{"/readyz": &c.ready, "/livez": &c.live}
+	if managedRecordsEndpointEnabled() {
+		if !envTokenConfigured() {
+			klog.Warningf("%s is set, but the endpoint lists records with the API token from the environment, which isn't set", managedRecordsEndpointEnv)
+		}
+		handlers["/managed-records"] = managedRecordsHandler{solver: c}
+	}
+	if debugConfigEndpointEnabled() {
+		handlers["/debug/config"] = debugConfigHandler{solver: c}
+	}
+	if validateConfigEndpointEnabled() {
+		handlers["/validate-config"] = validateConfigHandler{solver: c}
+	}
+	serveMetrics(addr, handlers, stopCh)
+	return nil
+}
+
+// initKubernetesClient sets up the clientset reading secrets and recording
+// events from kubeClientConfig, unless the solver already has one. Building
+// it doesn't contact the API server. Without a config, the clientset is
+// built from the in-cluster config on first use.
+func (c *hetznerDNSProviderSolver) initKubernetesClient(kubeClientConfig *rest.Config) error {
+	if kubernetesClientDisabled() || c.kubeClient == nil && kubeClientConfig == nil {
+		checkKubernetesClient()
+		return nil
+	}
+	c.kubeClientMu.Lock()
+	defer c.kubeClientMu.Unlock()
+	if c.kubeClient == nil {
+		client, err := kubernetes.NewForConfig(kubeClientConfig)
+		if err != nil {
+			return fmt.Errorf("error building the Kubernetes client: %v", err)
+		}
+		c.kubeClient = client
+	}
+	return nil
+}
+
+// redactURL returns rawURL with the credentials of its user info, if any,
+// replaced by REDACTED.
+func redactURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+		u.User = url.User("REDACTED")
+		return u.String()
+	}
+	return rawURL
+}
+
+// logStartup logs the effective defaults of the solver in a single line,
+// without any secrets, to tell which settings a deployment runs with.
+func (c *hetznerDNSProviderSolver) logStartup() {
+	groupName, _ := normalizeGroupName(GroupName)
+
+	apiURL := c.apiURL
+	if apiURL == "" {
+		apiURL = hetznerAPIURL
+		if env := os.Getenv("HETZNER_API_URL"); env != "" {
+			apiURL = env
+		}
+	}
+	apiURL = redactURL(apiURL)
+
+	credentialSource := "solver config"
+	for _, env := range []string{apiTokenEnv, apiTokenFileEnv} {
+		if os.Getenv(env) != "" {
+			credentialSource = env
+			break
+		}
+	}
+
+	ttl := defaultTTL
+	if c.defaults.TTL != 0 {
+		ttl = c.defaults.TTL
+	}
+	maxRetries := defaultMaxRetries
+	if c.defaults.MaxRetries > 0 {
+		maxRetries = c.defaults.MaxRetries
+	} else if c.defaults.MaxRetries < 0 {
+		maxRetries = 0
+	}
+
+	klog.InfoS("starting solver", "version", Version, "groupName", groupName, "solverName", c.Name(), "apiURL", apiURL,
+		"credentialSource", credentialSource, "defaultTTL", ttl, "maxRetries", maxRetries,
+		"retryJitter", defaultRetryJitter, "namespaceSource", namespaceSource())
+}
+
+// loadConfig is a small helper function that decodes JSON configuration into
+// the typed config struct.
+func loadConfig(cfgJSON *extapi.JSON) (hetznerDNSProviderConfig, error) {
+	return loadConfigWithDefaults(cfgJSON, solverDefaults{})
+}
+
+// strictConfigEnv is the environment variable making configs with unknown
+// options fail to load when set to "true".
+const strictConfigEnv = "STRICT_CONFIG"
+
+// decodeConfig decodes the JSON config raw into cfg. Unknown options are
+// ignored unless STRICT_CONFIG is "true", which makes them an error naming
+// the option, e.g. for a misspelled option that would otherwise silently
+// have no effect.
+func decodeConfig(raw []byte, cfg *hetznerDNSProviderConfig) error {
+	if os.Getenv(strictConfigEnv) != "true" {
+		return json.Unmarshal(raw, cfg)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(cfg)
+}
+
+// withConfigFile returns defaults with the solver config in the file at
+// path, failing if it can't be read or isn't a valid config on its own.
+func withConfigFile(defaults solverDefaults, path string) (solverDefaults, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return defaults, err
+	}
+	defaults.Config = raw
+	// the token is usually set by the configs of challenges
+	if _, err := loadConfigWithDefaults(nil, defaults); err != nil && !errors.Is(err, errNoAPIKey) {
+		return defaults, err
+	}
+	return defaults, nil
+}
+
+// loadConfigWithDefaults is loadConfig for a solver with the given
+// defaults. Options of cfgJSON take precedence over those of defaults.Config.
+func loadConfigWithDefaults(cfgJSON *extapi.JSON, defaults solverDefaults) (hetznerDNSProviderConfig, error) {
+	cfg := hetznerDNSProviderConfig{
+		TTL:         defaultTTL,
+		MinTTL:      minTTL,
+		TTLStrategy: ttlStrategyFixed,
+		ZoneLookup:  zoneLookupSearchName,
+		MaxRetries:  defaults.MaxRetries,
+		RecordType:  defaultRecordType,
+	}
+	if defaults.TTL != 0 {
+		cfg.TTL = defaults.TTL
+	}
+	if defaults.ZoneLookup != "" {
+		cfg.ZoneLookup = defaults.ZoneLookup
+	}
+	if len(defaults.Config) > 0 {
+		if err := decodeConfig(defaults.Config, &cfg); err != nil {
+			return cfg, fmt.Errorf("error decoding default solver config: %v", err)
+		}
+	}
+	// handle the 'base case' where no configuration has been provided
+	if cfgJSON != nil {
+		if err := decodeConfig(cfgJSON.Raw, &cfg); err != nil {
+			return cfg, fmt.Errorf("error decoding solver config: %v", err)
+		}
+	}
+
+	if cfg.MinTTL < minTTL || cfg.MinTTL > maxTTL {
+		return cfg, fmt.Errorf("minTtl must be between %d and %d but is %d", minTTL, maxTTL, cfg.MinTTL)
+	}
+	switch cfg.TTLStrategy {
+	case ttlStrategyFixed:
+	case ttlStrategyMinimum:
+		cfg.TTL = cfg.MinTTL
+	default:
+		return cfg, fmt.Errorf("ttlStrategy must be %q or %q but is %q", ttlStrategyFixed, ttlStrategyMinimum, cfg.TTLStrategy)
+	}
+	if cfg.TTL > maxTTL || cfg.StrictTTL && cfg.TTL < cfg.MinTTL {
+		return cfg, fmt.Errorf("ttl must be between %d and %d but is %d", cfg.MinTTL, maxTTL, cfg.TTL)
+	}
+	if cfg.TTL <= 0 {
+		return cfg, fmt.Errorf("ttl must be positive but is %d", cfg.TTL)
+	}
+
+	if cfg.ZoneID != "" {
+		if cfg.ZoneID = strings.TrimSpace(cfg.ZoneID); cfg.ZoneID == "" {
+			return cfg, fmt.Errorf("zoneId must not be blank")
+		}
+	}
+
+	cfg.RecordType = strings.ToUpper(strings.TrimSpace(cfg.RecordType))
+	validRecordType := false
+	for _, t := range recordTypes {
+		validRecordType = validRecordType || t == cfg.RecordType
+	}
+	if !validRecordType {
+		return cfg, fmt.Errorf("recordType must be one of %s but is %q", strings.Join(recordTypes, ", "), cfg.RecordType)
+	}
+
+	switch cfg.OwnerMarker = strings.TrimSpace(cfg.OwnerMarker); {
+	case cfg.OwnerMarker == "":
+		cfg.OwnerMarker = defaultOwnerMarker
+	case cfg.OwnerMarker == ownerMarkerNone:
+		cfg.OwnerMarker = ""
+	case !ownerMarkerPattern.MatchString(cfg.OwnerMarker):
+		return cfg, fmt.Errorf("ownerMarker must consist of up to 64 letters, digits, '.', '_' and '-' but is %q", cfg.OwnerMarker)
+	}
+	if cfg.RecordType != "TXT" {
+		// marker records only make sense next to TXT records
+		cfg.OwnerMarker = ""
+	}
+	if cfg.ReconcileOnStartup && cfg.OwnerMarker == "" {
+		// without markers all records would count as the webhook's
+		return cfg, fmt.Errorf("reconcileOnStartup requires an ownerMarker and recordType TXT")
+	}
+
+	if cfg.ZoneLookup != zoneLookupSearchName && cfg.ZoneLookup != zoneLookupName {
+		return cfg, fmt.Errorf("zoneLookup must be %q or %q but is %q", zoneLookupSearchName, zoneLookupName, cfg.ZoneLookup)
+	}
+
+	if cfg.RecordName != "" && cfg.RecordNamePrefix != "" {
+		return cfg, fmt.Errorf("only one of recordName and recordNamePrefix may be set")
+	}
+	if cfg.RecordNameTemplate != "" {
+		if cfg.RecordName != "" || cfg.RecordNamePrefix != "" {
+			return cfg, fmt.Errorf("recordNameTemplate can't be combined with recordName or recordNamePrefix")
+		}
+		// rendering example data catches references to unknown fields
+		if _, err := renderRecordName(cfg.RecordNameTemplate, recordNameData{
+			Entry:     "_acme-challenge",
+			Zone:      "example.com",
+			DNSName:   "example.com",
+			FQDN:      "_acme-challenge.example.com",
+			Namespace: "default",
+		}); err != nil {
+			return cfg, fmt.Errorf("invalid recordNameTemplate: %v", err)
+		}
+	}
+
+	suffixZones := make([]string, 0, len(cfg.RecordNameSuffix))
+	for zone := range cfg.RecordNameSuffix {
+		suffixZones = append(suffixZones, zone)
+	}
+	sort.Strings(suffixZones)
+	seenSuffixZones := map[string]string{}
+	for _, zone := range suffixZones {
+		suffix := cfg.RecordNameSuffix[zone]
+		if normalizeName(zone) == "" {
+			return cfg, fmt.Errorf("recordNameSuffix: empty zone name")
+		}
+		if normalizeName(suffix) == "" || strings.ContainsAny(suffix, " \t\r\n") || strings.Contains(suffix, "..") {
+			return cfg, fmt.Errorf("recordNameSuffix: %q is not a valid suffix for zone %s", suffix, zone)
+		}
+		// Present and CleanUp must agree on the suffix of a zone
+		canonical := normalizeName(zone)
+		if ascii, err := toASCII(canonical); err == nil {
+			canonical = ascii
+		}
+		if other, ok := seenSuffixZones[canonical]; ok {
+			return cfg, fmt.Errorf("recordNameSuffix: %q and %q are the same zone", other, zone)
+		}
+		seenSuffixZones[canonical] = zone
+	}
+
+	for name := range cfg.ExtraHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return cfg, fmt.Errorf("extraHeaders: invalid header name %q", name)
+		}
+		if strings.EqualFold(name, "Auth-API-Token") || strings.EqualFold(name, "Content-Type") {
+			return cfg, fmt.Errorf("extraHeaders: the %s header is set by the webhook and can't be overridden", name)
+		}
+	}
+
+	if cfg.MaxRetries > maxMaxRetries {
+		klog.Warningf("maxRetries %d is above the maximum, using %d", cfg.MaxRetries, maxMaxRetries)
+		cfg.MaxRetries = maxMaxRetries
+	}
+	if cfg.RetryBaseDelayMilliseconds < 0 {
+		return cfg, fmt.Errorf("retryBaseDelayMilliseconds must not be negative but is %d", cfg.RetryBaseDelayMilliseconds)
+	}
+	if cfg.RetryBaseDelayMilliseconds > maxRetryBaseDelayMilliseconds {
+		klog.Warningf("retryBaseDelayMilliseconds %d is above the maximum, using %d", cfg.RetryBaseDelayMilliseconds, maxRetryBaseDelayMilliseconds)
+		cfg.RetryBaseDelayMilliseconds = maxRetryBaseDelayMilliseconds
+	}
+	if cfg.RetryMaxDelayMilliseconds < 0 {
+		return cfg, fmt.Errorf("retryMaxDelayMilliseconds must not be negative but is %d", cfg.RetryMaxDelayMilliseconds)
+	}
+	if cfg.RetryMaxElapsedSeconds < 0 {
+		return cfg, fmt.Errorf("retryMaxElapsedSeconds must not be negative but is %d", cfg.RetryMaxElapsedSeconds)
+	}
+	if cfg.CircuitBreakerCooldownSeconds < 0 {
+		return cfg, fmt.Errorf("circuitBreakerCooldownSeconds must not be negative but is %d", cfg.CircuitBreakerCooldownSeconds)
+	}
+	if cfg.MaxIdleConns < 0 {
+		return cfg, fmt.Errorf("maxIdleConns must not be negative but is %d", cfg.MaxIdleConns)
+	}
+	if cfg.MaxIdleConnsPerHost < 0 {
+		return cfg, fmt.Errorf("maxIdleConnsPerHost must not be negative but is %d", cfg.MaxIdleConnsPerHost)
+	}
+	if cfg.IdleConnTimeoutSeconds < 0 {
+		return cfg, fmt.Errorf("idleConnTimeoutSeconds must not be negative but is %d", cfg.IdleConnTimeoutSeconds)
+	}
+	if idle := idleConnsFor(cfg); idle.maxPerHost > idle.max {
+		return cfg, fmt.Errorf("maxIdleConnsPerHost must not be above maxIdleConns (%d) but is %d", idle.max, idle.maxPerHost)
+	}
+	if cfg.RetryJitter > 1 {
+		return cfg, fmt.Errorf("retryJitter must not be above 1 but is %v", cfg.RetryJitter)
+	}
+	if cfg.StartJitterSeconds < 0 {
+		return cfg, fmt.Errorf("startJitterSeconds must not be negative but is %d", cfg.StartJitterSeconds)
+	}
+	if cfg.PropagationSeconds < 0 {
+		return cfg, fmt.Errorf("propagationSeconds must not be negative but is %d", cfg.PropagationSeconds)
+	}
+	for i, ns := range cfg.PropagationNameservers {
+		if strings.TrimSpace(ns) == "" {
+			return cfg, fmt.Errorf("propagationNameservers[%d] must not be blank", i)
+		}
+		cfg.PropagationNameservers[i] = nameserverAddr(strings.TrimSpace(ns))
+	}
+	if len(cfg.PropagationNameservers) > 0 && cfg.PropagationSeconds == 0 {
+		return cfg, fmt.Errorf("propagationNameservers requires propagationSeconds to be set")
+	}
+	if cfg.CleanUpMaxAttempts < 0 {
+		return cfg, fmt.Errorf("cleanUpMaxAttempts must not be negative but is %d", cfg.CleanUpMaxAttempts)
+	}
+	if cfg.CleanUpGiveUpSeconds < 0 {
+		return cfg, fmt.Errorf("cleanUpGiveUpSeconds must not be negative but is %d", cfg.CleanUpGiveUpSeconds)
+	}
+	if cfg.CleanUpDelaySeconds < 0 {
+		return cfg, fmt.Errorf("cleanUpDelaySeconds must not be negative but is %d", cfg.CleanUpDelaySeconds)
+	}
+	if cfg.CleanUpDelaySeconds > maxCleanUpDelaySeconds {
+		klog.Warningf("cleanUpDelaySeconds %d is above the maximum, using %d", cfg.CleanUpDelaySeconds, maxCleanUpDelaySeconds)
+		cfg.CleanUpDelaySeconds = maxCleanUpDelaySeconds
+	}
+
+	if cfg.TimeoutSeconds < 0 {
+		return cfg, fmt.Errorf("timeoutSeconds must not be negative but is %d", cfg.TimeoutSeconds)
+	}
+	if cfg.TimeoutSeconds > maxTimeoutSeconds {
+		klog.Warningf("timeoutSeconds %d is above the maximum, using %d", cfg.TimeoutSeconds, maxTimeoutSeconds)
+		cfg.TimeoutSeconds = maxTimeoutSeconds
+	}
+	if cfg.WriteTimeoutSeconds < 0 {
+		return cfg, fmt.Errorf("writeTimeoutSeconds must not be negative but is %d", cfg.WriteTimeoutSeconds)
+	}
+	if cfg.WriteTimeoutSeconds > maxTimeoutSeconds {
+		klog.Warningf("writeTimeoutSeconds %d is above the maximum, using %d", cfg.WriteTimeoutSeconds, maxTimeoutSeconds)
+		cfg.WriteTimeoutSeconds = maxTimeoutSeconds
+	}
+	if cfg.OperationTimeoutSeconds < 0 {
+		return cfg, fmt.Errorf("operationTimeoutSeconds must not be negative but is %d", cfg.OperationTimeoutSeconds)
+	}
+
+	if cfg.PerPage < 0 {
+		return cfg, fmt.Errorf("perPage must not be negative but is %d", cfg.PerPage)
+	}
+	if cfg.PerPage > maxPerPage {
+		klog.Warningf("perPage %d is above the maximum of the API, using %d", cfg.PerPage, maxPerPage)
+		cfg.PerPage = maxPerPage
+	}
+
+	if cfg.ZoneCacheSeconds < 0 {
+		return cfg, fmt.Errorf("zoneCacheSeconds must not be negative but is %d", cfg.ZoneCacheSeconds)
+	}
+	if cfg.ZoneCacheSize < 0 {
+		return cfg, fmt.Errorf("zoneCacheSize must not be negative but is %d", cfg.ZoneCacheSize)
+	}
+	for i, zone := range cfg.PrewarmZones {
+		if strings.TrimSpace(zone) == "" {
+			return cfg, fmt.Errorf("prewarmZones[%d] must not be blank", i)
+		}
+	}
+	if len(cfg.PrewarmZones) > 0 && cfg.ZoneCacheSeconds == 0 {
+		return cfg, fmt.Errorf("prewarmZones requires zoneCacheSeconds to be set")
+	}
+	if cfg.ReconcileMinAgeSeconds < 0 {
+		return cfg, fmt.Errorf("reconcileMinAgeSeconds must not be negative but is %d", cfg.ReconcileMinAgeSeconds)
+	}
+	for i, zone := range cfg.ReconcileZones {
+		if strings.TrimSpace(zone) == "" {
+			return cfg, fmt.Errorf("reconcileZones[%d] must not be blank", i)
+		}
+	}
+
+	if cfg.PresentDebounceSeconds < 0 {
+		return cfg, fmt.Errorf("presentDebounceSeconds must not be negative but is %d", cfg.PresentDebounceSeconds)
+	}
+
+	if cfg.RateLimit < 0 {
+		return cfg, fmt.Errorf("rateLimit must not be negative but is %v", cfg.RateLimit)
+	}
+
+	if cfg.APIKeySecretSelector != nil {
+		if cfg.APIKeySecretRef.Name != "" {
+			return cfg, errors.New("only one of apiKeySecretRef.name and apiKeySecretSelector may be set")
+		}
+		if cfg.APIKeySecretRef.Key == "" {
+			return cfg, errors.New("apiKeySecretRef.key is required when apiKeySecretSelector is set")
+		}
+		selector, err := metav1.LabelSelectorAsSelector(cfg.APIKeySecretSelector)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid apiKeySecretSelector: %v", err)
+		}
+		if selector.Empty() {
+			return cfg, errors.New("apiKeySecretSelector must select by at least one label")
+		}
+		cfg.APIKeySecretRef.selector = selector.String()
+	}
+	if err := validateSecretRef("apiKeySecretRef", cfg.APIKeySecretRef); err != nil {
+		return cfg, err
+	}
+	for zone, ref := range cfg.ZoneAPIKeySecretRefs {
+		if err := validateSecretRef(fmt.Sprintf("zoneApiKeySecretRefs[%s]", zone), ref); err != nil {
+			return cfg, err
+		}
+	}
+	if len(cfg.FallbackAPIKeySecretRefs) > maxFallbackAPIKeys {
+		return cfg, fmt.Errorf("fallbackApiKeySecretRefs must not have more than %d entries but has %d", maxFallbackAPIKeys, len(cfg.FallbackAPIKeySecretRefs))
+	}
+	for i, ref := range cfg.FallbackAPIKeySecretRefs {
+		path := fmt.Sprintf("fallbackApiKeySecretRefs[%d]", i)
+		if !ref.isSet() {
+			return cfg, fmt.Errorf("%s.name is required", path)
+		}
+		if err := validateSecretRef(path, ref); err != nil {
+			return cfg, err
+		}
+	}
+	switch cfg.SecretNamespaceSource {
+	case "", secretNamespaceWebhook, secretNamespaceChallenge:
+	default:
+		if !namespacePattern.MatchString(cfg.SecretNamespaceSource) {
+			return cfg, fmt.Errorf("secretNamespaceSource must be %s, %s or a namespace but is %q", secretNamespaceWebhook, secretNamespaceChallenge, cfg.SecretNamespaceSource)
+		}
+	}
+
+	// The API token is taken from the secret reference, the inline apiKey,
+	// the apiKeyFile or the environment, in this order. Tokens often carry a
+	// trailing newline when copied, which the API rejects.
+	rawAPIKey := cfg.APIKey
+	cfg.APIKey = strings.TrimSpace(cfg.APIKey)
+	if cfg.APIKey != "" {
+		apiKeyDeprecation.Do(func() {
+			klog.Warningf("the apiKey option is deprecated, store the API token in a secret and reference it " +
+				"with apiKeySecretRef instead, see https://github.com/mecodia/cert-manager-webhook-hetzner#credentials")
+		})
+	}
+	switch {
+	case cfg.APIKeySecretRef.isSet():
+		klog.V(2).Infof("using the API token from key %s of secret %s", cfg.APIKeySecretRef.Key, cfg.APIKeySecretRef)
+	case cfg.APIKey != "":
+		klog.V(2).Infof("using the API token from the apiKey option")
+	case cfg.APIKeyFile != "":
+		apiKey, err := readAPIKeyFile(cfg.APIKeyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid apiKeyFile: %v", err)
+		}
+		cfg.APIKey = apiKey
+		klog.V(2).Infof("using the API token from file %s", cfg.APIKeyFile)
+	case strings.TrimSpace(os.Getenv(apiTokenEnv)) != "":
+		cfg.APIKey = strings.TrimSpace(os.Getenv(apiTokenEnv))
+		klog.V(2).Infof("using the API token from the %s environment variable", apiTokenEnv)
+	case os.Getenv(apiTokenFileEnv) != "":
+		apiKey, err := readAPIKeyFile(os.Getenv(apiTokenFileEnv))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s: %v", apiTokenFileEnv, err)
+		}
+		cfg.APIKey = apiKey
+		klog.V(2).Infof("using the API token from file %s", os.Getenv(apiTokenFileEnv))
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := parseProxyURL(cfg.ProxyURL); err != nil {
+			return cfg, fmt.Errorf("invalid proxyUrl: %v", err)
+		}
+	}
+	if cfg.LocalAddress != "" && net.ParseIP(cfg.LocalAddress) == nil {
+		return cfg, fmt.Errorf("localAddress must be an IP address but is %q", cfg.LocalAddress)
+	}
+	if cfg.DNSResolver = strings.TrimSpace(cfg.DNSResolver); cfg.DNSResolver != "" {
+		cfg.DNSResolver = nameserverAddr(cfg.DNSResolver)
+		if host, _, err := net.SplitHostPort(cfg.DNSResolver); err != nil || host == "" {
+			return cfg, fmt.Errorf("dnsResolver must be a host or host:port but is %q", cfg.DNSResolver)
+		}
+	}
+
+	if cfg.CABundlePath != "" {
+		if cfg.CABundle != "" {
+			return cfg, fmt.Errorf("only one of caBundle and caBundlePath may be set")
+		}
+		caBundle, err := ioutil.ReadFile(cfg.CABundlePath)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid caBundlePath: %v", err)
+		}
+		cfg.CABundle = string(caBundle)
+	}
+	if cfg.CABundle != "" {
+		if _, err := parseCABundle([]byte(cfg.CABundle)); err != nil {
+			return cfg, fmt.Errorf("invalid CA bundle: %v", err)
+		}
+	}
+
+	if cfg.APIURL != "" {
+		apiURL, err := parseAPIURL(cfg.APIURL)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid apiUrl: %v", err)
+		}
+		cfg.APIURL = apiURL
+	}
+
+	// the other options are validated first, so that default configs
+	// without a token can be checked as well
+	if !cfg.APIKeySecretRef.isSet() && cfg.APIKey == "" && len(cfg.ZoneAPIKeySecretRefs) == 0 {
+		return cfg, noAPIKeyError(rawAPIKey)
+	}
+	return cfg, nil
+}
 
-func (c *hetznerDNSProviderSolver) getDomainAndEntry(ch *v1alpha1.ChallengeRequest) (string, string) {
-	// Both ch.ResolvedZone and ch.ResolvedFQDN end with a dot: '.'
-	entry := strings.TrimSuffix(ch.ResolvedFQDN, ch.ResolvedZone)
-	entry = strings.TrimSuffix(entry, ".")
-	domain := strings.TrimSuffix(ch.ResolvedZone, ".")
-	return entry, domain
+// apiKeySecretRefForZone returns the secret reference of the API token for
+// the given zone: the entry of ZoneAPIKeySecretRefs for the zone or its
+// closest parent zone, or APIKeySecretRef if there is none.
+func apiKeySecretRefForZone(cfg hetznerDNSProviderConfig, zone string) secretKeySelector {
+	zone = normalizeName(zone)
+
+	ref, matched := cfg.APIKeySecretRef, ""
+	for name, zoneRef := range cfg.ZoneAPIKeySecretRefs {
+		name = normalizeName(name)
+		if (zone == name || strings.HasSuffix(zone, "."+name)) && len(name) > len(matched) {
+			ref, matched = zoneRef, name
+		}
+	}
+	return ref
+}
+
+// apiKeyDeprecation makes the deprecation warning for the apiKey option be
+// logged once per process instead of for every challenge.
+var apiKeyDeprecation sync.Once
+
+// validateSecretRef checks that the secret reference at the given config
+// path is either unset or complete.
+func validateSecretRef(path string, ref secretKeySelector) error {
+	switch {
+	case !ref.isSet() && ref.Key != "":
+		return fmt.Errorf("%s.name is required when %s.key is set", path, path)
+	case ref.Name != "" && ref.Key == "":
+		return fmt.Errorf("%s.key is required when %s.name is set", path, path)
+	case !ref.isSet() && ref.Namespace != "":
+		return fmt.Errorf("%s.name is required when %s.namespace is set", path, path)
+	}
+	return nil
+}
+
+// errNoAPIKey is matched by the error of configs without any API token.
+var errNoAPIKey = errors.New("no API token configured")
+
+// noAPIKeyError returns the error for a config without any API token,
+// listing each source of the token and why it didn't provide one. A file
+// without a token already fails with its own error when it is read.
+func noAPIKeyError(apiKey string) error {
+	unset := func(value string) string {
+		if value != "" {
+			return "blank"
+		}
+		return "not set"
+	}
+	return fmt.Errorf("%w, tried apiKeySecretRef (not set), apiKey (%s), apiKeyFile (not set), "+
+		"the %s environment variable (%s) and the %s environment variable (not set)",
+		errNoAPIKey, unset(apiKey), apiTokenEnv, unset(os.Getenv(apiTokenEnv)), apiTokenFileEnv)
+}
+
+// readAPIKeyFile returns the API token stored in the file at path, without
+// surrounding whitespace.
+func readAPIKeyFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	apiKey := strings.TrimSpace(string(data))
+	if apiKey == "" {
+		return "", fmt.Errorf("empty API token in %s", path)
+	}
+	return apiKey, nil
+}
+
+// parseAPIURL validates an API base URL and strips any trailing slash.
+func parseAPIURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// parseProxyURL validates a proxy URL.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http(s) or socks5 URL", raw)
+	}
+	return u, nil
+}
+
+// newClient returns a Hetzner DNS API client for the given configuration
+// and challenge, authenticated with the API token of the given zone.
+func (c *hetznerDNSProviderSolver) newClient(ctx context.Context, cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest, zone string) (*HetznerClient, error) {
+	namespace, err := secretNamespace(cfg, ch)
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := c.getAPIKey(ctx, cfg, zone, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := cfg.APIURL
+	if apiURL == "" {
+		apiURL = c.apiURL
+	}
+	if apiURL == "" {
+		apiURL = hetznerAPIURL
+		if env := os.Getenv("HETZNER_API_URL"); env != "" {
+			if apiURL, err = parseAPIURL(env); err != nil {
+				return nil, fmt.Errorf("invalid HETZNER_API_URL: %v", err)
+			}
+		}
+	}
+	client := NewHetznerClient(apiURL, apiKey)
+	if client.transport, err = c.transportFor(cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.FallbackAPIKeySecretRefs) > 0 {
+		keys := []string{apiKey}
+		for i, ref := range cfg.FallbackAPIKeySecretRefs {
+			key, err := c.apiKeyFromSecret(ctx, ref.inNamespace(namespace))
+			if err != nil {
+				klog.Warningf("skipping fallback API token %d: %v", i+1, err)
+				continue
+			}
+			keys = append(keys, key)
+		}
+		client.apiKeys = &apiKeyFailover{keys: keys}
+	}
+	client.retryNonIdempotent = cfg.RetryNonIdempotent
+	if ua := strings.TrimSpace(cfg.UserAgent); ua != "" {
+		client.userAgent = ua
+	}
+	if len(cfg.ExtraHeaders) > 0 {
+		client.extraHeaders = cfg.ExtraHeaders
+		klog.V(4).Infof("sending extra headers %s", redactHeaders(cfg.ExtraHeaders))
+	}
+	if cfg.MaxRetries > 0 {
+		client.maxRetries = cfg.MaxRetries
+	} else if cfg.MaxRetries < 0 {
+		client.maxRetries = 0
+	}
+	if cfg.RetryBaseDelayMilliseconds > 0 {
+		client.retryBaseDelay = time.Duration(cfg.RetryBaseDelayMilliseconds) * time.Millisecond
+	}
+	if cfg.RetryMaxDelayMilliseconds > 0 {
+		client.retryMaxDelay = time.Duration(cfg.RetryMaxDelayMilliseconds) * time.Millisecond
+	}
+	if cfg.RetryMaxElapsedSeconds > 0 {
+		client.retryMaxElapsed = time.Duration(cfg.RetryMaxElapsedSeconds) * time.Second
+	}
+	client.requestID = string(ch.UID)
+	if cfg.CorrelationHeader != "" {
+		client.correlationHeader = cfg.CorrelationHeader
+		client.correlationID = string(ch.UID)
+	}
+	if cfg.RateLimit > 0 {
+		client.rateLimiter = c.rateLimiterFor(apiKey, cfg.RateLimit)
+	}
+	if cfg.MaxConcurrentRequests >= 0 {
+		size := cfg.MaxConcurrentRequests
+		if size == 0 {
+			size = defaultMaxConcurrentRequests
+		}
+		client.concurrency = c.semaphoreFor(size)
+	}
+	if cfg.CircuitBreakerThreshold >= 0 {
+		threshold, cooldown := cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldownSeconds
+		if threshold == 0 {
+			threshold = defaultCircuitBreakerThreshold
+		}
+		if cooldown == 0 {
+			cooldown = defaultCircuitBreakerCooldownSeconds
+		}
+		client.circuitBreaker = c.circuitBreakerFor(apiURL, threshold, time.Duration(cooldown)*time.Second)
+	}
+	client.liveness = &c.live
+	client.seen = &c.seenRecords
+	if cfg.RetryJitter > 0 {
+		client.retryJitter = cfg.RetryJitter
+	} else if cfg.RetryJitter < 0 {
+		client.retryJitter = 0
+	}
+	client.dryRun = cfg.DryRun
+	if cfg.TimeoutSeconds > 0 {
+		client.timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	if cfg.WriteTimeoutSeconds > 0 {
+		client.writeTimeout = time.Duration(cfg.WriteTimeoutSeconds) * time.Second
+	} else if client.timeout > client.writeTimeout {
+		client.writeTimeout = client.timeout
+	}
+	if cfg.MaxResponseBytes > 0 {
+		client.maxResponseBytes = cfg.MaxResponseBytes
+	} else if cfg.MaxResponseBytes < 0 {
+		client.maxResponseBytes = 0
+	}
+	if cfg.PerPage > 0 {
+		client.perPage = cfg.PerPage
+	}
+	if cfg.MinTTL > 0 {
+		client.ttlFloor = cfg.MinTTL
+	}
+	client.strictTTL = cfg.StrictTTL
+	client.rejectLongTXT = cfg.RejectLongTXTValues
+	return client, nil
+}
+
+// transportKey identifies the settings of a transport.
+type transportKey struct {
+	proxyURL     string
+	caBundle     string
+	localAddress string
+	dnsResolver  string
+	disableHTTP2 bool
+	idle         idleConns
+}
+
+// transportFor returns the transport shared by all clients with the same
+// proxy, CA bundle, local address, DNS resolver, HTTP version and idle
+// connection settings.
+func (c *hetznerDNSProviderSolver) transportFor(cfg hetznerDNSProviderConfig) (*http.Transport, error) {
+	key := transportKey{proxyURL: cfg.ProxyURL, caBundle: cfg.CABundle, localAddress: cfg.LocalAddress, dnsResolver: cfg.DNSResolver,
+		disableHTTP2: cfg.DisableHTTP2 || http2Disabled(), idle: idleConnsFor(cfg)}
+	if key.caBundle == "" {
+		key.caBundle = c.caBundle
+	}
+
+	c.transportsMu.Lock()
+	defer c.transportsMu.Unlock()
+
+	if transport, ok := c.transports[key]; ok {
+		return transport, nil
+	}
+
+	var proxyURL *url.URL
+	if key.proxyURL != "" {
+		var err error
+		if proxyURL, err = parseProxyURL(key.proxyURL); err != nil {
+			return nil, fmt.Errorf("invalid proxyUrl: %v", err)
+		}
+	}
+	var rootCAs *x509.CertPool
+	if key.caBundle != "" {
+		var err error
+		if rootCAs, err = parseCABundle([]byte(key.caBundle)); err != nil {
+			return nil, fmt.Errorf("invalid CA bundle: %v", err)
+		}
+	}
+	if c.transports == nil {
+		c.transports = map[transportKey]*http.Transport{}
+	}
+	transport := newTransport(proxyURL, rootCAs, newDialer(key.localAddress, key.dnsResolver), key.disableHTTP2, key.idle)
+	c.transports[key] = transport
+	return transport, nil
+}
+
+// rateLimiterFor returns the rate limiter shared by all clients using
+// apiKey, replacing it if the configured rate changed.
+func (c *hetznerDNSProviderSolver) rateLimiterFor(apiKey string, perSecond float64) *rateLimiter {
+	c.rateLimitersMu.Lock()
+	defer c.rateLimitersMu.Unlock()
+
+	if c.rateLimiters == nil {
+		c.rateLimiters = map[string]*rateLimiter{}
+	}
+	limiter := newRateLimiter(perSecond)
+	if existing := c.rateLimiters[apiKey]; existing != nil && existing.interval == limiter.interval {
+		return existing
+	}
+	c.rateLimiters[apiKey] = limiter
+	return limiter
+}
+
+// circuitBreakerKey identifies the circuit breakers shared by clients.
+type circuitBreakerKey struct {
+	apiURL    string
+	threshold int
+	cooldown  time.Duration
+}
+
+// circuitBreakerFor returns the circuit breaker shared by all clients of
+// apiURL with the given settings. Each combination of settings keeps its
+// own breaker, so that challenges with different settings don't replace
+// one another's and reset its failures.
+func (c *hetznerDNSProviderSolver) circuitBreakerFor(apiURL string, threshold int, cooldown time.Duration) *circuitBreaker {
+	c.circuitBreakersMu.Lock()
+	defer c.circuitBreakersMu.Unlock()
+
+	key := circuitBreakerKey{apiURL: apiURL, threshold: threshold, cooldown: cooldown}
+	if breaker := c.circuitBreakers[key]; breaker != nil {
+		return breaker
+	}
+	if c.circuitBreakers == nil {
+		c.circuitBreakers = map[circuitBreakerKey]*circuitBreaker{}
+	}
+	breaker := newCircuitBreaker(apiURL, threshold, cooldown)
+	c.circuitBreakers[key] = breaker
+	return breaker
+}
+
+// defaultMaxConcurrentRequests is the default limit of API requests in
+// flight.
+const defaultMaxConcurrentRequests = 5
+
+// semaphoreFor returns the semaphore shared by all clients limited to size
+// requests in flight. Each size keeps its own semaphore, so that challenges
+// with different limits don't replace one another's while its slots are
+// held.
+func (c *hetznerDNSProviderSolver) semaphoreFor(size int) semaphore {
+	c.semaphoresMu.Lock()
+	defer c.semaphoresMu.Unlock()
+
+	if sem := c.semaphores[size]; sem != nil {
+		return sem
+	}
+	if c.semaphores == nil {
+		c.semaphores = map[int]semaphore{}
+	}
+	sem := newSemaphore(size)
+	c.semaphores[size] = sem
+	return sem
+}
+
+// getAPIKey returns the API token to use for the given configuration and
+// zone. Secrets referenced without a namespace are read from namespace, or
+// the webhook's namespace if it is empty.
+func (c *hetznerDNSProviderSolver) getAPIKey(ctx context.Context, cfg hetznerDNSProviderConfig, zone, namespace string) (string, error) {
+	apiKey := cfg.APIKey
+	if ref := apiKeySecretRefForZone(cfg, zone); ref.isSet() {
+		if ref != cfg.APIKeySecretRef {
+			klog.V(2).Infof("using the API token from key %s of secret %s for zone %s", ref.Key, ref, zone)
+		}
+		var err error
+		if apiKey, err = c.apiKeyFromSecret(ctx, ref.inNamespace(namespace)); err != nil {
+			return "", err
+		}
+	}
+
+	if apiKey == "" {
+		return "", errors.New("empty API token")
+	}
+
+	if cfg.ValidateAPIKeyFormat {
+		pattern := cfg.APIKeyPattern
+		if pattern == "" {
+			pattern = defaultAPIKeyPattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", fmt.Errorf("invalid apiKeyPattern %q: %v", pattern, err)
+		}
+		if !re.MatchString(apiKey) {
+			return "", fmt.Errorf("API token does not match the expected format %s, "+
+				"make sure it is a Hetzner DNS API token and not a placeholder or a Hetzner Cloud token", pattern)
+		}
+	}
+
+	return apiKey, nil
+}
+
+// recordName returns the name of the challenge record for the entry
+// derived from the challenge, applying RecordName or RecordNamePrefix.
+func recordName(cfg hetznerDNSProviderConfig, entry string) string {
+	if cfg.RecordName != "" {
+		return normalizeName(cfg.RecordName)
+	}
+	if entry == "@" && cfg.RecordNamePrefix != "" {
+		return normalizeName(cfg.RecordNamePrefix)
+	}
+	return normalizeName(cfg.RecordNamePrefix + entry)
+}
+
+// recordNameData holds the fields RecordNameTemplate is evaluated with.
+type recordNameData struct {
+	// Entry is the name of the record derived from the challenge, relative
+	// to Zone, or "@" at the apex.
+	Entry string
+	Zone  string
+	// DNSName is the name the certificate is requested for, FQDN the name
+	// of the challenge record, usually _acme-challenge.<DNSName>.
+	DNSName string
+	FQDN    string
+	// Namespace is the namespace of the Issuer or Certificate of the
+	// challenge.
+	Namespace string
+}
+
+// challengeRecordName returns the name of the challenge record for the
+// entry derived from the challenge in zone: RecordNameTemplate rendered if
+// it is set, or else the name recordName returns, with the RecordNameSuffix
+// of the zone appended.
+func challengeRecordName(cfg hetznerDNSProviderConfig, ch *v1alpha1.ChallengeRequest, entry, zone string) (string, error) {
+	if cfg.RecordNameTemplate == "" {
+		return appendRecordNameSuffix(cfg, recordName(cfg, entry), zone), nil
+	}
+	name, err := renderRecordName(cfg.RecordNameTemplate, recordNameData{
+		Entry:     entry,
+		Zone:      zone,
+		DNSName:   normalizeName(ch.DNSName),
+		FQDN:      normalizeName(ch.ResolvedFQDN),
+		Namespace: ch.ResourceNamespace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering recordNameTemplate: %v", err)
+	}
+	return appendRecordNameSuffix(cfg, name, zone), nil
+}
+
+// appendRecordNameSuffix appends the RecordNameSuffix configured for zone
+// to the record name. At the apex the suffix replaces the name, without
+// its leading separator.
+func appendRecordNameSuffix(cfg hetznerDNSProviderConfig, name, zone string) string {
+	for z, suffix := range cfg.RecordNameSuffix {
+		if !sameName(z, zone) {
+			continue
+		}
+		if name == "@" {
+			return normalizeName(strings.TrimLeft(suffix, "."))
+		}
+		return normalizeName(name + suffix)
+	}
+	return name
+}
+
+// renderRecordName evaluates the record name template tmpl with data. The
+// result must be a name relative to the zone.
+func renderRecordName(tmpl string, data recordNameData) (string, error) {
+	t, err := template.New("recordNameTemplate").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	name := normalizeName(strings.TrimSpace(b.String()))
+	if name == "" || strings.ContainsAny(name, " \t\r\n") || strings.Contains(name, "..") {
+		return "", fmt.Errorf("%q is not a valid record name", b.String())
+	}
+	return name, nil
+}
+
+// getDomainAndEntry returns the name of the challenge record relative to
+// its zone, and the zone, in the ASCII form the API stores them in. The
+// record name is lowercase, while an ASCII zone keeps the case of the
+// challenge's resolved zone. It fails if the resolved FQDN of the challenge
+// is not in its resolved zone.
+func (c *hetznerDNSProviderSolver) getDomainAndEntry(ch *v1alpha1.ChallengeRequest) (string, string, error) {
+	// The API stores internationalized names in punycode, while either
+	// name of the challenge may be in Unicode.
+	fqdn, err := toASCII(normalizeName(ch.ResolvedFQDN))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid FQDN %s: %v", ch.ResolvedFQDN, err)
+	}
+	zone, err := toASCII(normalizeName(ch.ResolvedZone))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid zone %s: %v", ch.ResolvedZone, err)
+	}
+	if zone == "" {
+		return "", "", fmt.Errorf("no zone resolved for %s", ch.ResolvedFQDN)
+	}
+
+	// Challenges for a wildcard name are validated at the name without the
+	// wildcard label (RFC 8555, section 8.4), which cert-manager usually
+	// resolves the FQDN to already, e.g. _acme-challenge.example.com for
+	// *.example.com. An FQDN still carrying the wildcard label is mapped to
+	// that name as well, so that the record isn't created at a literal '*'.
+	if labels := strings.Split(fqdn, "."); len(labels) > 1 && strings.Contains(fqdn, "*") {
+		kept := labels[:0]
+		for _, label := range labels {
+			if label != "*" {
+				kept = append(kept, label)
+			}
+		}
+		klog.V(2).Infof("removing the wildcard label from FQDN %s", ch.ResolvedFQDN)
+		fqdn = strings.Join(kept, ".")
+	}
+
+	// The API names records at the apex of a zone '@'
+	entry := "@"
+	if fqdn != zone {
+		if !strings.HasSuffix(fqdn, "."+zone) {
+			return "", "", fmt.Errorf("FQDN %s is not in zone %s", ch.ResolvedFQDN, ch.ResolvedZone)
+		}
+		entry = strings.TrimSuffix(fqdn, "."+zone)
+	}
+
+	// StrictZoneNameCase compares zone names in the case cert-manager
+	// resolved the zone in
+	if resolved := strings.TrimRight(ch.ResolvedZone, "."); strings.EqualFold(resolved, zone) {
+		zone = resolved
+	}
+	return entry, zone, nil
 }
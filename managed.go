@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// managedRecordsEndpointEnv enables the /managed-records endpoint when set
+// to "true".
+const managedRecordsEndpointEnv = "MANAGED_RECORDS_ENDPOINT"
+
+// defaultManagedRecordsLimit is the number of records the endpoint returns
+// unless the limit parameter is given, maxManagedRecordsLimit the most it
+// returns.
+const (
+	defaultManagedRecordsLimit = 100
+	maxManagedRecordsLimit     = 1000
+)
+
+// managedRecord is a challenge record listed by the /managed-records
+// endpoint.
+type managedRecord struct {
+	Zone  string `json:"zone"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Owned is set if the record has an owner marker of this webhook.
+	Owned bool `json:"owned"`
+}
+
+// managedRecords is the response of the /managed-records endpoint.
+type managedRecords struct {
+	Records []managedRecord `json:"records"`
+	// Total is the number of records found, Offset and Limit the page of
+	// them in Records.
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// managedRecordsHandler lists the challenge TXT records present in the zones
+// of the API token from the environment, to spot records left behind by
+// failed cleanups. It only reads from the API. The zone parameter limits
+// the listing to one zone, offset and limit page through the records.
+type managedRecordsHandler struct {
+	solver *hetznerDNSProviderSolver
+}
+
+func (h managedRecordsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultManagedRecordsLimit)
+	if err != nil || limit < 1 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxManagedRecordsLimit {
+		limit = maxManagedRecordsLimit
+	}
+
+	records, err := h.solver.listManagedRecords(req.Context(), query.Get("zone"))
+	if err != nil {
+		klog.Errorf("failed to list managed records: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp := managedRecords{Records: []managedRecord{}, Total: len(records), Offset: offset, Limit: limit}
+	if offset < len(records) {
+		end := offset + limit
+		if end > len(records) {
+			end = len(records)
+		}
+		resp.Records = records[offset:end]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// queryInt parses the integer query parameter s, def if it is empty.
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// listManagedRecords returns the challenge TXT records in the zones of the
+// API token from the environment, or only in the given zone. Records count
+// as challenge records if their name starts with the _acme-challenge label
+// or they have an owner marker.
+func (c *hetznerDNSProviderSolver) listManagedRecords(ctx context.Context, zone string) ([]managedRecord, error) {
+	cfg, err := loadConfigWithDefaults(nil, c.defaults)
+	if err != nil {
+		return nil, err
+	}
+	client, err := c.newClient(ctx, cfg, &v1alpha1.ChallengeRequest{}, zone)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := client.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []managedRecord
+	for _, z := range zones {
+		if zone != "" && !sameName(z.Name, zone) {
+			continue
+		}
+		records, err := client.ListRecords(ctx, z.ZoneID)
+		if err != nil {
+			return nil, fmt.Errorf("listing records of zone %s failed: %w", z.Name, err)
+		}
+		o, records := newOwnership(cfg.OwnerMarker, records)
+		for _, e := range records {
+			if e.Type != "TXT" {
+				continue
+			}
+			_, marked := o.markerOf(e)
+			name := normalizeName(e.Name)
+			if !marked && name != "_acme-challenge" && !strings.HasPrefix(name, "_acme-challenge.") {
+				continue
+			}
+			found = append(found, managedRecord{Zone: z.Name, ID: e.ID, Name: e.Name, Value: e.Value, Owned: marked})
+		}
+	}
+	return found, nil
+}
+
+// managedRecordsEndpointEnabled reports whether the /managed-records
+// endpoint is served.
+func managedRecordsEndpointEnabled() bool {
+	return os.Getenv(managedRecordsEndpointEnv) == "true"
+}
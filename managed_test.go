@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagedRecordsHandler(t *testing.T) {
+	os.Setenv(apiTokenEnv, "token")
+	defer os.Unsetenv(apiTokenEnv)
+
+	records := append(withOwnerMarkers(Entry{ID: "a", Name: "_acme-challenge", Type: "TXT", Value: "leaked", ZoneID: "zone1"}),
+		Entry{ID: "b", Name: "_acme-challenge.sub", Type: "TXT", Value: "other", ZoneID: "zone2"},
+		Entry{ID: "c", Name: "_acme-challenge.www", Type: "TXT", Value: "manual", ZoneID: "zone1"},
+		Entry{ID: "d", Name: "www", Type: "A", Value: "192.0.2.1", ZoneID: "zone1"},
+		Entry{ID: "e", Name: "@", Type: "TXT", Value: "v=spf1 -all", ZoneID: "zone1"},
+	)
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2"}, records...)
+	defer srv.Close()
+	handler := managedRecordsHandler{solver: &hetznerDNSProviderSolver{apiURL: srv.URL}}
+
+	get := func(target string) (int, managedRecords) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		var resp managedRecords
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		}
+		return rec.Code, resp
+	}
+
+	code, resp := get("/managed-records")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, resp.Total)
+	assert.ElementsMatch(t, []managedRecord{
+		{Zone: "example.com", ID: "a", Name: "_acme-challenge", Value: "leaked", Owned: true},
+		{Zone: "example.com", ID: "c", Name: "_acme-challenge.www", Value: "manual"},
+		{Zone: "example.org", ID: "b", Name: "_acme-challenge.sub", Value: "other"},
+	}, resp.Records)
+
+	code, resp = get("/managed-records?zone=example.org.")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []managedRecord{{Zone: "example.org", ID: "b", Name: "_acme-challenge.sub", Value: "other"}}, resp.Records)
+
+	code, resp = get("/managed-records?offset=1&limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp.Records, 1)
+	assert.Equal(t, 3, resp.Total)
+	assert.Equal(t, 1, resp.Limit)
+
+	code, resp = get("/managed-records?offset=5")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Records)
+
+	code, _ = get("/managed-records?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/managed-records", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	for _, r := range m.requests {
+		assert.Contains(t, r, "GET ", "the endpoint must not change records")
+	}
+}
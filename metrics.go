@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "cert_manager_webhook_hetzner"
+
+// metricsAddrEnv is the environment variable holding the address the
+// metrics and health endpoints are served on, defaultMetricsAddr is used
+// if it is not set.
+const (
+	metricsAddrEnv     = "METRICS_ADDR"
+	defaultMetricsAddr = ":8080"
+)
+
+var (
+	challengesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "challenges_total",
+		Help:      "Number of Present and CleanUp calls by result.",
+	}, []string{"action", "result"})
+
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of Hetzner DNS API requests by operation and HTTP status code.",
+	}, []string{"operation", "code"})
+
+	apiRequestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_errors_total",
+		Help:      "Number of failed Hetzner DNS API requests by operation.",
+	}, []string{"operation"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of Hetzner DNS API requests by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	apiRateLimitLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_rate_limit_limit",
+		Help:      "Number of Hetzner DNS API requests allowed in the current rate limit window, as last reported by the API.",
+	})
+
+	apiRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_rate_limit_remaining",
+		Help:      "Number of Hetzner DNS API requests left in the current rate limit window, as last reported by the API.",
+	})
+
+	recordPropagationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_propagation_seconds",
+		Help:      "Time until a presented record was visible when waiting for its propagation, by zone and source.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600},
+	}, []string{"zone", "source"})
+
+	apiCircuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_circuit_breaker_state",
+		Help:      "State of the circuit breaker of requests to a Hetzner DNS API URL: 0 closed, 1 half-open, 2 open.",
+	}, []string{"api_url"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		challengesTotal,
+		apiRequestsTotal,
+		apiRequestErrorsTotal,
+		apiRequestDuration,
+		apiRateLimitLimit,
+		apiRateLimitRemaining,
+		recordPropagationDuration,
+		apiCircuitBreakerState,
+	)
+}
+
+// apiOperation returns the operation label of an API request to the given
+// URL path.
+func apiOperation(method, urlPath string) string {
+	switch {
+	case method == "GET" && strings.HasSuffix(urlPath, "/zones"):
+		return "zone_lookup"
+	case method == "GET" && strings.HasSuffix(urlPath, "/records"):
+		return "list_records"
+	case method == "POST" && strings.HasSuffix(urlPath, "/records"):
+		return "create"
+	case method == "DELETE" && strings.HasSuffix(path.Dir(urlPath), "/records"):
+		return "delete"
+	default:
+		return "other"
+	}
+}
+
+// withMetrics records the outcome and latency of every request.
+func withMetrics() middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			observeAPIRequest(apiOperation(req.Method, req.URL.Path), start, resp, err)
+			if err == nil {
+				observeRateLimit(resp.Header)
+			}
+			return resp, err
+		})
+	}
+}
+
+// observeAPIRequest records the outcome of a single API request. A request
+// fails if it returns an error or a non-2xx status code.
+func observeAPIRequest(operation string, start time.Time, resp *http.Response, err error) {
+	apiRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiRequestErrorsTotal.WithLabelValues(operation).Inc()
+		return
+	}
+	apiRequestsTotal.WithLabelValues(operation, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiRequestErrorsTotal.WithLabelValues(operation).Inc()
+	}
+}
+
+// rateLimitWarningFraction is the fraction of the rate limit below which
+// the remaining requests are logged as a warning.
+const rateLimitWarningFraction = 0.1
+
+// rateLimitQuota is the rate limit state reported by the API.
+type rateLimitQuota struct {
+	Limit     int
+	Remaining int
+	// Reset is the time until the current window ends, 0 if unknown.
+	Reset time.Duration
+}
+
+// parseRateLimit returns the rate limit state from the RateLimit-* headers
+// of a response, or their X-RateLimit-* variants, if it has them.
+func parseRateLimit(header http.Header) (rateLimitQuota, bool) {
+	get := func(name string) (int, bool) {
+		value := header.Get("RateLimit-" + name)
+		if value == "" {
+			value = header.Get("X-RateLimit-" + name)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		return n, err == nil && n >= 0
+	}
+
+	limit, ok := get("Limit")
+	if !ok {
+		return rateLimitQuota{}, false
+	}
+	remaining, ok := get("Remaining")
+	if !ok {
+		return rateLimitQuota{}, false
+	}
+	quota := rateLimitQuota{Limit: limit, Remaining: remaining}
+	if reset, ok := get("Reset"); ok {
+		quota.Reset = time.Duration(reset) * time.Second
+	}
+	return quota, true
+}
+
+// observeRateLimit records the rate limit state reported in the headers of
+// a response, warning when few requests are left.
+func observeRateLimit(header http.Header) {
+	quota, ok := parseRateLimit(header)
+	if !ok {
+		return
+	}
+	apiRateLimitLimit.Set(float64(quota.Limit))
+	apiRateLimitRemaining.Set(float64(quota.Remaining))
+	if float64(quota.Remaining) < rateLimitWarningFraction*float64(quota.Limit) {
+		klog.Warningf("only %d of %d API requests left before hitting the rate limit, the window resets in %v", quota.Remaining, quota.Limit, quota.Reset)
+	}
+}
+
+// Sources of the record_propagation_seconds metric: the records listed by
+// the API, or the nameservers in propagationNameservers.
+const (
+	propagationSourceAPI = "api"
+	propagationSourceDNS = "dns"
+)
+
+// observePropagation records the time since start it took until a record
+// in zone was visible at source.
+func observePropagation(zone, source string, start time.Time) {
+	recordPropagationDuration.WithLabelValues(zone, source).Observe(time.Since(start).Seconds())
+}
+
+// observeChallenge records the result of a Present or CleanUp call.
+func observeChallenge(action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	challengesTotal.WithLabelValues(action, result).Inc()
+}
+
+// metricsAddr returns the address the metrics and health endpoints are
+// served on.
+func metricsAddr() (string, error) {
+	addr := strings.TrimSpace(os.Getenv(metricsAddrEnv))
+	if addr == "" {
+		return defaultMetricsAddr, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", metricsAddrEnv, err)
+	}
+	return addr, nil
+}
+
+// serveMetrics serves the metrics endpoint, and the given handlers by their
+// paths, e.g. /readyz and /livez, until stopCh is closed.
+func serveMetrics(addr string, handlers map[string]http.Handler, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-stopCh
+		if err := srv.Shutdown(context.Background()); err != nil {
+			klog.Errorf("failed to shut down metrics server: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("failed to serve metrics on %s: %v", addr, err)
+		}
+	}()
+}
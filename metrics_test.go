@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_ChallengeOperations(t *testing.T) {
+	challengesTotal.Reset()
+	apiRequestsTotal.Reset()
+	apiRequestErrorsTotal.Reset()
+	apiRequestDuration.Reset()
+
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", `{"apiKey": "token"}`)))
+	assert.Error(t, solver.Present(newChallengeRequest("key", `{"apiKey": "wrong"}`)))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(challengesTotal.WithLabelValues("present", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(challengesTotal.WithLabelValues("present", "failure")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(challengesTotal.WithLabelValues("cleanup", "success")))
+
+	// CleanUp deletes the record presented before and its owner marker by
+	// their IDs
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiRequestsTotal.WithLabelValues("zone_lookup", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiRequestsTotal.WithLabelValues("zone_lookup", "401")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(apiRequestsTotal.WithLabelValues("create", "200")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(apiRequestsTotal.WithLabelValues("delete", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiRequestErrorsTotal.WithLabelValues("zone_lookup")))
+	assert.Equal(t, 4, testutil.CollectAndCount(apiRequestDuration))
+}
+
+func TestMetrics_RecordPropagation(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = time.Millisecond
+	recordPropagationDuration.Reset()
+
+	_, restore := useStubTXT(map[string][]string{"192.0.2.1:53 _acme-challenge.example.org.": {"key"}})
+	defer restore()
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key0", `{"apiKey": "token"}`)))
+	assert.Equal(t, 0, testutil.CollectAndCount(recordPropagationDuration), "nothing must be recorded without waiting for propagation")
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token", "propagationSeconds": 5}`)))
+	ch := newChallengeRequest("key", `{"apiKey": "token", "propagationSeconds": 5, "propagationNameservers": ["192.0.2.1"]}`)
+	ch.ResolvedFQDN = "_acme-challenge.example.org."
+	ch.ResolvedZone = "example.org."
+	assert.NoError(t, solver.Present(ch))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(recordPropagationDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(recordPropagationDuration.WithLabelValues("example.com", propagationSourceAPI).(prometheus.Histogram)))
+	assert.Equal(t, 1, testutil.CollectAndCount(recordPropagationDuration.WithLabelValues("example.org", propagationSourceDNS).(prometheus.Histogram)))
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		header http.Header
+		quota  rateLimitQuota
+		ok     bool
+	}{
+		{http.Header{"Ratelimit-Limit": {"42"}, "Ratelimit-Remaining": {"41"}, "Ratelimit-Reset": {"1"}}, rateLimitQuota{42, 41, time.Second}, true},
+		{http.Header{"X-Ratelimit-Limit": {"3600"}, "X-Ratelimit-Remaining": {"12"}}, rateLimitQuota{3600, 12, 0}, true},
+		{http.Header{"Ratelimit-Limit": {"42"}}, rateLimitQuota{}, false},
+		{http.Header{"Ratelimit-Limit": {"many"}, "Ratelimit-Remaining": {"1"}}, rateLimitQuota{}, false},
+		{http.Header{}, rateLimitQuota{}, false},
+	} {
+		quota, ok := parseRateLimit(tt.header)
+		assert.Equal(t, tt.ok, ok, "%v", tt.header)
+		assert.Equal(t, tt.quota, quota, "%v", tt.header)
+	}
+}
+
+func TestObserveRateLimit(t *testing.T) {
+	logs, restore := captureLogs(0)
+	observeRateLimit(http.Header{"Ratelimit-Limit": {"100"}, "Ratelimit-Remaining": {"50"}})
+	assert.Equal(t, float64(100), testutil.ToFloat64(apiRateLimitLimit))
+	assert.Equal(t, float64(50), testutil.ToFloat64(apiRateLimitRemaining))
+	assert.Empty(t, logs.String())
+
+	observeRateLimit(http.Header{"Ratelimit-Limit": {"100"}, "Ratelimit-Remaining": {"9"}, "Ratelimit-Reset": {"30"}})
+	restore()
+	assert.Equal(t, float64(9), testutil.ToFloat64(apiRateLimitRemaining))
+	assert.Contains(t, logs.String(), "only 9 of 100 API requests left before hitting the rate limit, the window resets in 30s")
+}
+
+func TestMetricsAddr(t *testing.T) {
+	os.Unsetenv(metricsAddrEnv)
+	addr, err := metricsAddr()
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", addr)
+
+	os.Setenv(metricsAddrEnv, "127.0.0.1:9090")
+	defer os.Unsetenv(metricsAddrEnv)
+	addr, err = metricsAddr()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", addr)
+
+	os.Setenv(metricsAddrEnv, "9090")
+	_, err = metricsAddr()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid METRICS_ADDR")
+}
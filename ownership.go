@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// defaultOwnerMarker marks the records created by the webhook unless the
+// config sets another marker, or disables marking with ownerMarkerNone.
+const (
+	defaultOwnerMarker = "cert-manager-webhook-hetzner"
+	ownerMarkerNone    = "none"
+)
+
+// ownerMarkerPattern matches valid owner markers.
+var ownerMarkerPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ownerMarkerValue returns the value of the TXT record marking the record
+// with the given value as created by the webhook. The API has no comment
+// field, so ownership is recorded in a TXT record next to the record,
+// whose value is the marker and a hash of the record's value. ACME
+// validation ignores TXT records with other values.
+func ownerMarkerValue(marker, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return marker + "=" + hex.EncodeToString(sum[:8])
+}
+
+// ownership tells the records created by the webhook apart from others by
+// their owner markers.
+type ownership struct {
+	// marker is the owner marker, empty if marking is disabled.
+	marker string
+	// markers maps the values of the marker records to the records.
+	markers map[string]Entry
+}
+
+// newOwnership returns the ownership of records with the given marker, and
+// records without the marker records. An empty marker disables marking and
+// makes all records count as owned.
+func newOwnership(marker string, records []Entry) (ownership, []Entry) {
+	o := ownership{marker: marker, markers: map[string]Entry{}}
+	if marker == "" {
+		return o, records
+	}
+	var others []Entry
+	for _, e := range records {
+		if e.Type == "TXT" && strings.HasPrefix(e.Value, marker+"=") {
+			o.markers[e.Value] = e
+			continue
+		}
+		others = append(others, e)
+	}
+	return o, others
+}
+
+// owns reports whether e was created by the webhook.
+func (o ownership) owns(e Entry) bool {
+	if o.marker == "" {
+		return true
+	}
+	_, ok := o.markers[ownerMarkerValue(o.marker, e.Value)]
+	return ok
+}
+
+// markerOf returns the marker record of e, if it has one.
+func (o ownership) markerOf(e Entry) (Entry, bool) {
+	if o.marker == "" {
+		return Entry{}, false
+	}
+	marker, ok := o.markers[ownerMarkerValue(o.marker, e.Value)]
+	return marker, ok
+}
+
+// markRecord creates the marker record for the record e unless it exists,
+// returning its ID. Failing to create it only leaves the record unmarked,
+// so it is logged instead of failing the challenge.
+func markRecord(ctx context.Context, client *HetznerClient, o ownership, e Entry) string {
+	if o.marker == "" {
+		return ""
+	}
+	if marker, ok := o.markerOf(e); ok {
+		return marker.ID
+	}
+	marker, err := client.CreateRecord(ctx, Entry{
+		Name:   e.Name,
+		TTL:    e.TTL,
+		Type:   "TXT",
+		Value:  ownerMarkerValue(o.marker, e.Value),
+		ZoneID: e.ZoneID,
+	})
+	if err != nil {
+		klog.Warningf("failed to create the owner marker of record %s named %s, it won't be purged: %v", e.ID, e.Name, err)
+		return ""
+	}
+	klog.V(4).Infof("created owner marker %s of record %s", marker.ID, e.ID)
+	return marker.ID
+}
+
+// deleteMarker deletes the marker record with the given ID, if any, after
+// the record it marks was deleted. A marker left behind is harmless, so
+// failures are only logged.
+func deleteMarker(ctx context.Context, client *HetznerClient, id string) {
+	if id == "" {
+		return
+	}
+	if err := client.DeleteRecord(ctx, id); err != nil && !isNotFound(err) {
+		klog.Warningf("failed to delete owner marker %s: %v", id, err)
+	}
+}
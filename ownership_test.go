@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestOwnership(t *testing.T) {
+	owned := Entry{ID: "a", Name: "_acme-challenge", Type: "TXT", Value: "owned"}
+	manual := Entry{ID: "b", Name: "_acme-challenge", Type: "TXT", Value: "manual"}
+	marker := Entry{ID: "c", Name: "_acme-challenge", Type: "TXT", Value: ownerMarkerValue("owner", "owned")}
+	other := Entry{ID: "d", Name: "_acme-challenge", Type: "TXT", Value: ownerMarkerValue("other", "manual")}
+
+	o, records := newOwnership("owner", []Entry{owned, manual, marker, other})
+	assert.Equal(t, []Entry{owned, manual, other}, records, "only markers with the marker must be split off")
+	assert.True(t, o.owns(owned))
+	assert.False(t, o.owns(manual))
+	got, ok := o.markerOf(owned)
+	assert.True(t, ok)
+	assert.Equal(t, marker, got)
+	_, ok = o.markerOf(manual)
+	assert.False(t, ok)
+
+	// without marker all records count as owned
+	o, records = newOwnership("", []Entry{owned, manual, marker})
+	assert.Equal(t, []Entry{owned, manual, marker}, records)
+	assert.True(t, o.owns(manual))
+	_, ok = o.markerOf(owned)
+	assert.False(t, ok)
+}
+
+func TestPresentAndCleanUp_OwnerMarker(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	config := `{"apiKey": "token", "ownerMarker": "my-webhook"}`
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", config)))
+	assert.Equal(t, Entry{
+		ID:     "new-2",
+		Name:   "_acme-challenge",
+		TTL:    300,
+		Type:   "TXT",
+		Value:  ownerMarkerValue("my-webhook", "key"),
+		ZoneID: "zone1",
+	}, m.records["new-2"])
+
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", config)))
+	assert.Empty(t, m.records, "the owner marker must be deleted along with the record")
+
+	// without marking only the challenge record is created
+	config = `{"apiKey": "token", "ownerMarker": "none"}`
+	assert.NoError(t, solver.Present(newChallengeRequest("key", config)))
+	assert.Len(t, m.records, 1)
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", config)))
+	assert.Empty(t, m.records)
+}
+
+func TestLoadConfig_OwnerMarker(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		marker string
+		err    string
+	}{
+		{`{"apiKey": "token"}`, defaultOwnerMarker, ""},
+		{`{"apiKey": "token", "ownerMarker": " my.webhook_1 "}`, "my.webhook_1", ""},
+		{`{"apiKey": "token", "ownerMarker": "none"}`, "", ""},
+		{`{"apiKey": "token", "recordType": "CNAME"}`, "", ""},
+		{`{"apiKey": "token", "ownerMarker": "a=b"}`, "", `ownerMarker must consist of up to 64 letters, digits, '.', '_' and '-' but is "a=b"`},
+	} {
+		cfg, err := loadConfig(&extapi.JSON{Raw: []byte(tt.config)})
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.config)
+			continue
+		}
+		assert.NoError(t, err, tt.config)
+		assert.Equal(t, tt.marker, cfg.OwnerMarker, tt.config)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// propagationPollInterval is the time between two lookups of waitForRecord.
+var propagationPollInterval = 2 * time.Second
+
+// ErrPropagationTimeout is returned by waitForRecord when the record isn't
+// listed before the timeout elapses, as opposed to the API failing.
+var ErrPropagationTimeout = errors.New("record not visible in time")
+
+// waitForRecord polls the records of the zone until a record with the name,
+// type and value of want is listed, or until timeout elapses. Transient
+// failures of the lookups, like server errors or network errors, are retried
+// until then, other API errors are returned right away. When the record
+// doesn't show up in time, the error wraps ErrPropagationTimeout.
+func waitForRecord(ctx context.Context, client *HetznerClient, zoneID string, want Entry, zone string, timeout time.Duration) error {
+	name := want.Name
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		records, err := client.ListRecordsByName(ctx, zoneID, name)
+		switch {
+		case err == nil:
+			lastErr = nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case !isTransientError(err):
+			return fmt.Errorf("checking propagation of record %s in zone %s failed: %w", name, zone, err)
+		default:
+			klog.V(2).Infof("error checking propagation of record %s in zone %s, retrying: %v", name, zone, err)
+			lastErr = err
+		}
+		for _, e := range records {
+			if e.Type == want.Type && sameName(e.Name, name) && e.Value == want.Value {
+				klog.V(2).Infof("record %s in zone %s is visible", name, zone)
+				return nil
+			}
+		}
+
+		wait := propagationPollInterval
+		if remaining := time.Until(deadline); remaining <= 0 {
+			if lastErr != nil {
+				return fmt.Errorf("%w: record %s in zone %s not visible after %v, the last lookup failed: %v", ErrPropagationTimeout, name, zone, timeout, lastErr)
+			}
+			return fmt.Errorf("%w: record %s in zone %s not visible after %v", ErrPropagationTimeout, name, zone, timeout)
+		} else if remaining < wait {
+			wait = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// lookupTXT returns the TXT values of fqdn served by the nameserver at addr,
+// replaced in tests.
+var lookupTXT = func(ctx context.Context, addr, fqdn string) ([]string, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return r.LookupTXT(ctx, fqdn)
+}
+
+// waitForRecordInDNS queries each of the nameservers until all of them
+// serve a TXT record for fqdn with the given value, or until timeout
+// elapses, like the ACME server validating the challenge would. Failed
+// queries, e.g. because the name doesn't exist yet, are retried until then.
+// When the record doesn't show up in time, the error wraps
+// ErrPropagationTimeout and names the nameservers lacking it.
+func waitForRecordInDNS(ctx context.Context, nameservers []string, fqdn, value string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pending := map[string]error{}
+	for _, ns := range nameservers {
+		pending[ns] = nil
+	}
+	for {
+		for ns := range pending {
+			values, err := lookupTXT(ctx, ns, fqdn)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			pending[ns] = err
+			if err != nil {
+				klog.V(4).Infof("error looking up %s at %s, retrying: %v", fqdn, ns, err)
+				continue
+			}
+			for _, v := range values {
+				if v == value {
+					klog.V(2).Infof("record %s is served by %s", fqdn, ns)
+					delete(pending, ns)
+					break
+				}
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		wait := propagationPollInterval
+		if remaining := time.Until(deadline); remaining <= 0 {
+			var missing []string
+			for ns, err := range pending {
+				if err != nil {
+					ns = fmt.Sprintf("%s (%v)", ns, err)
+				}
+				missing = append(missing, ns)
+			}
+			sort.Strings(missing)
+			return fmt.Errorf("%w: record %s not served after %v by %s", ErrPropagationTimeout, fqdn, timeout, strings.Join(missing, ", "))
+		} else if remaining < wait {
+			wait = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nameserverAddr returns the address of a nameserver given as a host with
+// an optional port, defaulting to port 53.
+func nameserverAddr(ns string) string {
+	if _, _, err := net.SplitHostPort(ns); err == nil {
+		return ns
+	}
+	return net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+}
+
+// isTransientError reports whether err may go away when the request is
+// repeated, i.e. it is a network error, rate limiting, a server error or a
+// transient authentication failure.
+func isTransientError(err error) bool {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return !errors.Is(err, ErrResponseTooLarge)
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500 || apiErr.transientAuth
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newLaggingServer returns a server listing the TXT record _acme-challenge
+// with value key only from the given list request on.
+func newLaggingServer(visibleFrom int32) (*httptest.Server, *int32) {
+	var lists int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := Entries{Records: []Entry{}}
+		if atomic.AddInt32(&lists, 1) >= visibleFrom {
+			entries.Records = append(entries.Records, Entry{ID: "record1", Name: "_acme-challenge", Type: "TXT", Value: "key"})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	return srv, &lists
+}
+
+func TestWaitForRecord(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = time.Millisecond
+
+	srv, lists := newLaggingServer(3)
+	defer srv.Close()
+
+	err := waitForRecord(context.Background(), NewHetznerClient(srv.URL, "token"), "zone1", Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"}, "example.com", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(lists))
+}
+
+func TestWaitForRecord_RetriesFailedLookups(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = time.Millisecond
+
+	// the first two polls fail, the record appears on the third one
+	var lists int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&lists, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Entries{Records: []Entry{{ID: "record1", Name: "_acme-challenge", Type: "TXT", Value: "key"}}})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.maxRetries = -1
+
+	err := waitForRecord(context.Background(), client, "zone1", Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"}, "example.com", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lists))
+}
+
+func TestWaitForRecord_Errors(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = time.Millisecond
+
+	status := http.StatusServiceUnavailable
+	var lists int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lists, 1)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.maxRetries = -1
+	want := Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"}
+
+	// transient failures until the end are a timeout
+	err := waitForRecord(context.Background(), client, "zone1", want, "example.com", 20*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrPropagationTimeout))
+	assert.Contains(t, err.Error(), "the last lookup failed: listing records of zone zone1 failed with HTTP 503 Service Unavailable")
+	assert.True(t, atomic.LoadInt32(&lists) > 1, "failed lookups must be retried")
+
+	// other API errors are returned right away
+	status = http.StatusUnauthorized
+	atomic.StoreInt32(&lists, 0)
+	err = waitForRecord(context.Background(), client, "zone1", want, "example.com", time.Minute)
+	assert.False(t, errors.Is(err, ErrPropagationTimeout))
+	assert.EqualError(t, err, "checking propagation of record _acme-challenge in zone example.com failed: listing records of zone zone1 failed with HTTP 401 Unauthorized")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lists))
+}
+
+func TestWaitForRecord_Timeout(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = 10 * time.Millisecond
+
+	srv, _ := newLaggingServer(1000)
+	defer srv.Close()
+
+	start := time.Now()
+	err := waitForRecord(context.Background(), NewHetznerClient(srv.URL, "token"), "zone1", Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"}, "example.com", 50*time.Millisecond)
+
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrPropagationTimeout))
+	assert.EqualError(t, err, "record not visible in time: record _acme-challenge in zone example.com not visible after 50ms")
+}
+
+// stubTXT replaces lookupTXT with a stub answering from the TXT values of
+// each nameserver and name, recording the queries.
+type stubTXT struct {
+	mu      sync.Mutex
+	values  map[string][]string // "nameserver fqdn" -> values
+	queries []string
+}
+
+func useStubTXT(values map[string][]string) (*stubTXT, func()) {
+	stub := &stubTXT{values: values}
+	old := lookupTXT
+	lookupTXT = func(ctx context.Context, addr, fqdn string) ([]string, error) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		stub.queries = append(stub.queries, addr+" "+fqdn)
+		values, ok := stub.values[addr+" "+fqdn]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: fqdn, Server: addr, IsNotFound: true}
+		}
+		return values, nil
+	}
+	return stub, func() { lookupTXT = old }
+}
+
+func (s *stubTXT) set(key string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = values
+}
+
+func TestWaitForRecordInDNS(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = 10 * time.Millisecond
+
+	stub, restore := useStubTXT(map[string][]string{
+		"ns1:53 _acme-challenge.example.com.": {"other", "key"},
+	})
+	defer restore()
+	nameservers := []string{"ns1:53", "ns2:53"}
+
+	// the second nameserver serves the record only later
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		stub.set("ns2:53 _acme-challenge.example.com.", "key")
+	}()
+	err := waitForRecordInDNS(context.Background(), nameservers, "_acme-challenge.example.com.", "key", time.Minute)
+	assert.NoError(t, err)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	ns1 := 0
+	for _, q := range stub.queries {
+		if q == "ns1:53 _acme-challenge.example.com." {
+			ns1++
+		}
+	}
+	assert.Equal(t, 1, ns1, "nameservers serving the record must not be queried again")
+}
+
+func TestWaitForRecordInDNS_Timeout(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = 10 * time.Millisecond
+
+	_, restore := useStubTXT(map[string][]string{
+		"ns1:53 _acme-challenge.example.com.": {"key"},
+		"ns2:53 _acme-challenge.example.com.": {"stale"},
+	})
+	defer restore()
+
+	err := waitForRecordInDNS(context.Background(), []string{"ns1:53", "ns2:53", "ns3:53"}, "_acme-challenge.example.com.", "key", 30*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrPropagationTimeout))
+	assert.EqualError(t, err, "record not visible in time: record _acme-challenge.example.com. not served after 30ms by "+
+		"ns2:53, ns3:53 (lookup _acme-challenge.example.com. on ns3:53: no such host)")
+}
+
+func TestPresent_PropagationNameservers(t *testing.T) {
+	defer func(d time.Duration) { propagationPollInterval = d }(propagationPollInterval)
+	propagationPollInterval = time.Millisecond
+
+	stub, restore := useStubTXT(map[string][]string{"192.0.2.1:53 _acme-challenge.example.com.": {"key"}})
+	defer restore()
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	err := solver.Present(newChallengeRequest("key", `{"apiKey": "token", "propagationSeconds": 5, "propagationNameservers": ["192.0.2.1"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1:53 _acme-challenge.example.com."}, stub.queries)
+	assert.Equal(t, 1, m.countRequests("GET /records"), "the records must only be listed before creating the record, not polled")
+}
+
+func TestNameserverAddr(t *testing.T) {
+	for ns, want := range map[string]string{
+		"192.0.2.1":        "192.0.2.1:53",
+		"192.0.2.1:5353":   "192.0.2.1:5353",
+		"ns1.example.com":  "ns1.example.com:53",
+		"2001:db8::1":      "[2001:db8::1]:53",
+		"[2001:db8::1]":    "[2001:db8::1]:53",
+		"[2001:db8::1]:54": "[2001:db8::1]:54",
+	} {
+		assert.Equal(t, want, nameserverAddr(ns), ns)
+	}
+}
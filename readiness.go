@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// validateAPITokenEnv disables validating the API token from the environment
+// on startup when set to "false", e.g. in air-gapped environments.
+const validateAPITokenEnv = "VALIDATE_API_TOKEN"
+
+// tokenCheckInterval is the time between attempts to validate the API token
+// from the environment, until one succeeds.
+var tokenCheckInterval = time.Minute
+
+// servingHealthURLEnv is the URL of the health endpoint of the webhook's
+// HTTPS server, e.g. https://127.0.0.1:8443/healthz. If set, the readiness
+// and liveness endpoints also fail while it does, so that they can take the
+// place of the probes of the HTTPS server.
+const servingHealthURLEnv = "SERVING_HEALTH_URL"
+
+// servingCheckTimeout bounds a single check of the HTTPS server.
+const servingCheckTimeout = 5 * time.Second
+
+// servingCheck checks the health endpoint of the webhook's HTTPS server.
+// Its zero value, and a nil one, never fails.
+type servingCheck struct {
+	url    string
+	client *http.Client
+}
+
+// newServingCheck returns the check of the URL in SERVING_HEALTH_URL, or nil
+// if it isn't set. The server's certificate isn't verified, since it is
+// issued for the webhook's service and not the address probed.
+func newServingCheck() (*servingCheck, error) {
+	rawURL := strings.TrimSpace(os.Getenv(servingHealthURLEnv))
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s: %q is not an http or https URL", servingHealthURLEnv, rawURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &servingCheck{
+		url:    rawURL,
+		client: &http.Client{Transport: transport, Timeout: servingCheckTimeout},
+	}, nil
+}
+
+// check returns an error if the HTTPS server isn't healthy.
+func (s *servingCheck) check() error {
+	if s == nil || s.url == "" {
+		return nil
+	}
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("HTTPS server health check failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTPS server health check failed with HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// readiness reports the result of validating the API token from the
+// environment on the readiness endpoint, along with the health of the HTTPS
+// server if serving is set. Its zero value is ready.
+type readiness struct {
+	serving *servingCheck
+
+	mu  sync.Mutex
+	err error
+}
+
+func (r *readiness) set(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	err := r.err
+	r.mu.Unlock()
+
+	if err == nil {
+		err = r.serving.check()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// envTokenConfigured reports whether an API token is provided through the
+// environment.
+func envTokenConfigured() bool {
+	return os.Getenv(apiTokenEnv) != "" || os.Getenv(apiTokenFileEnv) != ""
+}
+
+// startTokenValidation validates the API token from the environment in the
+// background, retrying every tokenCheckInterval until it succeeds or stopCh
+// is closed. The webhook is not ready until the token was validated.
+func (c *hetznerDNSProviderSolver) startTokenValidation(stopCh <-chan struct{}) {
+	if !envTokenConfigured() || os.Getenv(validateAPITokenEnv) == "false" {
+		return
+	}
+	c.ready.set(errors.New("API token validation pending"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	go func() {
+		for {
+			err := c.validateEnvToken(ctx)
+			if err == nil {
+				c.ready.set(nil)
+				klog.Infof("validated the API token from the environment")
+				return
+			}
+			c.ready.set(fmt.Errorf("API token validation failed: %v", err))
+			klog.Errorf("failed to validate the API token from the environment, retrying in %v: %v", tokenCheckInterval, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tokenCheckInterval):
+			}
+		}
+	}()
+}
+
+// validateEnvToken checks the API token from the environment with a cheap
+// authenticated API call.
+func (c *hetznerDNSProviderSolver) validateEnvToken(ctx context.Context) error {
+	cfg, err := loadConfigWithDefaults(nil, c.defaults)
+	if err != nil {
+		return err
+	}
+	client, err := c.newClient(ctx, cfg, &v1alpha1.ChallengeRequest{}, "")
+	if err != nil {
+		return err
+	}
+	return client.ValidateToken(ctx)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readyzStatus returns the status code of the readiness endpoint, waiting
+// up to a second for it to become expected.
+func readyzStatus(r *readiness, expected int) int {
+	var code int
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if code = rec.Code; code == expected {
+			break
+		}
+	}
+	return code
+}
+
+func TestStartTokenValidation(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// without a token in the environment there is nothing to validate
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	solver.startTokenValidation(stopCh)
+	assert.Equal(t, http.StatusOK, readyzStatus(&solver.ready, http.StatusOK))
+
+	os.Setenv(apiTokenEnv, "token")
+	defer os.Unsetenv(apiTokenEnv)
+	solver = &hetznerDNSProviderSolver{apiURL: srv.URL}
+	solver.startTokenValidation(stopCh)
+	assert.Equal(t, http.StatusOK, readyzStatus(&solver.ready, http.StatusOK))
+
+	os.Setenv(apiTokenEnv, "wrong")
+	solver = &hetznerDNSProviderSolver{apiURL: srv.URL}
+	solver.startTokenValidation(stopCh)
+	assert.Equal(t, http.StatusServiceUnavailable, readyzStatus(&solver.ready, http.StatusServiceUnavailable))
+	err := solver.validateEnvToken(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "API token was rejected")
+
+	// the validation can be disabled
+	os.Setenv(validateAPITokenEnv, "false")
+	defer os.Unsetenv(validateAPITokenEnv)
+	solver = &hetznerDNSProviderSolver{apiURL: srv.URL}
+	solver.startTokenValidation(stopCh)
+	assert.Equal(t, http.StatusOK, readyzStatus(&solver.ready, http.StatusOK))
+}
+
+func TestHetznerClient_ValidateToken(t *testing.T) {
+	_, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+
+	assert.NoError(t, newTestClient(srv.URL).ValidateToken(context.Background()))
+
+	err := NewHetznerClient(srv.URL, "wrong").ValidateToken(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "API token was rejected")
+}
+
+func TestReadiness_Serving(t *testing.T) {
+	healthy := int32(1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "not healthy", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	os.Setenv(servingHealthURLEnv, srv.URL+"/healthz")
+	defer os.Unsetenv(servingHealthURLEnv)
+	serving, err := newServingCheck()
+	assert.NoError(t, err)
+	r := &readiness{serving: serving}
+	assert.Equal(t, http.StatusOK, readyzStatus(r, http.StatusOK))
+
+	atomic.StoreInt32(&healthy, 0)
+	assert.Equal(t, http.StatusServiceUnavailable, readyzStatus(r, http.StatusServiceUnavailable))
+
+	srv.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, readyzStatus(r, http.StatusServiceUnavailable))
+
+	os.Setenv(servingHealthURLEnv, "127.0.0.1:8443")
+	_, err = newServingCheck()
+	assert.EqualError(t, err, `invalid SERVING_HEALTH_URL: "127.0.0.1:8443" is not an http or https URL`)
+}
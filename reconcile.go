@@ -0,0 +1,44 @@
+package main
+
+// recordPlan holds the changes that converge the records with a name and
+// type to a desired set of values.
+type recordPlan struct {
+	// keep holds one record for each desired value that has one.
+	keep []Entry
+	// create holds the desired values without a record.
+	create []string
+	// delete holds the records with a value that isn't desired, and the
+	// duplicates of records in keep.
+	delete []Entry
+}
+
+// planRecords computes the minimal changes turning the records of the given
+// type and name into exactly one record for each of the desired values.
+// Records of other types and names are left alone.
+func planRecords(records []Entry, recordType, name string, desired []string) recordPlan {
+	wanted := make(map[string]bool, len(desired))
+	for _, value := range desired {
+		wanted[value] = true
+	}
+
+	var plan recordPlan
+	kept := map[string]bool{}
+	for _, e := range records {
+		if e.Type != recordType || !sameName(e.Name, name) {
+			continue
+		}
+		if wanted[e.Value] && !kept[e.Value] {
+			kept[e.Value] = true
+			plan.keep = append(plan.keep, e)
+			continue
+		}
+		plan.delete = append(plan.delete, e)
+	}
+	for _, value := range desired {
+		if !kept[value] {
+			kept[value] = true
+			plan.create = append(plan.create, value)
+		}
+	}
+	return plan
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanRecords(t *testing.T) {
+	txt := func(id, name, value string) Entry {
+		return Entry{ID: id, Name: name, Type: "TXT", Value: value}
+	}
+	records := []Entry{
+		txt("1", "_acme-challenge", "a"),
+		txt("2", "_acme-challenge", "b"),
+		txt("3", "_acme-challenge", "a"),
+		txt("4", "_acme-challenge.sub", "c"),
+		{ID: "5", Name: "_acme-challenge", Type: "CAA", Value: "c"},
+		txt("6", "_ACME-Challenge", "c"),
+	}
+
+	for _, tt := range []struct {
+		desired  []string
+		expected recordPlan
+	}{
+		{
+			desired: []string{"a"},
+			expected: recordPlan{
+				keep:   []Entry{records[0]},
+				delete: []Entry{records[1], records[2], records[5]},
+			},
+		},
+		{
+			desired: []string{"c", "d", "d"},
+			expected: recordPlan{
+				keep:   []Entry{records[5]},
+				create: []string{"d"},
+				delete: []Entry{records[0], records[1], records[2]},
+			},
+		},
+		{
+			desired: []string{"a", "b", "c"},
+			expected: recordPlan{
+				keep:   []Entry{records[0], records[1], records[5]},
+				delete: []Entry{records[2]},
+			},
+		},
+		{
+			desired: nil,
+			expected: recordPlan{
+				delete: []Entry{records[0], records[1], records[2], records[5]},
+			},
+		},
+	} {
+		assert.Equal(t, tt.expected, planRecords(records, "TXT", "_acme-challenge", tt.desired), "%v", tt.desired)
+	}
+
+	assert.Equal(t, recordPlan{create: []string{"a"}}, planRecords(nil, "TXT", "_acme-challenge", []string{"a"}))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recordIDTTL is how long the ID of a presented record is remembered, to
+// delete it on CleanUp without listing the records of its zone.
+const recordIDTTL = time.Hour
+
+// recordIDs maps presented records to their IDs. Its zero value is empty.
+type recordIDs struct {
+	mu      sync.Mutex
+	entries map[string]recordIDEntry
+}
+
+type recordIDEntry struct {
+	id      string
+	expires time.Time
+}
+
+// put remembers the record ID for key for recordIDTTL, dropping expired
+// entries.
+func (r *recordIDs) put(key, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.entries == nil {
+		r.entries = map[string]recordIDEntry{}
+	}
+	for k, entry := range r.entries {
+		if now.After(entry.expires) {
+			delete(r.entries, k)
+		}
+	}
+	r.entries[key] = recordIDEntry{id: id, expires: now.Add(recordIDTTL)}
+}
+
+// take returns and forgets the record ID for key, if it hasn't expired.
+func (r *recordIDs) take(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[key]
+	delete(r.entries, key)
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.id, true
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordIDs(t *testing.T) {
+	var ids recordIDs
+	_, ok := ids.take("a")
+	assert.False(t, ok)
+
+	ids.put("a", "id1")
+	ids.put("b", "id2")
+	id, ok := ids.take("a")
+	assert.True(t, ok)
+	assert.Equal(t, "id1", id)
+	_, ok = ids.take("a")
+	assert.False(t, ok, "an ID must only be taken once")
+
+	ids.entries["b"] = recordIDEntry{id: "id2", expires: time.Now().Add(-time.Second)}
+	_, ok = ids.take("b")
+	assert.False(t, ok, "expired IDs must not be returned")
+
+	ids.entries["c"] = recordIDEntry{id: "id3", expires: time.Now().Add(-time.Second)}
+	ids.put("d", "id4")
+	assert.NotContains(t, ids.entries, "c", "expired IDs must be dropped")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultMaxRetries      = 3
+	defaultRetryBaseDelay  = time.Second
+	defaultRetryJitter     = 0.5
+	defaultRetryMaxDelay   = 30 * time.Second
+	defaultRetryMaxElapsed = 2 * time.Minute
+)
+
+// withRetry retries requests with an exponential backoff starting at
+// baseDelay on network errors, rate limiting, server errors and transient
+// authentication failures, see isTransientAuthFailure. Responses to
+// idempotent requests are read in full before being returned, so that
+// bodies cut short, e.g. by a connection reset, are retried as well. Each delay
+// is extended by a random fraction of up to jitter of it, so that clients
+// failing at the same time don't retry in lockstep.
+//
+// No delay is longer than maxDelay, jitter included. Retries stop early when
+// the request's deadline would pass before the next attempt, or when it would
+// start more than maxElapsed after the first one, returning the result of the
+// last one. A maxDelay or maxElapsed of zero disables the respective bound.
+//
+// GET and DELETE are idempotent and retried freely. Other methods, i.e. the
+// POST creating a record, may have taken effect even if they failed, so they
+// are only retried if the connection was refused or reset, unless
+// retryNonIdempotent is set.
+func withRetry(maxRetries int, baseDelay, maxDelay, maxElapsed time.Duration, jitter float64, retryNonIdempotent bool) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			idempotent := req.Method == "GET" || req.Method == "DELETE" || retryNonIdempotent
+
+			start := time.Now()
+			delay := baseDelay
+			for attempt := 0; ; attempt++ {
+				attemptReq := req
+				if attempt > 0 && req.GetBody != nil {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					attemptReq = req.Clone(req.Context())
+					attemptReq.Body = body
+				}
+				resp, err := next.RoundTrip(attemptReq)
+				if err == nil && idempotent {
+					if err = bufferBody(resp); err != nil {
+						resp = nil
+					}
+				}
+
+				retry := false
+				switch {
+				case errors.Is(err, ErrResponseTooLarge):
+					// the same response is likely to be just as large
+				case err != nil:
+					retry = idempotent || isConnectionError(err)
+				case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+					retry = idempotent
+				case resp.StatusCode == http.StatusUnauthorized:
+					retry = idempotent && isTransientAuthResponse(resp)
+				}
+				if !retry || attempt >= maxRetries {
+					return resp, err
+				}
+
+				wait := withJitter(delay, jitter)
+				if maxDelay > 0 && wait > maxDelay {
+					wait = maxDelay
+				}
+				if maxElapsed > 0 && time.Since(start)+wait > maxElapsed {
+					klog.V(2).Infof("not retrying %s %s, the next attempt would start more than %v after the first one", req.Method, req.URL.Path, maxElapsed)
+					return resp, err
+				}
+				// a retry that can't finish before the deadline would only
+				// replace the last error with a less useful one
+				if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+					klog.V(2).Infof("not retrying %s %s, its deadline is in less than %v", req.Method, req.URL.Path, wait)
+					return resp, err
+				}
+				if err != nil {
+					klog.V(2).Infof("retrying %s %s in %v (attempt %d/%d): %v", req.Method, req.URL.Path, wait, attempt+1, maxRetries, err)
+				} else {
+					resp.Body.Close()
+					klog.V(2).Infof("retrying %s %s in %v (attempt %d/%d): got HTTP %s", req.Method, req.URL.Path, wait, attempt+1, maxRetries, resp.Status)
+				}
+
+				select {
+				case <-req.Context().Done():
+					if err == nil {
+						err = req.Context().Err()
+					}
+					return nil, err
+				case <-time.After(wait):
+				}
+				if maxDelay <= 0 || delay < maxDelay {
+					delay *= 2
+				}
+			}
+		})
+	}
+}
+
+// bufferBody reads the body of resp into memory, replacing it. Reading it
+// only fails if it was cut short or exceeds the client's maxResponseBytes.
+func bufferBody(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading the response (HTTP %s) failed after %d bytes: %w", resp.Status, len(body), err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// isConnectionError reports whether err indicates that a request never
+// reached the server.
+func isConnectionError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// withJitter returns d extended by a random fraction of up to jitter of it.
+func withJitter(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*jitter*float64(d))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyServer returns a server answering the first failures requests
+// with status and all others with 200.
+func newFlakyServer(failures int32, status int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	return srv, &calls
+}
+
+func newTestClient(apiURL string) *HetznerClient {
+	client := NewHetznerClient(apiURL, "token")
+	client.retryBaseDelay = time.Millisecond
+	return client
+}
+
+func TestWithRetry_RetriesIdempotentRequests(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		srv, calls := newFlakyServer(2, status)
+		_, err := newTestClient(srv.URL).ListRecords(context.Background(), "zone1")
+		srv.Close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), *calls)
+	}
+}
+
+func TestWithRetry_GivesUpAfterMaxRetries(t *testing.T) {
+	srv, calls := newFlakyServer(10, http.StatusInternalServerError)
+	defer srv.Close()
+
+	newTestClient(srv.URL).DeleteRecord(context.Background(), "record1")
+	assert.Equal(t, int32(defaultMaxRetries+1), *calls)
+}
+
+func TestWithRetry_StopsBeforeDeadline(t *testing.T) {
+	srv, calls := newFlakyServer(10, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	client := NewHetznerClient(srv.URL, "token")
+	client.retryBaseDelay = 40 * time.Millisecond
+	client.retryJitter = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.ListRecords(ctx, "zone1")
+	elapsed := time.Since(start)
+
+	// attempts at 0, 40ms and 120ms; the last one would overshoot
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP 503", "the error of the last attempt must be returned")
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	assert.True(t, elapsed < 100*time.Millisecond, "took %v", elapsed)
+}
+
+func TestWithRetry_CapsDelay(t *testing.T) {
+	srv, calls := newFlakyServer(10, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	client := NewHetznerClient(srv.URL, "token")
+	client.maxRetries = 4
+	client.retryBaseDelay = 20 * time.Millisecond
+	client.retryMaxDelay = 30 * time.Millisecond
+	client.retryJitter = 1
+
+	start := time.Now()
+	_, err := client.ListRecords(context.Background(), "zone1")
+	elapsed := time.Since(start)
+
+	// uncapped, the delays would add up to at least 20+40+80+160ms
+	assert.Error(t, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(calls))
+	assert.True(t, elapsed >= 4*20*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < 300*time.Millisecond, "took %v", elapsed)
+}
+
+func TestWithRetry_StopsAtMaxElapsed(t *testing.T) {
+	srv, calls := newFlakyServer(100, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	client := NewHetznerClient(srv.URL, "token")
+	client.maxRetries = maxMaxRetries
+	client.retryBaseDelay = 30 * time.Millisecond
+	client.retryMaxDelay = 30 * time.Millisecond
+	client.retryMaxElapsed = 100 * time.Millisecond
+	client.retryJitter = 0
+
+	start := time.Now()
+	_, err := client.ListRecords(context.Background(), "zone1")
+	elapsed := time.Since(start)
+
+	// attempts at 0, 30, 60 and 90ms; the next one would start after 100ms
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "HTTP 503", "the error of the last attempt must be returned")
+	assert.Equal(t, int32(4), atomic.LoadInt32(calls))
+	assert.True(t, elapsed < 200*time.Millisecond, "took %v", elapsed)
+}
+
+func TestWithRetry_DoesNotRetryCreateOnServerError(t *testing.T) {
+	srv, calls := newFlakyServer(1, http.StatusInternalServerError)
+	defer srv.Close()
+
+	newTestClient(srv.URL).CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+	assert.Equal(t, int32(1), *calls, "a create that may have succeeded must not be retried")
+
+	client := newTestClient(srv.URL)
+	client.retryNonIdempotent = true
+	atomic.StoreInt32(calls, 0)
+	client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+	assert.Equal(t, int32(2), *calls, "retryNonIdempotent must retry creates")
+}
+
+func TestWithRetry_RetriesCreateOnConnectionRefused(t *testing.T) {
+	srv, calls := newFlakyServer(0, http.StatusOK)
+	defer srv.Close()
+
+	client := newTestClient(srv.URL)
+	var attempts int32
+	client.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	_, err := client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), attempts)
+	assert.Equal(t, int32(1), *calls)
+}
+
+func TestWithRetry_DoesNotRetryCreateOnOtherNetworkErrors(t *testing.T) {
+	client := newTestClient("http://hetzner.invalid")
+	var attempts int32
+	client.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, errors.New("timeout awaiting response headers")
+	})
+
+	_, err := client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), attempts)
+}
+
+// newTruncatingServer returns a server closing the connection in the middle
+// of the body of the first truncated responses, and sending an empty list
+// of records after.
+func newTruncatingServer(truncated int32) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= truncated {
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"records\": [")
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"records": []}`))
+	}))
+	return srv, &calls
+}
+
+func TestWithRetry_RetriesTruncatedBodies(t *testing.T) {
+	srv, calls := newTruncatingServer(2)
+	defer srv.Close()
+
+	records, err := newTestClient(srv.URL).ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	assert.Equal(t, int32(3), *calls)
+}
+
+func TestWithRetry_DoesNotRetryCreateOnTruncatedBody(t *testing.T) {
+	srv, calls := newTruncatingServer(1)
+	defer srv.Close()
+
+	_, err := newTestClient(srv.URL).CreateRecord(context.Background(), Entry{Name: "_acme-challenge", Type: "TXT", Value: "key"})
+	assert.EqualError(t, err, "error decoding the response to creating TXT record _acme-challenge (HTTP 200 OK) after 13 bytes: unexpected EOF")
+	assert.Equal(t, int32(1), *calls)
+}
+
+func TestWithRetry_ResendsBody(t *testing.T) {
+	var bodies []string
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	req, _ := http.NewRequest("POST", "http://hetzner.invalid/records", strings.NewReader(`{"name":"_acme-challenge"}`))
+	withRetry(2, time.Millisecond, 0, 0, 0, true)(next).RoundTrip(req)
+	assert.Equal(t, []string{`{"name":"_acme-challenge"}`, `{"name":"_acme-challenge"}`, `{"name":"_acme-challenge"}`}, bodies)
+}
+
+func TestWithJitter(t *testing.T) {
+	assert.Equal(t, time.Second, withJitter(time.Second, 0))
+	assert.Equal(t, time.Second, withJitter(time.Second, -1))
+	for i := 0; i < 100; i++ {
+		d := withJitter(time.Second, 0.5)
+		assert.True(t, d >= time.Second && d < 1500*time.Millisecond, "%v out of bounds", d)
+	}
+}
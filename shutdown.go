@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// shutdownGraceSecondsEnv is the environment variable holding how long to
+// wait for Present and CleanUp calls in flight on shutdown.
+const shutdownGraceSecondsEnv = "SHUTDOWN_GRACE_SECONDS"
+
+// defaultShutdownGrace is used when SHUTDOWN_GRACE_SECONDS is not set. It
+// is below the default termination grace period of pods, 30 seconds.
+const defaultShutdownGrace = 25 * time.Second
+
+// canceledOperationsWait is how long shutdown waits for the operations it
+// canceled to return, at most half of the grace period, of which it is a
+// part.
+const canceledOperationsWait = 2 * time.Second
+
+// ErrShuttingDown is returned by Present and CleanUp once the webhook is
+// shutting down, so that cert-manager retries them with another replica or
+// after the restart.
+var ErrShuttingDown = errors.New("the webhook is shutting down")
+
+// shutdownGrace returns the grace period from the environment.
+func shutdownGrace() (time.Duration, error) {
+	env := os.Getenv(shutdownGraceSecondsEnv)
+	if env == "" {
+		return defaultShutdownGrace, nil
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a non-negative number", shutdownGraceSecondsEnv, env)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// operations tracks the Present and CleanUp calls in flight, so that
+// shutdown can wait for them instead of leaving records half created. Its
+// zero value is ready to use.
+type operations struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopping bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// begin starts an operation, returning its context and the function to
+// call when it is done. It fails with ErrShuttingDown after stop.
+func (o *operations) begin() (context.Context, func(), error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.stopping {
+		return nil, nil, ErrShuttingDown
+	}
+	if o.ctx == nil {
+		o.ctx, o.cancel = context.WithCancel(context.Background())
+	}
+	o.wg.Add(1)
+	return o.ctx, o.wg.Done, nil
+}
+
+// stop makes further operations fail with ErrShuttingDown.
+func (o *operations) stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stopping = true
+}
+
+// shutdown stops accepting operations and waits for the ones in flight,
+// altogether no longer than grace. Operations still running shortly before
+// its end are canceled, and waited for the rest of it so that they can
+// return. It reports whether all operations finished.
+func (o *operations) shutdown(grace time.Duration) bool {
+	o.stop()
+
+	finished := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(finished)
+	}()
+
+	cancelWait := canceledOperationsWait
+	if cancelWait > grace/2 {
+		cancelWait = grace / 2
+	}
+	select {
+	case <-finished:
+		return true
+	case <-time.After(grace - cancelWait):
+	}
+
+	klog.Warningf("Present and CleanUp calls still running after %v, canceling them", grace-cancelWait)
+	o.mu.Lock()
+	if o.cancel != nil {
+		o.cancel()
+	}
+	o.mu.Unlock()
+
+	select {
+	case <-finished:
+	case <-time.After(cancelWait):
+		klog.Errorf("Present and CleanUp calls did not return after being canceled, exiting anyway")
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestOperations_Shutdown(t *testing.T) {
+	var ops operations
+	ctx, done, err := ops.begin()
+	assert.NoError(t, err)
+
+	shutDown := make(chan bool)
+	go func() { shutDown <- ops.shutdown(time.Second) }()
+
+	// wait for shutdown to stop accepting operations
+	for {
+		_, probeDone, err := ops.begin()
+		if err != nil {
+			assert.Equal(t, ErrShuttingDown, err)
+			break
+		}
+		probeDone()
+		time.Sleep(time.Millisecond)
+	}
+
+	done()
+	assert.True(t, <-shutDown)
+	assert.NoError(t, ctx.Err(), "finished operations must not be canceled")
+}
+
+func TestOperations_ShutdownCancelsStuckOperations(t *testing.T) {
+	var ops operations
+	ctx, done, err := ops.begin()
+	assert.NoError(t, err)
+	go func() {
+		<-ctx.Done()
+		done()
+	}()
+
+	assert.False(t, ops.shutdown(10*time.Millisecond))
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestOperations_ShutdownWithinGrace(t *testing.T) {
+	var ops operations
+	_, done, err := ops.begin()
+	assert.NoError(t, err)
+	defer done()
+
+	// an operation ignoring its cancellation doesn't extend the grace period
+	start := time.Now()
+	assert.False(t, ops.shutdown(50*time.Millisecond))
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestPresent_Shutdown(t *testing.T) {
+	m, mockSrv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	mockSrv.Close()
+	requested, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			once.Do(func() { close(requested) })
+			<-release
+		}
+		m.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	presented := make(chan error)
+	go func() { presented <- solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)) }()
+	<-requested
+
+	shutDown := make(chan bool)
+	go func() { shutDown <- solver.operations.shutdown(time.Second) }()
+	for {
+		// a challenge in a zone the account doesn't have fails right away
+		err := solver.Present(&v1alpha1.ChallengeRequest{
+			ResolvedFQDN: "_acme-challenge.example.org.",
+			ResolvedZone: "example.org.",
+			Key:          "key",
+			Config:       &extapi.JSON{Raw: []byte(`{"apiKey": "token"}`)},
+		})
+		if err == ErrShuttingDown {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the record being created when shutting down is completed
+	close(release)
+	assert.NoError(t, <-presented)
+	assert.True(t, <-shutDown)
+	assert.Equal(t, []string{"key"}, m.txtValues("_acme-challenge"))
+}
+
+func TestShutdownGrace(t *testing.T) {
+	os.Unsetenv(shutdownGraceSecondsEnv)
+	grace, err := shutdownGrace()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultShutdownGrace, grace)
+
+	os.Setenv(shutdownGraceSecondsEnv, "5")
+	defer os.Unsetenv(shutdownGraceSecondsEnv)
+	grace, err = shutdownGrace()
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, grace)
+
+	os.Setenv(shutdownGraceSecondsEnv, "-1")
+	_, err = shutdownGrace()
+	assert.EqualError(t, err, `invalid SHUTDOWN_GRACE_SECONDS: "-1" is not a non-negative number`)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// defaultReconcileMinAgeSeconds is the age records must have to be removed
+// by the startup sweep unless ReconcileMinAgeSeconds is set. Challenges are
+// solved within minutes, so records a day old are left behind.
+const defaultReconcileMinAgeSeconds = 24 * 60 * 60
+
+// recordTimeLayouts are the formats of the created and modified times of
+// records, as returned by the API, or in RFC 3339.
+var recordTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339Nano,
+}
+
+// recordAge returns the time since e was last modified, or created if it
+// never was. ok is false if the API returned neither time.
+func recordAge(e Entry, now time.Time) (age time.Duration, ok bool) {
+	for _, s := range []string{e.Modified, e.Created} {
+		if s == "" {
+			continue
+		}
+		for _, layout := range recordTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return now.Sub(t), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// reconcileOnStartup removes the challenge records left behind by crashes or
+// failed cleanups if ReconcileOnStartup is set in the default config, see
+// sweepOrphanedRecords. Failures are logged, the sweep is repeated with the
+// next start.
+func (c *hetznerDNSProviderSolver) reconcileOnStartup(stopCh <-chan struct{}) {
+	cfg, err := loadConfigWithDefaults(nil, c.defaults)
+	if !cfg.ReconcileOnStartup {
+		return
+	}
+	if err != nil {
+		klog.Warningf("not removing orphaned challenge records: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	deleted, err := c.sweepOrphanedRecords(ctx, cfg, time.Now())
+	if err != nil {
+		klog.Warningf("removed %d orphaned challenge records, but the sweep failed: %v", deleted, err)
+		return
+	}
+	klog.Infof("removed %d orphaned challenge records", deleted)
+}
+
+// sweepOrphanedRecords deletes the challenge records created by the webhook,
+// i.e. carrying its owner marker, that were last modified at least
+// ReconcileMinAgeSeconds before now, from ReconcileZones or all zones of the
+// API token. Records whose age is unknown are kept. Deletions are limited
+// like those of CleanUp. It returns the number of records deleted.
+func (c *hetznerDNSProviderSolver) sweepOrphanedRecords(ctx context.Context, cfg hetznerDNSProviderConfig, now time.Time) (int, error) {
+	client, err := c.newClient(ctx, cfg, &v1alpha1.ChallengeRequest{}, "")
+	if err != nil {
+		return 0, err
+	}
+	zones, err := client.ListZones(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	minAge := time.Duration(cfg.ReconcileMinAgeSeconds) * time.Second
+	if minAge == 0 {
+		minAge = defaultReconcileMinAgeSeconds * time.Second
+	}
+	workers := cfg.CleanUpWorkers
+	if workers == 0 {
+		workers = defaultCleanUpWorkers
+	}
+
+	var deleted int32
+	var errs joinedError
+	for _, z := range zones {
+		if !reconcileZone(cfg, z.Name) {
+			continue
+		}
+		records, err := client.ListRecords(ctx, z.ZoneID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing records of zone %s failed: %w", z.Name, err))
+			continue
+		}
+		owners, records := newOwnership(cfg.OwnerMarker, records)
+
+		var orphans []Entry
+		for _, e := range records {
+			if e.Type != cfg.RecordType || !owners.owns(e) {
+				continue
+			}
+			if age, ok := recordAge(e, now); ok && age >= minAge {
+				orphans = append(orphans, e)
+			}
+		}
+
+		err = deleteRecords(ctx, workers, orphans, func(ctx context.Context, e Entry) error {
+			if err := client.DeleteRecord(ctx, e.ID); err != nil && !isNotFound(err) {
+				return fmt.Errorf("failed to delete orphaned record %s named %s in zone %s: %w", e.ID, e.Name, z.Name, err)
+			}
+			age, _ := recordAge(e, now)
+			klog.Infof("deleted orphaned record %s named %s with value %q from zone %s, last modified %v ago", e.ID, e.Name, e.Value, z.Name, age.Round(time.Second))
+			marker, _ := owners.markerOf(e)
+			deleteMarker(ctx, client, marker.ID)
+			atomic.AddInt32(&deleted, 1)
+			return nil
+		})
+		if failed, ok := err.(joinedError); ok {
+			errs = append(errs, failed...)
+		}
+	}
+	if len(errs) > 0 {
+		return int(deleted), errs
+	}
+	return int(deleted), nil
+}
+
+// reconcileZone reports whether the sweep covers the zone with the given
+// name, i.e. ReconcileZones is unset or lists it.
+func reconcileZone(cfg hetznerDNSProviderConfig, zone string) bool {
+	if len(cfg.ReconcileZones) == 0 {
+		return true
+	}
+	for _, z := range cfg.ReconcileZones {
+		if sameName(z, zone) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestRecordAge(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		e   Entry
+		age time.Duration
+		ok  bool
+	}{
+		{Entry{Created: "2024-05-03 11:00:00.497 +0000 UTC"}, 59*time.Minute + 59503*time.Millisecond, true},
+		{Entry{Created: "2024-05-01T12:00:00Z", Modified: "2024-05-03T11:00:00Z"}, time.Hour, true},
+		{Entry{Created: "2024-05-02T12:00:00Z", Modified: "garbage"}, 24 * time.Hour, true},
+		{Entry{}, 0, false},
+	} {
+		age, ok := recordAge(tt.e, now)
+		assert.Equal(t, tt.ok, ok, "%+v", tt.e)
+		assert.Equal(t, tt.age, age, "%+v", tt.e)
+	}
+}
+
+func TestSweepOrphanedRecords(t *testing.T) {
+	old := "2024-05-01 12:00:00.000 +0000 UTC"
+	recent := "2024-05-03 11:00:00.000 +0000 UTC"
+	owned := withOwnerMarkers(
+		Entry{ID: "old", Name: "_acme-challenge", Type: "TXT", Value: "old-key", ZoneID: "zone1", Modified: old},
+		Entry{ID: "recent", Name: "_acme-challenge", Type: "TXT", Value: "recent-key", ZoneID: "zone1", Modified: recent},
+		Entry{ID: "unknown-age", Name: "_acme-challenge.www", Type: "TXT", Value: "unknown-key", ZoneID: "zone1"},
+		Entry{ID: "other-zone", Name: "_acme-challenge", Type: "TXT", Value: "other-key", ZoneID: "zone2", Modified: old},
+	)
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2"}, append(owned,
+		Entry{ID: "manual", Name: "_acme-challenge", Type: "TXT", Value: "manual-key", ZoneID: "zone1", Modified: old},
+		Entry{ID: "www", Name: "www", Type: "A", Value: "192.0.2.1", ZoneID: "zone1", Modified: old},
+	)...)
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "reconcileOnStartup": true, "reconcileZones": ["example.com"]}`)})
+	assert.NoError(t, err)
+	deleted, err := solver.sweepOrphanedRecords(context.Background(), cfg, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	for _, id := range []string{"old", "old-marker"} {
+		assert.NotContains(t, m.records, id)
+	}
+	for _, id := range []string{"recent", "unknown-age", "other-zone", "manual", "www"} {
+		assert.Contains(t, m.records, id, "only old records of the webhook in the listed zones must be deleted")
+	}
+
+	// all zones are swept by default, failures are returned
+	m.statuses = map[string]int{"DELETE /records/other-zone": http.StatusInternalServerError}
+	cfg.ReconcileZones = nil
+	cfg.MaxRetries = -1
+	deleted, err = solver.sweepOrphanedRecords(context.Background(), cfg, now)
+	assert.Equal(t, 0, deleted)
+	var failed joinedError
+	if assert.True(t, errors.As(err, &failed), "got %v", err) {
+		assert.Len(t, failed, 1)
+	}
+	assert.Contains(t, m.records, "other-zone")
+}
+
+func TestLoadConfig_ReconcileOnStartup(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "reconcileOnStartup": true}`)})
+	assert.NoError(t, err)
+	assert.True(t, cfg.ReconcileOnStartup)
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "reconcileOnStartup": true, "ownerMarker": "none"}`)})
+	assert.EqualError(t, err, "reconcileOnStartup requires an ownerMarker and recordType TXT")
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "reconcileMinAgeSeconds": -1}`)})
+	assert.EqualError(t, err, "reconcileMinAgeSeconds must not be negative but is -1")
+
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "reconcileZones": [""]}`)})
+	assert.EqualError(t, err, "reconcileZones[0] must not be blank")
+}
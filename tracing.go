@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// tracer starts the spans API calls and challenges are traced with. Unless
+// the webhook is built with the otel build tag, see tracing_otel.go, it is
+// noopTracer and tracing costs nothing.
+type tracer interface {
+	// Start starts a span with the given name as a child of the span in
+	// ctx, if any, and returns a context holding it.
+	Start(ctx context.Context, name string) (context.Context, span)
+}
+
+// span is a single traced operation.
+type span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// apiTracer is the tracer of the webhook.
+var apiTracer tracer = noopTracer{}
+
+// flushTracing exports the spans the tracer hasn't exported yet. main calls
+// it before exiting, with a context bounded by tracingFlushTimeout.
+var flushTracing = func(context.Context) error { return nil }
+
+// tracingFlushTimeout is how long exiting waits for the spans to be
+// exported, within the 5 seconds the chart's termination grace period
+// leaves after the shutdown grace period.
+const tracingFlushTimeout = 3 * time.Second
+
+// tracingEnabled reports whether spans are recorded at all.
+func tracingEnabled() bool {
+	_, noop := apiTracer.(noopTracer)
+	return !noop
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+// startSpan starts a span with the given attributes.
+func startSpan(ctx context.Context, name string, attributes ...interface{}) (context.Context, span) {
+	ctx, s := apiTracer.Start(ctx, name)
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.SetAttribute(attributes[i].(string), attributes[i+1])
+	}
+	return ctx, s
+}
+
+// endSpan records err, if any, and ends s.
+func endSpan(s span, err error) {
+	if err != nil {
+		s.RecordError(err)
+	}
+	s.End()
+}
+
+// attemptsKey is the context key of the attempt counter of a traced API
+// call.
+type attemptsKey struct{}
+
+// withTracing traces every API call in a span named after its operation,
+// with the zone, the HTTP status and the number of retries as attributes.
+// It goes before withRetry, which calls countAttempts for every attempt.
+func withTracing() middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			operation := apiOperation(req.Method, req.URL.Path)
+			ctx, s := startSpan(req.Context(), "hetzner."+operation,
+				"hetzner.operation", operation,
+				"http.method", req.Method,
+			)
+			if zone := requestZone(req); zone != "" {
+				s.SetAttribute("hetzner.zone", zone)
+			}
+			var attempts int32
+			ctx = context.WithValue(ctx, attemptsKey{}, &attempts)
+
+			resp, err := next.RoundTrip(req.WithContext(ctx))
+			if n := atomic.LoadInt32(&attempts); n > 0 {
+				s.SetAttribute("hetzner.retries", int(n-1))
+			}
+			if resp != nil {
+				s.SetAttribute("http.status_code", resp.StatusCode)
+			}
+			endSpan(s, err)
+			return resp, err
+		})
+	}
+}
+
+// countAttempts counts the attempts of an API call traced by withTracing.
+func countAttempts() middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if attempts, ok := req.Context().Value(attemptsKey{}).(*int32); ok {
+				atomic.AddInt32(attempts, 1)
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// requestZone returns the zone an API request is about: the zone ID of
+// records listed or created, or the name of zones looked up. It is empty for
+// deletes, which only name the record.
+func requestZone(req *http.Request) string {
+	query := req.URL.Query()
+	if zone := query.Get("zone_id"); zone != "" {
+		return zone
+	}
+	if zone := query.Get("name"); zone != "" {
+		return zone
+	}
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return ""
+	}
+	var record struct {
+		ZoneID string `json:"zone_id"`
+	}
+	if json.Unmarshal(data, &record) != nil {
+		return ""
+	}
+	return record.ZoneID
+}
@@ -0,0 +1,18 @@
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracing_Disabled(t *testing.T) {
+	assert.False(t, tracingEnabled(), "tracing must be disabled by default")
+	_, s := apiTracer.Start(context.Background(), "test")
+	s.SetAttribute("key", "value")
+	s.End()
+}
@@ -0,0 +1,79 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+// Built with the otel tag, the webhook exports its spans to a Jaeger
+// collector, e.g. the OpenTelemetry Collector's jaeger receiver, at the URL
+// in OTEL_EXPORTER_JAEGER_ENDPOINT. The OTLP exporters need a newer gRPC
+// than the Kubernetes libraries of the webhook build with.
+func init() {
+	exporter, err := jaeger.New(jaeger.WithCollectorEndpoint())
+	if err != nil {
+		klog.Errorf("failed to set up the OpenTelemetry exporter, tracing is disabled: %v", err)
+		return
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "cert-manager-webhook-hetzner")))
+	if err == nil {
+		res, err = resource.Merge(res, resource.Environment())
+	}
+	if err != nil {
+		klog.Errorf("failed to set up the OpenTelemetry resource, tracing is disabled: %v", err)
+		return
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	apiTracer = otelTracer{provider.Tracer("github.com/mecodia/cert-manager-webhook-hetzner")}
+	flushTracing = provider.Shutdown
+}
+
+// otelTracer adapts an OpenTelemetry tracer to the tracer interface.
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	ctx, s := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{s}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,51 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOtelTracer(t *testing.T) {
+	assert.True(t, tracingEnabled(), "the otel build must trace")
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	tracer := otelTracer{provider.Tracer("test")}
+
+	ctx, parent := tracer.Start(context.Background(), "Present")
+	_, child := tracer.Start(ctx, "zone_lookup")
+	child.SetAttribute("hetzner.zone", "example.com")
+	child.SetAttribute("http.status_code", 500)
+	child.SetAttribute("hetzner.dry_run", true)
+	child.SetAttribute("hetzner.retries", int64(2))
+	child.RecordError(errors.New("server error"))
+	child.End()
+	parent.End()
+
+	ended := recorder.Ended()
+	if assert.Len(t, ended, 2) {
+		s := ended[0]
+		assert.Equal(t, "zone_lookup", s.Name())
+		assert.Equal(t, ended[1].SpanContext().SpanID(), s.Parent().SpanID(), "spans must be children of the span in the context")
+		assert.ElementsMatch(t, []attribute.KeyValue{
+			attribute.String("hetzner.zone", "example.com"),
+			attribute.Int("http.status_code", 500),
+			attribute.Bool("hetzner.dry_run", true),
+			attribute.String("hetzner.retries", "2"),
+		}, s.Attributes())
+		assert.Equal(t, codes.Error, s.Status().Code)
+		assert.Equal(t, "server error", s.Status().Description)
+		assert.Equal(t, codes.Unset, ended[1].Status().Code)
+	}
+}
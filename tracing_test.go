@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTracer records the spans it starts, with the name of their
+// parent.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+type parentSpanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	s := &recordedSpan{name: name, attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(parentSpanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, parentSpanKey{}, s), s
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *recordedSpan) RecordError(err error)                      { s.err = err }
+func (s *recordedSpan) End()                                       { s.ended = true }
+
+func useRecordingTracer() (*recordingTracer, func()) {
+	t := &recordingTracer{}
+	old := apiTracer
+	apiTracer = t
+	return t, func() { apiTracer = old }
+}
+
+func TestTracing_APICalls(t *testing.T) {
+	tracer, restore := useRecordingTracer()
+	defer restore()
+
+	var failed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && atomic.AddInt32(&failed, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == "POST" {
+			json.NewEncoder(w).Encode(struct{ Record Entry }{Entry{ID: "new-1"}})
+			return
+		}
+		json.NewEncoder(w).Encode(Entries{})
+	}))
+	defer srv.Close()
+	client := NewHetznerClient(srv.URL, "token")
+	client.retryBaseDelay = time.Millisecond
+
+	_, err := client.ListRecords(context.Background(), "zone1")
+	assert.NoError(t, err)
+	_, err = client.CreateRecord(context.Background(), Entry{Name: "_acme-challenge", ZoneID: "zone1", Type: "TXT", Value: "key"})
+	assert.NoError(t, err)
+	assert.NoError(t, client.DeleteRecord(context.Background(), "new-1"))
+
+	if assert.Len(t, tracer.spans, 3) {
+		assert.Equal(t, "hetzner.list_records", tracer.spans[0].name)
+		assert.Equal(t, map[string]interface{}{
+			"hetzner.operation": "list_records",
+			"hetzner.zone":      "zone1",
+			"hetzner.retries":   1,
+			"http.method":       "GET",
+			"http.status_code":  http.StatusOK,
+		}, tracer.spans[0].attributes)
+		assert.Equal(t, "zone1", tracer.spans[1].attributes["hetzner.zone"], "the zone of a created record must be taken from the body")
+		assert.Equal(t, 0, tracer.spans[1].attributes["hetzner.retries"])
+		assert.Equal(t, "hetzner.delete", tracer.spans[2].name)
+		for _, s := range tracer.spans {
+			assert.True(t, s.ended, s.name)
+			assert.NoError(t, s.err, s.name)
+		}
+	}
+}
+
+func TestTracing_Challenges(t *testing.T) {
+	tracer, restore := useRecordingTracer()
+	defer restore()
+
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{"apiKey": "token"}`)))
+
+	if assert.NotEmpty(t, tracer.spans) {
+		assert.Equal(t, "Present", tracer.spans[0].name)
+		assert.Equal(t, "_acme-challenge.example.com.", tracer.spans[0].attributes["challenge.fqdn"])
+		assert.True(t, tracer.spans[0].ended)
+		for _, s := range tracer.spans[1:] {
+			assert.Equal(t, "Present", s.parent, "API calls must be traced as part of the challenge, got %s", s.name)
+		}
+	}
+
+	// failed challenges record the error
+	tracer.spans = nil
+	m.statuses = map[string]int{"DELETE /records/new-1": http.StatusInternalServerError}
+	assert.Error(t, solver.CleanUp(newChallengeRequest("key", `{"apiKey": "token", "maxRetries": -1}`)))
+	if assert.NotEmpty(t, tracer.spans) {
+		assert.Equal(t, "CleanUp", tracer.spans[0].name)
+		assert.Error(t, tracer.spans[0].err)
+		assert.True(t, tracer.spans[0].ended)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// newTransport returns the transport requests to the API are sent with
+// once they went through all middlewares. Requests go through proxyURL if
+// set, and through the proxy configured by the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables otherwise. If rootCAs is set, it replaces
+// the system CAs to verify the API's certificate. If dialer is set,
+// connections are made with it instead of the default dialer. With
+// disableHTTP2, requests are only ever sent with HTTP/1.1. Idle connections
+// are kept as configured by idle.
+func newTransport(proxyURL *url.URL, rootCAs *x509.CertPool, dialer *net.Dialer, disableHTTP2 bool, idle idleConns) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = idle.max
+	transport.MaxIdleConnsPerHost = idle.maxPerHost
+	transport.IdleConnTimeout = idle.timeout
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	if dialer != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, dialer, network, addr)
+		}
+	}
+	if disableHTTP2 {
+		// a non-nil empty map keeps the transport from setting up HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// Defaults of the idle connections kept by transports. All requests go to
+// the API, or the proxy, so that many of them may be kept per host, unlike
+// Go's default of 2, to serve bursts of renewals without reconnecting.
+const (
+	defaultMaxIdleConns           = 100
+	defaultMaxIdleConnsPerHost    = 10
+	defaultIdleConnTimeoutSeconds = 90
+)
+
+// idleConns configures the idle connections kept by a transport: at most
+// max in total and maxPerHost per host, each for up to timeout.
+type idleConns struct {
+	max        int
+	maxPerHost int
+	timeout    time.Duration
+}
+
+// idleConnsFor returns the idle connection settings of cfg, with the
+// defaults for those it doesn't set.
+func idleConnsFor(cfg hetznerDNSProviderConfig) idleConns {
+	idle := idleConns{max: defaultMaxIdleConns, maxPerHost: defaultMaxIdleConnsPerHost, timeout: defaultIdleConnTimeoutSeconds * time.Second}
+	if cfg.MaxIdleConns > 0 {
+		idle.max = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		idle.maxPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeoutSeconds > 0 {
+		idle.timeout = time.Duration(cfg.IdleConnTimeoutSeconds) * time.Second
+	}
+	return idle
+}
+
+// disableHTTP2Env is the environment variable which, set to "true", makes
+// all connections to the API use HTTP/1.1, like disableHttp2 in the config.
+const disableHTTP2Env = "DISABLE_HTTP2"
+
+// http2Disabled reports whether DISABLE_HTTP2 is set.
+func http2Disabled() bool {
+	return os.Getenv(disableHTTP2Env) == "true"
+}
+
+// dialContext connects to addr with dialer, replaced in tests.
+var dialContext = func(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// newDialer returns a dialer connecting from the IP address localAddress
+// and resolving host names with the DNS server at the address dnsResolver,
+// nil if neither is set. Its timeouts are those of the default dialer.
+func newDialer(localAddress, dnsResolver string) *net.Dialer {
+	if localAddress == "" && dnsResolver == "" {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if localAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localAddress)}
+	}
+	if dnsResolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, dnsResolver)
+			},
+		}
+	}
+	return dialer
+}
+
+// withDecompression decodes gzip and deflate compressed responses. The
+// transport only does so itself if it asked for compression, i.e. not if
+// Accept-Encoding was set in extraHeaders.
+func withDecompression() middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return resp, err
+			}
+
+			var body io.ReadCloser
+			switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+			case "gzip":
+				body, err = gzip.NewReader(resp.Body)
+			case "deflate":
+				body, err = zlib.NewReader(resp.Body)
+			default:
+				return resp, nil
+			}
+			if err != nil {
+				resp.Body.Close()
+				return nil, fmt.Errorf("error decompressing response: %v", err)
+			}
+			resp.Body = readCloser{Reader: body, Closer: multiCloser{body, resp.Body}}
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			resp.Uncompressed = true
+			return resp, nil
+		})
+	}
+}
+
+// ErrResponseTooLarge is returned when reading a response body larger than
+// the client's maxResponseBytes.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// withBodyLimit makes reading response bodies fail with ErrResponseTooLarge
+// after max bytes. It wraps withDecompression, so that the limit applies to
+// the decompressed body.
+func withBodyLimit(max int64) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return resp, err
+			}
+			resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max, max: max}
+			return resp, nil
+		})
+	}
+}
+
+// limitedBody is a response body failing with ErrResponseTooLarge once
+// more than max bytes were read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// the body may end exactly at the limit
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, fmt.Errorf("%w: the body exceeds the limit of %d bytes, see maxResponseBytes", ErrResponseTooLarge, b.max)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// readCloser combines a Reader and a Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// multiCloser closes all of its closers, returning the first error.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// parseCABundle returns a pool of the PEM encoded CA certificates in
+// bundle. Unlike x509.CertPool.AppendCertsFromPEM it fails on anything but
+// valid certificates.
+func parseCABundle(bundle []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for n := 1; ; n++ {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			if n == 1 {
+				return nil, errors.New("no PEM encoded certificate found")
+			}
+			if len(bytes.TrimSpace(bundle)) > 0 {
+				return nil, fmt.Errorf("unexpected data after certificate %d", n-1)
+			}
+			return pool, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("block %d is a %s, not a CERTIFICATE", n, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate %d: %v", n, err)
+		}
+		pool.AddCert(cert)
+	}
+}
+
+// middleware wraps a RoundTripper to add a single concern, e.g. retries or
+// metrics, to every request sent through it.
+type middleware func(http.RoundTripper) http.RoundTripper
+
+// chain wraps base in the given middlewares. The first middleware is the
+// outermost one, i.e. it sees a request first and its response last.
+func chain(base http.RoundTripper, middlewares ...middleware) http.RoundTripper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		base = middlewares[i](base)
+	}
+	return base
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// withHeader sets the given header on every request.
+func withHeader(name, value string) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// a RoundTripper must not modify the request it was given
+			req = req.Clone(req.Context())
+			req.Header.Set(name, value)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// withExtraHeaders sets the given headers on every request, except for
+// headers the request already has, e.g. Content-Type.
+func withExtraHeaders(headers map[string]string) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			for name, value := range headers {
+				if req.Header.Get(name) == "" {
+					req.Header.Set(name, value)
+				}
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// secretHeaderPattern matches names of headers likely to carry secrets.
+var secretHeaderPattern = regexp.MustCompile(`(?i)auth|token|secret|key|password|cookie|session`)
+
+// redactHeaders formats headers for logging, hiding the values of headers
+// whose name suggests that they carry a secret.
+func redactHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, len(names))
+	for i, name := range names {
+		value := headers[name]
+		if secretHeaderPattern.MatchString(name) {
+			value = "REDACTED"
+		}
+		formatted[i] = name + ": " + value
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// withCorrelationID sends id in the given header with every request and
+// logs it, to trace calls back to the challenge that caused them.
+func withCorrelationID(header, id string) middleware {
+	setHeader := withHeader(header, id)
+	return func(next http.RoundTripper) http.RoundTripper {
+		next = setHeader(next)
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			klog.V(4).Infof("%s %s with correlation id %s", req.Method, req.URL.Path, id)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// withDryRun logs requests that would modify records instead of sending
+// them, and answers them with an empty success response. Read requests are
+// sent as usual.
+func withDryRun() middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == "GET" || req.Method == "HEAD" {
+				return next.RoundTrip(req)
+			}
+
+			var body []byte
+			if req.Body != nil {
+				var err error
+				if body, err = ioutil.ReadAll(req.Body); err != nil {
+					return nil, err
+				}
+				req.Body.Close()
+			}
+			klog.Infof("dry run: not sending %s %s %s", req.Method, req.URL.Path, body)
+			return &http.Response{
+				Status:     "200 OK",
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("{}")),
+				Request:    req,
+			}, nil
+		})
+	}
+}
+
+// maxLoggedBodyBytes is the maximum number of bytes of a response body
+// included in the debug logs.
+const maxLoggedBodyBytes = 512
+
+// disableBodyLoggingEnv is the environment variable which, set to "true",
+// keeps response bodies out of the debug logs at any verbosity.
+const disableBodyLoggingEnv = "DISABLE_BODY_LOGGING"
+
+// bodyLoggingDisabled reports whether DISABLE_BODY_LOGGING is set.
+func bodyLoggingDisabled() bool {
+	return os.Getenv(disableBodyLoggingEnv) == "true"
+}
+
+// withLogging logs all requests and their responses at debug level as
+// structured key/values. Headers are not logged, as the request headers
+// carry the API token. With logBodies, the response body is buffered so a
+// snippet of it can be logged and it can still be read by the caller.
+func withLogging(requestID string, logBodies bool) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !klog.V(4).Enabled() {
+				return next.RoundTrip(req)
+			}
+
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				klog.V(4).InfoS("API request failed", "method", req.Method, "url", req.URL.String(),
+					"duration", time.Since(start), "err", err, "requestID", requestID)
+				return resp, err
+			}
+			if !logBodies {
+				klog.V(4).InfoS("API request", "method", req.Method, "url", req.URL.String(),
+					"status", resp.StatusCode, "duration", time.Since(start), "requestID", requestID)
+				return resp, nil
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			klog.V(4).InfoS("API request", "method", req.Method, "url", req.URL.String(),
+				"status", resp.StatusCode, "duration", time.Since(start), "body", bodySnippet(body), "requestID", requestID)
+			return resp, nil
+		})
+	}
+}
+
+// bodySnippet returns body, truncated to maxLoggedBodyBytes.
+func bodySnippet(body []byte) string {
+	if len(body) <= maxLoggedBodyBytes {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d bytes total)", body[:maxLoggedBodyBytes], len(body))
+}
+
+// rateLimiter spaces requests evenly so that no more than a given number
+// of requests per second are sent.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// reserve returns how long to wait before the next request may be sent.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	return at.Sub(now)
+}
+
+// semaphore limits the number of concurrent requests.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	return make(semaphore, size)
+}
+
+// withConcurrencyLimit sends requests only while holding a slot of sem, so
+// that no more than its size are in flight at once. Requests beyond the
+// limit wait for a slot or until they are canceled. The slot is held until
+// the response body is closed, since reading it is part of the request.
+func withConcurrencyLimit(sem semaphore) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case sem <- struct{}{}:
+			}
+			release := releaseOnce(func() { <-sem })
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			resp.Body = releaseOnClose{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		})
+	}
+}
+
+// releaseOnce returns a function calling release on its first call only.
+func releaseOnce(release func()) func() {
+	var once sync.Once
+	return func() { once.Do(release) }
+}
+
+// releaseOnClose calls release once its response body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// withRateLimit delays requests as needed to stay within the rate of
+// limiter.
+func withRateLimit(limiter *rateLimiter) middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if delay := limiter.reserve(); delay > 0 {
+				select {
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				case <-time.After(delay):
+				}
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// validateConfigEndpointEnv enables the /validate-config endpoint when set
+// to "true".
+const validateConfigEndpointEnv = "VALIDATE_CONFIG_ENDPOINT"
+
+// maxValidateConfigBytes is the largest solver config /validate-config
+// accepts.
+const maxValidateConfigBytes = 1 << 20
+
+// configValidation is the result of validating a solver config, as served
+// by the /validate-config endpoint.
+type configValidation struct {
+	Valid bool `json:"valid"`
+	// Steps are the checks run, in order. The checks after a failed one
+	// are skipped.
+	Steps []validationStep `json:"steps"`
+	// FieldErrors are the errors attributed to an option of the config.
+	FieldErrors []fieldError `json:"fieldErrors,omitempty"`
+}
+
+type validationStep struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// validateConfigHandler validates a solver config, posted as the JSON an
+// issuer would set as the webhook's config, like challenges for the zone
+// given by the zone parameter would load it: the config is loaded with the
+// solver's defaults, the API token is resolved and the zone looked up. It
+// never changes records. Options deciding where the token is read from or
+// sent to have to equal the solver's defaults, see restrictedConfigFields.
+type validateConfigHandler struct {
+	solver *hetznerDNSProviderSolver
+}
+
+func (h validateConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	zone := req.URL.Query().Get("zone")
+	if strings.TrimSpace(zone) == "" {
+		http.Error(w, "the zone parameter is required", http.StatusBadRequest)
+		return
+	}
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxValidateConfigBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading the config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result := h.solver.validateConfig(req.Context(), raw, zone)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
+
+// validateConfig runs the checks of /validate-config for the solver config
+// raw and zone.
+func (c *hetznerDNSProviderSolver) validateConfig(ctx context.Context, raw []byte, zone string) (result configValidation) {
+	step := func(name string, err error, format string, args ...interface{}) bool {
+		s := validationStep{Name: name, Passed: err == nil}
+		if err != nil {
+			s.Error = err.Error()
+			if field := configFieldOf(err); field != "" {
+				result.FieldErrors = append(result.FieldErrors, fieldError{Field: field, Error: s.Error})
+			}
+		} else {
+			s.Detail = fmt.Sprintf(format, args...)
+		}
+		result.Steps = append(result.Steps, s)
+		return err == nil
+	}
+	defer func() {
+		result.Valid = true
+		for _, s := range result.Steps {
+			result.Valid = result.Valid && s.Passed
+		}
+	}()
+
+	// unknown options are only rejected with STRICT_CONFIG, but are most
+	// likely misspelled ones
+	if os.Getenv(strictConfigEnv) != "true" {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&hetznerDNSProviderConfig{})
+		if err != nil && !unknownFieldPattern.MatchString(err.Error()) {
+			err = nil // reported by loading the config
+		}
+		if !step("known options", err, "all options are known") {
+			return result
+		}
+	}
+
+	c.checkZone(ctx, raw, zone, true, c.checkRestrictedConfigFields, step)
+	return result
+}
+
+// restrictedConfigFields are the options of configs posted to
+// /validate-config that have to equal the solver's defaults. Otherwise
+// anyone able to reach the endpoint could have a token the webhook can read
+// sent to a server of their choice, or probe secrets in any namespace.
+var restrictedConfigFields = []string{
+	"apiUrl",
+	"proxyUrl",
+	"caBundle",
+	"caBundlePath",
+	"extraHeaders",
+	"apiKeySecretRef",
+	"apiKeySecretSelector",
+	"zoneApiKeySecretRefs",
+	"fallbackApiKeySecretRefs",
+	"secretNamespaceSource",
+	"apiKeyFile",
+}
+
+// checkRestrictedConfigFields fails if an option of cfg in
+// restrictedConfigFields differs from the solver's defaults.
+func (c *hetznerDNSProviderSolver) checkRestrictedConfigFields(cfg hetznerDNSProviderConfig) error {
+	// the token is usually set by the posted config
+	defaults, err := loadConfigWithDefaults(nil, c.defaults)
+	if err != nil && !errors.Is(err, errNoAPIKey) {
+		return err
+	}
+	got, want := reflect.ValueOf(cfg), reflect.ValueOf(defaults)
+	t := got.Type()
+	for _, name := range restrictedConfigFields {
+		for i := 0; i < t.NumField(); i++ {
+			if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] != name {
+				continue
+			}
+			if !reflect.DeepEqual(got.Field(i).Interface(), want.Field(i).Interface()) {
+				return fmt.Errorf("%s can only be set to the solver's default when validating a config", name)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	unknownFieldPattern = regexp.MustCompile(`unknown field "([^"]+)"`)
+	typeErrorPattern    = regexp.MustCompile(`Go struct field \w+\.(\S+) of type`)
+)
+
+// configFieldOf returns the option of the solver config err is about, or
+// "" if it isn't about a single option. Validation errors start with the
+// name of the option, decoding errors name it.
+func configFieldOf(err error) string {
+	msg := err.Error()
+	if m := unknownFieldPattern.FindStringSubmatch(msg); m != nil {
+		return m[1]
+	}
+	if m := typeErrorPattern.FindStringSubmatch(msg); m != nil {
+		return m[1]
+	}
+	field := msg
+	if i := strings.IndexAny(field, " :"); i >= 0 {
+		field = field[:i]
+	}
+	name := field
+	if i := strings.IndexAny(name, ".["); i >= 0 {
+		name = name[:i]
+	}
+	if !configFields[name] {
+		return ""
+	}
+	return field
+}
+
+// configFields holds the names of the options of the solver config.
+var configFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(hetznerDNSProviderConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// validateConfigEndpointEnabled reports whether the /validate-config
+// endpoint is served.
+func validateConfigEndpointEnabled() bool {
+	return os.Getenv(validateConfigEndpointEnv) == "true"
+}
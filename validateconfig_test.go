@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfigHandler(t *testing.T) {
+	os.Unsetenv(apiTokenEnv)
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	handler := validateConfigHandler{solver: &hetznerDNSProviderSolver{apiURL: srv.URL}}
+	post := func(zone, config string) (int, configValidation) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/validate-config?zone="+zone, strings.NewReader(config)))
+		var result configValidation
+		if rec.Code == http.StatusOK || rec.Code == http.StatusUnprocessableEntity {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		}
+		return rec.Code, result
+	}
+	failedStep := func(result configValidation) validationStep {
+		for _, s := range result.Steps {
+			if !s.Passed {
+				return s
+			}
+		}
+		return validationStep{}
+	}
+
+	code, result := post("example.com", `{"apiKey": "token", "ttl": 120}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.Valid)
+	assert.Empty(t, result.FieldErrors)
+	if assert.Len(t, result.Steps, 5) {
+		assert.Equal(t, validationStep{Name: "zone lookup", Passed: true, Detail: "zone example.com has the ID zone1"}, result.Steps[4])
+	}
+
+	for _, tt := range []struct {
+		zone   string
+		config string
+		step   string
+		field  string
+	}{
+		{"example.com", `{"apiKey": "token", "tll": 120}`, "known options", "tll"},
+		{"example.com", `{"apiKey": "token", "ttl": 100000}`, "config", "ttl"},
+		{"example.com", `{"apiKey": "token", "ttl": "120"}`, "config", "ttl"},
+		{"example.com", `{"apiKey": "token", "propagationNameservers": [" "]}`, "config", "propagationNameservers[0]"},
+		{"example.com", `{"apiKey": "token", "recordName": "a", "recordNamePrefix": "b"}`, "config", ""},
+		{"example.com", `{"apiKey": "token"`, "config", ""},
+		{"example.com", `{}`, "config", ""},
+		{"example.com", `{"apiKeySecretRef": {"name": "hetzner", "key": "api-token"}}`, "config", "apiKeySecretRef"},
+		{"example.com", `{"apiKey": "token", "apiUrl": "https://attacker.example"}`, "config", "apiUrl"},
+		{"example.com", `{"apiKey": "token", "proxyUrl": "http://attacker.example"}`, "config", "proxyUrl"},
+		{"example.com", `{"apiKey": "token", "extraHeaders": {"X-Forward": "attacker.example"}}`, "config", "extraHeaders"},
+		{"example.com", `{"apiKey": "token", "secretNamespaceSource": "kube-system"}`, "config", "secretNamespaceSource"},
+		{"example.com", `{"apiKeyFile": "/etc/passwd"}`, "config", "apiKeyFile"},
+		{"example.com", `{"apiKey": "wrong"}`, "zone lookup", ""},
+		{"example.org", `{"apiKey": "token"}`, "zone lookup", ""},
+	} {
+		code, result := post(tt.zone, tt.config)
+		assert.Equal(t, http.StatusUnprocessableEntity, code, tt.config)
+		assert.False(t, result.Valid, tt.config)
+		failed := failedStep(result)
+		assert.Equal(t, tt.step, failed.Name, tt.config)
+		assert.NotEmpty(t, failed.Error, tt.config)
+		assert.Equal(t, failed, result.Steps[len(result.Steps)-1], "the steps after a failed one must be skipped")
+		if tt.field == "" {
+			assert.Empty(t, result.FieldErrors, tt.config)
+		} else if assert.Len(t, result.FieldErrors, 1, tt.config) {
+			assert.Equal(t, tt.field, result.FieldErrors[0].Field, tt.config)
+		}
+	}
+
+	code, _ = post("", `{"apiKey": "token"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/validate-config?zone=example.com", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// options equal to the solver's defaults are allowed
+	handler.solver.defaults.Config = []byte(`{"apiUrl": "` + srv.URL + `", "extraHeaders": {"X-Team": "a"}}`)
+	code, result = post("example.com", `{"apiKey": "token", "apiUrl": "`+srv.URL+`", "extraHeaders": {"X-Team": "a"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.Valid)
+	code, result = post("example.com", `{"apiKey": "token", "extraHeaders": {"X-Team": "b"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	if assert.Len(t, result.FieldErrors, 1) {
+		assert.Equal(t, "extraHeaders", result.FieldErrors[0].Field)
+	}
+
+	for _, r := range m.requests {
+		assert.True(t, strings.HasPrefix(r, "GET "), "the endpoint must not change records, got %s", r)
+	}
+}
+
+func TestConfigFieldOf(t *testing.T) {
+	for msg, expected := range map[string]string{
+		"ttl must be between 60 and 86400 but is 100000":          "ttl",
+		"recordNameSuffix: empty zone name":                       "recordNameSuffix",
+		"reconcileZones[1] must not be blank":                     "reconcileZones[1]",
+		`error decoding solver config: json: unknown field "tll"`: "tll",
+		"only one of recordName and recordNamePrefix may be set":  "",
+		"zone not found": "",
+	} {
+		assert.Equal(t, expected, configFieldOf(errors.New(msg)), msg)
+	}
+}
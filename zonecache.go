@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// defaultZoneCacheSize is the maximum number of cached zone IDs when
+// ZoneCacheSize is not set.
+const defaultZoneCacheSize = 1000
+
+// zoneCache is a size bounded cache of zone IDs whose entries expire after
+// a TTL. Its zero value is an empty cache.
+type zoneCache struct {
+	mu      sync.Mutex
+	entries map[string]zoneCacheEntry
+}
+
+type zoneCacheEntry struct {
+	zoneID  string
+	expires time.Time
+}
+
+// get returns the cached zone ID for key, if it hasn't expired.
+func (z *zoneCache) get(key string) (string, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	entry, ok := z.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.zoneID, true
+}
+
+// put caches zoneID for key for the given TTL. If the cache holds maxSize
+// entries, expired entries are dropped first, then the entry expiring next.
+func (z *zoneCache) put(key, zoneID string, ttl time.Duration, maxSize int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.entries == nil {
+		z.entries = map[string]zoneCacheEntry{}
+	}
+	if _, ok := z.entries[key]; !ok && len(z.entries) >= maxSize {
+		now := time.Now()
+		for k, entry := range z.entries {
+			if now.After(entry.expires) {
+				delete(z.entries, k)
+			}
+		}
+		for len(z.entries) >= maxSize {
+			var next string
+			for k, entry := range z.entries {
+				if next == "" || entry.expires.Before(z.entries[next].expires) {
+					next = k
+				}
+			}
+			delete(z.entries, next)
+		}
+	}
+	z.entries[key] = zoneCacheEntry{zoneID: zoneID, expires: time.Now().Add(ttl)}
+}
+
+// prewarmZoneCache looks up and caches the IDs of the PrewarmZones of the
+// default config, so that the first challenges for them don't have to.
+// Zones failing to resolve are logged and left to the first challenge.
+// Challenges only find the cached IDs if they use the same API token as the
+// default config.
+func (c *hetznerDNSProviderSolver) prewarmZoneCache(stopCh <-chan struct{}) {
+	cfg, err := loadConfigWithDefaults(nil, c.defaults)
+	if len(cfg.PrewarmZones) == 0 {
+		return
+	}
+	if err != nil {
+		klog.Warningf("not prewarming the zone cache: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cached := 0
+	for _, zone := range cfg.PrewarmZones {
+		if err := c.prewarmZone(ctx, cfg, zone); err != nil {
+			klog.Warningf("failed to prewarm the zone cache with zone %s: %v", zone, err)
+			continue
+		}
+		cached++
+	}
+	klog.Infof("prewarmed the zone cache with %d of %d zones", cached, len(cfg.PrewarmZones))
+}
+
+// prewarmZone resolves the ID of zone, caching it.
+func (c *hetznerDNSProviderSolver) prewarmZone(ctx context.Context, cfg hetznerDNSProviderConfig, zone string) error {
+	zone, err := toASCII(normalizeName(zone))
+	if err != nil {
+		return err
+	}
+	client, err := c.newClient(ctx, cfg, &v1alpha1.ChallengeRequest{}, zone)
+	if err != nil {
+		return err
+	}
+	_, err = c.resolveZoneID(ctx, client, cfg, zone)
+	return err
+}
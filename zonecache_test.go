@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+)
+
+func TestZoneCache(t *testing.T) {
+	var cache zoneCache
+
+	_, ok := cache.get("example.com")
+	assert.False(t, ok)
+
+	cache.put("example.com", "zone1", time.Minute, 2)
+	zoneID, ok := cache.get("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "zone1", zoneID)
+
+	cache.put("expired.com", "zone2", -time.Second, 2)
+	_, ok = cache.get("expired.com")
+	assert.False(t, ok, "expired entries must not be returned")
+
+	// expired entries are evicted first, then the one expiring next
+	cache.put("example.org", "zone3", 2*time.Minute, 2)
+	assert.Len(t, cache.entries, 2)
+	cache.put("example.net", "zone4", 3*time.Minute, 2)
+	assert.Len(t, cache.entries, 2)
+	_, ok = cache.get("example.com")
+	assert.False(t, ok)
+	_, ok = cache.get("example.org")
+	assert.True(t, ok)
+	_, ok = cache.get("example.net")
+	assert.True(t, ok)
+}
+
+func TestZoneCache_Concurrent(t *testing.T) {
+	var cache zoneCache
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			zone := fmt.Sprintf("zone%d.com", i%5)
+			cache.put(zone, "id", time.Minute, 3)
+			cache.get(zone)
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, len(cache.entries) <= 3)
+}
+
+func TestPrewarmZoneCache(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1", "example.org": "zone2"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL, defaults: solverDefaults{
+		Config: []byte(`{"apiKey": "token", "zoneCacheSeconds": 300, "prewarmZones": ["Example.com.", "missing.net", "example.org"]}`),
+	}}
+
+	logs, restore := captureLogs(0)
+	defer restore()
+	solver.prewarmZoneCache(make(chan struct{}))
+	assert.Contains(t, logs.String(), "failed to prewarm the zone cache with zone missing.net: zone not found: missing.net")
+	assert.Contains(t, logs.String(), "prewarmed the zone cache with 2 of 3 zones")
+	lookups := m.countRequests("GET /zones")
+
+	// challenges use the cached IDs
+	assert.NoError(t, solver.Present(newChallengeRequest("key", `{}`)))
+	assert.NoError(t, solver.CleanUp(newChallengeRequest("key", `{}`)))
+	assert.Equal(t, lookups, m.countRequests("GET /zones"), "no zone must be looked up after prewarming")
+}
+
+func TestPrewarmZoneCache_Disabled(t *testing.T) {
+	m, srv := newMockHetznerAPI(map[string]string{"example.com": "zone1"})
+	defer srv.Close()
+	solver := &hetznerDNSProviderSolver{apiURL: srv.URL}
+
+	solver.prewarmZoneCache(make(chan struct{}))
+	assert.Empty(t, m.requests)
+
+	_, err := loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "prewarmZones": ["example.com"]}`)})
+	assert.EqualError(t, err, "prewarmZones requires zoneCacheSeconds to be set")
+	_, err = loadConfig(&extapi.JSON{Raw: []byte(`{"apiKey": "token", "zoneCacheSeconds": 60, "prewarmZones": [" "]}`)})
+	assert.EqualError(t, err, "prewarmZones[0] must not be blank")
+}